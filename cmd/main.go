@@ -1,10 +1,27 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
 	"github.com/aws/aws-lambda-go/lambda"
 	ecrImageSync "github.com/martijnvdp/lambda-ecr-image-sync/pkg/lambda"
 )
 
 func main() {
-	lambda.Start(ecrImageSync.Start)
+	// run the webhook receiver as a local http server instead of a lambda function
+	if addr := os.Getenv("WEBHOOK_LISTEN_ADDR"); addr != "" {
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           ecrImageSync.WebhookHTTPHandler(),
+			IdleTimeout:       60 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+		}
+		log.Fatal(server.ListenAndServe())
+	}
+	lambda.Start(ecrImageSync.Handler)
 }
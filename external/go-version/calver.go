@@ -0,0 +1,120 @@
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// calVerToken is a placeholder of a calendar version layout, see
+// https://calver.org for the notation.
+type calVerToken struct {
+	token   string
+	pattern string
+	min     int64
+	max     int64
+}
+
+// calVerTokens are matched in order, so longer tokens like YYYY go before YY.
+var calVerTokens = []calVerToken{
+	{token: "YYYY", pattern: `([0-9]{4})`, min: 0, max: 9999},
+	{token: "YY", pattern: `([0-9]{1,2})`, min: 0, max: 99},
+	{token: "0M", pattern: `([0-9]{2})`, min: 1, max: 12},
+	{token: "MM", pattern: `([0-9]{1,2})`, min: 1, max: 12},
+	{token: "0D", pattern: `([0-9]{2})`, min: 1, max: 31},
+	{token: "DD", pattern: `([0-9]{1,2})`, min: 1, max: 31},
+	{token: "hh", pattern: `([0-9]{2})`, min: 0, max: 23},
+	{token: "mm", pattern: `([0-9]{2})`, min: 0, max: 59},
+	{token: "ss", pattern: `([0-9]{2})`, min: 0, max: 59},
+}
+
+// CalVerFormat parses calendar versions like 2024.10.01, 20241018-abc123 or
+// RELEASE.2024-10-02T17-50-41Z with a layout like YYYY.0M.0D, YYYY0M0D or
+// RELEASE.YYYY-0M-0DThh-mm-ssZ.
+//
+// Every placeholder of the layout becomes a segment of the version, so
+// 20241018 parsed with YYYY0M0D equals 2024.10.18 and can be checked with
+// constraints like ">= 2024.06". Anything after the layout separated by
+// - _ . or + is kept as metadata, like the commit abc123 of 20241018-abc123.
+type CalVerFormat struct {
+	layout string
+	tokens []calVerToken
+	re     *regexp.Regexp
+}
+
+// NewCalVerFormat returns the format of the layout. The layout supports the
+// placeholders YYYY, YY, 0M, MM, 0D, DD, hh, mm and ss, other characters
+// are matched literally.
+func NewCalVerFormat(layout string) (*CalVerFormat, error) {
+	var (
+		pattern strings.Builder
+		tokens  []calVerToken
+	)
+
+	for rest := layout; rest != ""; {
+		matched := false
+
+		for _, t := range calVerTokens {
+			if strings.HasPrefix(rest, t.token) {
+				pattern.WriteString(t.pattern)
+				tokens = append(tokens, t)
+				rest = rest[len(t.token):]
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			pattern.WriteString(regexp.QuoteMeta(rest[:1]))
+			rest = rest[1:]
+		}
+	}
+
+	if len(tokens) == 0 || (tokens[0].token != "YYYY" && tokens[0].token != "YY") {
+		return nil, fmt.Errorf("Malformed calver layout: %s, it has to start with the year YYYY or YY", layout)
+	}
+
+	return &CalVerFormat{
+		layout: layout,
+		tokens: tokens,
+		re:     regexp.MustCompile("^" + pattern.String() + `(?:[-_.+]([0-9A-Za-z\-_.]+))?$`),
+	}, nil
+}
+
+// Parse parses a calendar version in the format.
+func (f *CalVerFormat) Parse(v string) (*Version, error) {
+	matches := f.re.FindStringSubmatch(v)
+	if matches == nil {
+		return nil, fmt.Errorf("Malformed version: %s does not match %s", v, f.layout)
+	}
+
+	segments := make([]int64, len(f.tokens))
+	for i, t := range f.tokens {
+		val, err := strconv.ParseInt(matches[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing version: %s", err)
+		}
+		if val < t.min || val > t.max {
+			return nil, fmt.Errorf("Malformed version: %s, %s out of range", v, t.token)
+		}
+		segments[i] = val
+	}
+
+	// pad to three segments like versions, 2024.10 equals 2024.10.0
+	for i := len(segments); i < 3; i++ {
+		segments = append(segments, 0)
+	}
+
+	return &Version{
+		metadata: matches[len(f.tokens)+1],
+		segments: segments,
+		si:       len(f.tokens),
+		original: v,
+	}, nil
+}
+
+// String returns the layout of the format.
+func (f *CalVerFormat) String() string {
+	return f.layout
+}
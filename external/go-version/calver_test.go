@@ -0,0 +1,117 @@
+package version
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNewCalVerFormat(t *testing.T) {
+	cases := []struct {
+		layout string
+		err    bool
+	}{
+		{"YYYY.0M.0D", false},
+		{"YYYY0M0D", false},
+		{"YY.0M", false},
+		{"RELEASE.YYYY-0M-0DThh-mm-ssZ", false},
+		{"", true},
+		{"0M.0D", true},
+		{"release", true},
+	}
+
+	for _, tc := range cases {
+		_, err := NewCalVerFormat(tc.layout)
+		if tc.err && err == nil {
+			t.Fatalf("expected error for layout: %q", tc.layout)
+		} else if !tc.err && err != nil {
+			t.Fatalf("error for layout %q: %s", tc.layout, err)
+		}
+	}
+}
+
+func TestCalVerFormatParse(t *testing.T) {
+	cases := []struct {
+		layout   string
+		version  string
+		segments []int64
+		metadata string
+		err      bool
+	}{
+		{"YYYY.0M.0D", "2024.10.01", []int64{2024, 10, 1}, "", false},
+		{"YYYY.MM", "2024.6", []int64{2024, 6, 0}, "", false},
+		{"YYYY0M0D", "20241018-abc123", []int64{2024, 10, 18}, "abc123", false},
+		{"YYYY0M0D", "20241318", nil, "", true},
+		{"YYYY0M0D", "2024101", nil, "", true},
+		{"RELEASE.YYYY-0M-0DThh-mm-ssZ", "RELEASE.2024-10-02T17-50-41Z", []int64{2024, 10, 2, 17, 50, 41}, "", false},
+		{"RELEASE.YYYY-0M-0DThh-mm-ssZ", "RELEASE.2024-10-02T17-50-41Z.fips", []int64{2024, 10, 2, 17, 50, 41}, "fips", false},
+		{"RELEASE.YYYY-0M-0DThh-mm-ssZ", "latest", nil, "", true},
+	}
+
+	for _, tc := range cases {
+		f, err := NewCalVerFormat(tc.layout)
+		if err != nil {
+			t.Fatalf("error for layout %q: %s", tc.layout, err)
+		}
+
+		v, err := f.Parse(tc.version)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("expected error for version %q with layout %q", tc.version, tc.layout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error for version %q with layout %q: %s", tc.version, tc.layout, err)
+		}
+		if !reflect.DeepEqual(v.Segments64(), tc.segments) {
+			t.Fatalf("segments for %q: %#v, expected %#v", tc.version, v.Segments64(), tc.segments)
+		}
+		if v.Metadata() != tc.metadata {
+			t.Fatalf("metadata for %q: %q, expected %q", tc.version, v.Metadata(), tc.metadata)
+		}
+		if v.Original() != tc.version {
+			t.Fatalf("original for %q: %q", tc.version, v.Original())
+		}
+	}
+}
+
+func TestCalVerConstraintAndSort(t *testing.T) {
+	f, err := NewCalVerFormat("RELEASE.YYYY-0M-0DThh-mm-ssZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{
+		"RELEASE.2024-10-02T17-50-41Z",
+		"RELEASE.2023-12-31T23-59-59Z",
+		"RELEASE.2024-10-02T09-00-00Z",
+		"RELEASE.2024-05-01T00-00-00Z",
+	}
+	versions := make([]*Version, len(tags))
+	for i, tag := range tags {
+		versions[i] = Must(f.Parse(tag))
+	}
+	sort.Sort(Collection(versions))
+
+	var sorted []string
+	for _, v := range versions {
+		sorted = append(sorted, v.Original())
+	}
+	expected := []string{
+		"RELEASE.2023-12-31T23-59-59Z",
+		"RELEASE.2024-05-01T00-00-00Z",
+		"RELEASE.2024-10-02T09-00-00Z",
+		"RELEASE.2024-10-02T17-50-41Z",
+	}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Fatalf("sorted: %#v, expected %#v", sorted, expected)
+	}
+
+	c := MustConstraints(NewConstraint(">= 2024.06"))
+	for _, v := range versions {
+		want := v.Segments64()[0] == 2024 && v.Segments64()[1] >= 6
+		if c.Check(v) != want {
+			t.Fatalf("constraint >= 2024.06 for %q: %t, expected %t", v.Original(), c.Check(v), want)
+		}
+	}
+}
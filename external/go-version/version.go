@@ -388,3 +388,112 @@ func (v *Version) String() string {
 func (v *Version) Original() string {
 	return v.original
 }
+
+// dockerCoreRegexp matches the numeric part of a docker tag like v1.2.3
+var dockerCoreRegexp = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+)*`)
+
+// dockerRevisionRegexp matches a package revision like -r1 at the end of a docker tag
+var dockerRevisionRegexp = regexp.MustCompile(`-(r[0-9]+)$`)
+
+// NormalizeDockerTag rewrites the build metadata of a docker tag to semver
+// build metadata. Docker tags can't contain +, so upstreams use _ or a
+// package revision instead: 1.2.3_build5 becomes 1.2.3+build5 and
+// v1.2.3-r1 becomes v1.2.3+r1. Other tags are returned as-is.
+func NormalizeDockerTag(v string) string {
+	if strings.Contains(v, "+") {
+		return v
+	}
+	core := dockerCoreRegexp.FindString(v)
+	if core == "" {
+		return v
+	}
+	rest := v[len(core):]
+
+	if strings.HasPrefix(rest, "_") && len(rest) > 1 {
+		return core + "+" + rest[1:]
+	}
+
+	if loc := dockerRevisionRegexp.FindStringSubmatchIndex(rest); loc != nil {
+		return core + rest[:loc[0]] + "+" + rest[loc[2]:loc[3]]
+	}
+	return v
+}
+
+// NewDockerVersion parses a docker tag like NewVersion after normalizing the
+// build metadata with NormalizeDockerTag. Original returns the tag as-is.
+func NewDockerVersion(v string) (*Version, error) {
+	result, err := NewVersion(NormalizeDockerTag(v))
+	if err != nil {
+		return nil, err
+	}
+	result.original = v
+
+	return result, nil
+}
+
+// compareMetadata compares build metadata, versions without metadata go
+// first and numbers in the metadata are compared numerically, so build5 goes
+// before build10.
+func compareMetadata(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+
+	for a != "" && b != "" {
+		chunkA, restA := metadataChunk(a)
+		chunkB, restB := metadataChunk(b)
+
+		if c := compareMetadataChunk(chunkA, chunkB); c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+
+	if a == "" && b == "" {
+		return 0
+	} else if a == "" {
+		return -1
+	}
+	return 1
+}
+
+// metadataChunk returns the leading run of digits or non digits of s
+func metadataChunk(s string) (chunk, rest string) {
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func compareMetadataChunk(a, b string) int {
+	digitA, digitB := isDigit(a[0]), isDigit(b[0])
+
+	switch {
+	case digitA && digitB:
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	case digitA:
+		return -1
+	case digitB:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -8,8 +8,17 @@ func (v Collection) Len() int {
 	return len(v)
 }
 
+// Less orders the versions by precedence, versions that only differ in
+// build metadata are ordered by metadata and then by the original string, so
+// 1.2.3 < 1.2.3+build5 < 1.2.3+build10 and 1.2.3 < v1.2.3.
 func (v Collection) Less(i, j int) bool {
-	return v[i].LessThan(v[j])
+	if c := v[i].Compare(v[j]); c != 0 {
+		return c < 0
+	}
+	if c := compareMetadata(v[i].Metadata(), v[j].Metadata()); c != 0 {
+		return c < 0
+	}
+	return v[i].Original() < v[j].Original()
 }
 
 func (v Collection) Swap(i, j int) {
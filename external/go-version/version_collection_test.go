@@ -44,3 +44,46 @@ func TestCollection(t *testing.T) {
 		t.Fatalf("bad: %#v", actual)
 	}
 }
+
+func TestCollectionMetadata(t *testing.T) {
+	versionsRaw := []string{
+		"1.2.3_build10",
+		"v1.2.3",
+		"1.2.3-r1",
+		"1.2.3",
+		"1.2.3_build5",
+		"1.2.2_build20",
+		"1.2.4",
+	}
+
+	versions := make([]*Version, len(versionsRaw))
+	for i, raw := range versionsRaw {
+		v, err := NewDockerVersion(raw)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		versions[i] = v
+	}
+
+	sort.Sort(Collection(versions))
+
+	actual := make([]string, len(versions))
+	for i, v := range versions {
+		actual[i] = v.Original()
+	}
+
+	expected := []string{
+		"1.2.2_build20",
+		"1.2.3",
+		"v1.2.3",
+		"1.2.3_build5",
+		"1.2.3_build10",
+		"1.2.3-r1",
+		"1.2.4",
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
@@ -304,6 +304,37 @@ func TestVersionMetadata(t *testing.T) {
 	}
 }
 
+func TestNewDockerVersion(t *testing.T) {
+	cases := []struct {
+		version    string
+		prerelease string
+		metadata   string
+	}{
+		{"1.2.3", "", ""},
+		{"1.2.3_build5", "", "build5"},
+		{"v1.2.3-r1", "", "r1"},
+		{"1.2.3-alpine-r2", "alpine", "r2"},
+		{"1.2.3-alpine", "alpine", ""},
+		{"1.2.3-rc1_build5", "rc1_build5", ""},
+		{"1.2.3+build5", "", "build5"},
+	}
+
+	for _, tc := range cases {
+		v, err := NewDockerVersion(tc.version)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if v.Prerelease() != tc.prerelease || v.Metadata() != tc.metadata {
+			t.Fatalf("%s: expected: %q %q\nactual: %q %q", tc.version, tc.prerelease, tc.metadata, v.Prerelease(), v.Metadata())
+		}
+
+		if v.Original() != tc.version {
+			t.Fatalf("expected original: %s\nactual: %s", tc.version, v.Original())
+		}
+	}
+}
+
 func TestVersionPrerelease(t *testing.T) {
 	cases := []struct {
 		version  string
@@ -0,0 +1,390 @@
+package lambda
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	actionAudit = "audit"
+
+	auditHMACKeyEnvVar      = "AUDIT_HMAC_KEY"
+	auditKMSKeyIDEnvVar     = "AUDIT_KMS_KEY_ID"
+	auditKMSAlgorithmEnvVar = "AUDIT_KMS_SIGNING_ALGORITHM"
+
+	auditDeletedUpstream = "deleted-upstream"
+	auditDigestMismatch  = "digest-mismatch" // the digests differ and the image has no provenance to tell why
+	auditInSync          = "in-sync"
+	auditUnknown         = "unknown" // the upstream digest can't be read
+	auditUpstreamMoved   = "upstream-moved"
+
+	defaultKMSSigningAlgorithm = kms.SigningAlgorithmSpecEcdsaSha256
+	hmacSigningAlgorithm       = "HMAC_SHA_256"
+)
+
+// auditRecord is the audit of the ecr mirrors, the fields are part of the public interface
+type auditRecord struct {
+	GeneratedAt  time.Time         `json:"generated_at"`
+	Repositories []repositoryAudit `json:"repositories"`
+	RunID        string            `json:"run_id"`
+	Tool         string            `json:"tool"`
+	ToolVersion  string            `json:"tool_version"`
+}
+
+type repositoryAudit struct {
+	Error      string     `json:"error,omitempty"`
+	Repository string     `json:"repository"`
+	Source     string     `json:"source"`
+	Tags       []tagAudit `json:"tags"`
+}
+
+type tagAudit struct {
+	ECRDigest      string `json:"ecr_digest"`
+	Error          string `json:"error,omitempty"`
+	Status         string `json:"status"` // in-sync, upstream-moved, deleted-upstream, digest-mismatch or unknown
+	Tag            string `json:"tag"`
+	UpstreamDigest string `json:"upstream_digest,omitempty"`
+}
+
+// auditSignature is uploaded next to the audit record and signs the exact bytes of the record
+type auditSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature"` // base64
+}
+
+// auditSigner signs the audit record
+type auditSigner interface {
+	sign(ctx context.Context, payload []byte) (auditSignature, error)
+}
+
+type hmacSigner struct {
+	key []byte
+}
+
+// kmsSigner signs the sha256 digest of the record with an asymmetric kms key
+type kmsSigner struct {
+	algorithm string
+	client    kmsiface.KMSAPI
+	keyID     string
+}
+
+// upstreamManifest is the part of a manifest or index used to find the platform manifests
+type upstreamManifest struct {
+	Manifests []v1.Descriptor `json:"manifests"`
+}
+
+// newAuditSigner returns the kms signer when AUDIT_KMS_KEY_ID is set, otherwise the hmac signer of AUDIT_HMAC_KEY
+func newAuditSigner(region string) (auditSigner, error) {
+	if keyID := os.Getenv(auditKMSKeyIDEnvVar); keyID != "" {
+		s, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+		if err != nil {
+			return nil, fmt.Errorf("creating kms session: %w", err)
+		}
+		return &kmsSigner{
+			algorithm: tryString(os.Getenv(auditKMSAlgorithmEnvVar), defaultKMSSigningAlgorithm),
+			client:    kms.New(s),
+			keyID:     keyID,
+		}, nil
+	}
+
+	if key := os.Getenv(auditHMACKeyEnvVar); key != "" {
+		return &hmacSigner{key: []byte(key)}, nil
+	}
+	return nil, fmt.Errorf("the audit record is signed, set %s or %s", auditKMSKeyIDEnvVar, auditHMACKeyEnvVar)
+}
+
+func (s *hmacSigner) sign(ctx context.Context, payload []byte) (auditSignature, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+
+	return auditSignature{Algorithm: hmacSigningAlgorithm, Signature: base64.StdEncoding.EncodeToString(mac.Sum(nil))}, nil
+}
+
+func (s *kmsSigner) sign(ctx context.Context, payload []byte) (auditSignature, error) {
+	digest := sha256.Sum256(payload)
+	out, err := s.client.SignWithContext(ctx, &kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(s.algorithm),
+	})
+	if err != nil {
+		return auditSignature{}, fmt.Errorf("signing with kms: %w", err)
+	}
+	return auditSignature{Algorithm: s.algorithm, KeyID: aws.StringValue(out.KeyId), Signature: base64.StdEncoding.EncodeToString(out.Signature)}, nil
+}
+
+// upstreamDigests returns the digest of the source tag and the digests of the platform manifests when it's an index
+func upstreamDigests(source string, opts ...crane.Option) (digest string, platforms []string, err error) {
+	manifest, err := crane.Manifest(source, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(manifest)
+	var index upstreamManifest
+
+	if err := json.Unmarshal(manifest, &index); err != nil {
+		return "", nil, err
+	}
+
+	for _, m := range index.Manifests {
+		platforms = append(platforms, m.Digest.String())
+	}
+	return fmt.Sprintf("sha256:%x", sum), platforms, nil
+}
+
+// classifyTag returns the status of an ecr tag, the ecr digest matches the upstream index or one of its platforms when
+// in sync. A mismatching image pushed by the sync has a provenance artifact, so the upstream tag moved. A missing
+// artifact doesn't tell why, the image may be mirrored before provenance was enabled or its provenance push failed.
+func classifyTag(ecrDigest, upstream string, platforms []string, provenance map[string]bool) string {
+	if ecrDigest == upstream {
+		return auditInSync
+	}
+
+	for _, p := range platforms {
+		if ecrDigest == p {
+			return auditInSync
+		}
+	}
+
+	if provenance[ecrDigest] {
+		return auditUpstreamMoved
+	}
+	return auditDigestMismatch
+}
+
+// provenanceDigests returns the image digests with a provenance artifact from the tags of the repository
+func provenanceDigests(tags []string) map[string]bool {
+	digests := make(map[string]bool)
+
+	for _, t := range tags {
+		if strings.HasSuffix(t, provenanceTagSuffix) {
+			digests[strings.Replace(strings.TrimSuffix(t, provenanceTagSuffix), "-", ":", 1)] = true
+		}
+	}
+	return digests
+}
+
+// auditRepository compares the digest of every tag of the ecr repository with the upstream digest
+func (svc *ecrClient) auditRepository(ctx context.Context, repo inputRepository, region string) repositoryAudit {
+	audit := repositoryAudit{Repository: repo.ecrImageName, Source: repo.source, Tags: []tagAudit{}}
+	logger := svc.log().With(logKeyPhase, phaseFilter, logKeyRepository, repo.ecrImageName, logKeySource, repo.source)
+
+	images, err := svc.getImagesFromECR(ctx, repo.ecrImageName, region, &repo)
+	if err != nil {
+		audit.Error = err.Error()
+		return audit
+	}
+	upstreamTags, err := repo.getTagsFromPublicRepo(svc.craneOptions(ctx)...)
+	if err != nil {
+		logger.Error("error auditing repository", logKeyError, err)
+		audit.Error = err.Error()
+		return audit
+	}
+	ecrDigests := make(map[string]string, len(images))
+
+	for _, image := range images {
+		ecrDigests[image.tag] = image.hash
+	}
+	upstream := make(map[string]bool, len(upstreamTags))
+
+	for _, t := range upstreamTags {
+		upstream[t] = true
+	}
+	provenance := provenanceDigests(sortedKeys(ecrDigests))
+
+	for _, tag := range sortedKeys(ecrDigests) {
+		if strings.HasSuffix(tag, provenanceTagSuffix) {
+			continue
+		}
+		audit.Tags = append(audit.Tags, svc.auditTag(ctx, repo.source, tag, ecrDigests[tag], upstream[tag], provenance))
+	}
+	return audit
+}
+
+// auditTag returns the audit of a single ecr tag
+func (svc *ecrClient) auditTag(ctx context.Context, source, tag, ecrDigest string, exists bool, provenance map[string]bool) tagAudit {
+	audit := tagAudit{ECRDigest: ecrDigest, Tag: tag}
+
+	if !exists {
+		audit.Status = auditDeletedUpstream
+		return audit
+	}
+	digest, platforms, err := upstreamDigests(source+":"+tag, svc.craneOptions(ctx)...)
+
+	if err != nil {
+		audit.Error, audit.Status = err.Error(), auditUnknown
+		return audit
+	}
+	audit.UpstreamDigest = digest
+	audit.Status = classifyTag(ecrDigest, digest, platforms, provenance)
+	return audit
+}
+
+// auditRepositories returns the audits of the repositories sorted by repository
+func (svc *ecrClient) auditRepositories(ctx context.Context, repositories []inputRepository, region string, max int) []repositoryAudit {
+	audits := make([]repositoryAudit, len(repositories))
+
+	forEach(len(repositories), max, func(i int) {
+		audits[i] = svc.auditRepository(ctx, repositories[i], region)
+	})
+	sort.Slice(audits, func(i, j int) bool { return audits[i].Repository < audits[j].Repository })
+	return audits
+}
+
+// counts returns the number of tags per status
+func (r *auditRecord) counts() map[string]int {
+	counts := make(map[string]int)
+
+	for _, repo := range r.Repositories {
+		for _, t := range repo.Tags {
+			counts[t.Status]++
+		}
+	}
+	return counts
+}
+
+// summary returns the number of tags per status
+func (r *auditRecord) summary() string {
+	counts := r.counts()
+	parts := make([]string, 0, len(counts))
+
+	for _, status := range sortedKeys(counts) {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+	}
+	return fmt.Sprintf("Audited %d repositories: %s", len(r.Repositories), tryString(strings.Join(parts, ", "), "no tags"))
+}
+
+// markdown returns the tags that are not in sync as a markdown table
+func (r *auditRecord) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# ECR image sync audit\n\n%s\n\n", r.summary())
+	b.WriteString("| Repository | Tag | Status | ECR digest | Upstream digest |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+
+	for _, repo := range r.Repositories {
+		if repo.Error != "" {
+			fmt.Fprintf(&b, "| %s |  | error: %s |  |  |\n", repo.Repository, strings.ReplaceAll(repo.Error, "|", `\|`))
+		}
+
+		for _, t := range repo.Tags {
+			if t.Status != auditInSync {
+				fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", repo.Repository, t.Tag, t.Status, t.ECRDigest, t.UpstreamDigest)
+			}
+		}
+	}
+	return b.String()
+}
+
+// uploadAudit signs the audit record and uploads the record and the signature with the key template of the s3 output
+func uploadAudit(ctx context.Context, uploader s3manageriface.UploaderAPI, signer auditSigner, r *auditRecord, opts s3OutputOptions) (keys []string, err error) {
+	record, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.sign(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := json.Marshal(signature)
+	if err != nil {
+		return nil, err
+	}
+	outputs := []struct {
+		format, ext string
+		body        []byte
+	}{
+		{"json", "json", record},
+		{"signature", "sig", sig},
+	}
+
+	objects := make([]keyTemplateData, len(outputs))
+
+	for i, o := range outputs {
+		objects[i] = keyTemplateData{name: actionAudit, format: o.format, ext: o.ext, runID: opts.runID, time: opts.time}
+	}
+
+	if err := checkKeyTemplate(opts.keyTemplate, objects); err != nil {
+		return nil, err
+	}
+
+	for i, o := range outputs {
+		key := renderKeyTemplate(opts.keyTemplate, objects[i])
+		body := o.body
+
+		err := uploadStream(ctx, uploader, key, "application/json", &opts, func(w io.Writer) error {
+			_, err := w.Write(body)
+			return err
+		})
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// runAudit audits the repositories, uploads the signed record to the s3 bucket and sends the findings to the notifiers
+func (svc *ecrClient) runAudit(ctx context.Context, event LambdaEvent, env environmentVars, repositories []inputRepository, max int, n notifiers, result *runResult) (response, error) {
+	if env.awsBucket == "" {
+		return returnErr(ctx, fmt.Errorf("BUCKET_NAME is not set"), n, result,
+			"Error uploading the audit record:")
+	}
+	signer, err := newAuditSigner(env.awsRegion)
+	if err != nil {
+		return returnErr(ctx, err, n, result,
+			"Error configuring the audit signer:")
+	}
+	record := &auditRecord{
+		GeneratedAt:  time.Now().UTC(),
+		Repositories: svc.auditRepositories(ctx, repositories, env.awsRegion, max),
+		RunID:        result.RunID,
+		Tool:         toolName,
+		ToolVersion:  toolVersion(),
+	}
+	uploader, err := newS3Uploader(env.awsRegion, env.s3Endpoint)
+	if err != nil {
+		return returnErr(ctx, err, n, result,
+			"Error creating S3 client:")
+	}
+
+	outputCtx, outputSpan := startSpan(ctx, phaseOutput)
+	keys, err := uploadAudit(outputCtx, uploader, signer, record, s3OutputOptionsFromEvent(event, env, result))
+	endSpan(outputSpan, err)
+
+	if err != nil {
+		return returnErr(ctx, err, n, result,
+			"Error uploading the audit record to the S3 Bucket:")
+	}
+	svc.log().Info("uploaded audit record", logKeyPhase, phaseOutput, "keys", keys)
+
+	result.Ok = true
+	result.Message = record.summary()
+	result.Report = record.markdown()
+	result.Finished = time.Now()
+	n.notify(ctx, result)
+
+	return response{
+		Audit:   record,
+		Message: result.Message,
+		Ok:      true,
+	}, nil
+}
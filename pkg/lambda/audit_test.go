@@ -0,0 +1,218 @@
+package lambda
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+type mockKMSClient struct {
+	kmsiface.KMSAPI
+	input *kms.SignInput
+}
+
+func (m *mockKMSClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	m.input = input
+	return &kms.SignOutput{KeyId: input.KeyId, Signature: []byte("signature"), SigningAlgorithm: input.SigningAlgorithm}, nil
+}
+
+func Test_classifyTag(t *testing.T) {
+	tests := []struct {
+		name       string
+		ecrDigest  string
+		platforms  []string
+		provenance map[string]bool
+		want       string
+	}{
+		{name: "same digest", ecrDigest: "sha256:index", want: auditInSync},
+		{name: "platform of the index", ecrDigest: "sha256:amd64", platforms: []string{"sha256:arm64", "sha256:amd64"}, want: auditInSync},
+		{name: "synced image", ecrDigest: "sha256:old", provenance: map[string]bool{"sha256:old": true}, want: auditUpstreamMoved},
+		{name: "image without provenance", ecrDigest: "sha256:local", provenance: map[string]bool{"sha256:old": true}, want: auditDigestMismatch},
+		{name: "no provenance", ecrDigest: "sha256:old", want: auditDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyTag(tt.ecrDigest, "sha256:index", tt.platforms, tt.provenance); got != tt.want {
+				t.Errorf("classifyTag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provenanceDigests(t *testing.T) {
+	got := provenanceDigests([]string{"1.25.3", "sha256-abcd.provenance", "latest"})
+
+	if want := map[string]bool{"sha256:abcd": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("provenanceDigests() = %v, want %v", got, want)
+	}
+}
+
+func Test_upstreamDigests(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	index, _ := random.Index(512, 1, 2)
+	ref, _ := name.ParseReference(host + "/library/nginx:1.25.3")
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatalf("WriteIndex() error = %v", err)
+	}
+	want, _ := index.Digest()
+	manifest, _ := index.IndexManifest()
+
+	digest, platforms, err := upstreamDigests(host + "/library/nginx:1.25.3")
+	if err != nil {
+		t.Fatalf("upstreamDigests() error = %v", err)
+	}
+
+	if digest != want.String() || len(platforms) != 2 || platforms[0] != manifest.Manifests[0].Digest.String() {
+		t.Errorf("upstreamDigests() = %v %v, want %v with the 2 platform manifests", digest, platforms, want)
+	}
+}
+
+func Test_auditRepository(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, _ := random.Image(512, 1)
+	for _, tag := range []string{"v1.1.1", "v1.1.2"} {
+		if err := crane.Push(img, host+"/library/app:"+tag); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+	upstream, _ := img.Digest()
+	ecrDigest := "sha256:1234567890123456789012345678901234567890123456789012345678901234"
+	svc := &ecrClient{ECRAPI: &mockECRClient{}}
+
+	got := svc.auditRepository(context.Background(), inputRepository{ecrImageName: "dev/app", source: host + "/library/app"}, "eu-west-1")
+	want := []tagAudit{
+		{ECRDigest: ecrDigest, Status: auditDigestMismatch, Tag: "v1.1.1", UpstreamDigest: upstream.String()},
+		{ECRDigest: ecrDigest, Status: auditDigestMismatch, Tag: "v1.1.2", UpstreamDigest: upstream.String()},
+		{ECRDigest: ecrDigest, Status: auditDeletedUpstream, Tag: "v1.1.3"},
+	}
+
+	if got.Error != "" || !reflect.DeepEqual(got.Tags, want) {
+		t.Errorf("auditRepository() = %+v, want tags %+v", got, want)
+	}
+}
+
+func Test_kmsSigner_sign(t *testing.T) {
+	client := &mockKMSClient{}
+	signer := &kmsSigner{algorithm: defaultKMSSigningAlgorithm, client: client, keyID: "alias/audit"}
+
+	got, err := signer.sign(context.Background(), []byte(`{"run_id":"run-1"}`))
+	if err != nil {
+		t.Fatalf("sign() error = %v", err)
+	}
+	digest := sha256.Sum256([]byte(`{"run_id":"run-1"}`))
+
+	if aws.StringValue(client.input.MessageType) != kms.MessageTypeDigest || !reflect.DeepEqual(client.input.Message, digest[:]) {
+		t.Errorf("sign() input = %+v, want the sha256 digest of the record", client.input)
+	}
+
+	if want := (auditSignature{Algorithm: "ECDSA_SHA_256", KeyID: "alias/audit", Signature: "c2lnbmF0dXJl"}); got != want {
+		t.Errorf("sign() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_uploadAudit(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		uploads = make(map[string][]byte)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		uploads[r.URL.Path] = body
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	uploader, err := newS3Uploader("eu-west-1", server.URL)
+	if err != nil {
+		t.Fatalf("newS3Uploader() error = %v", err)
+	}
+	record := &auditRecord{
+		GeneratedAt:  time.Date(2024, 10, 2, 0, 0, 0, 0, time.UTC),
+		Repositories: []repositoryAudit{{Repository: "dev/app", Tags: []tagAudit{{ECRDigest: "sha256:old", Status: auditUpstreamMoved, Tag: "1.0.0"}}}},
+		RunID:        "run1",
+	}
+
+	keys, err := uploadAudit(context.Background(), uploader, &hmacSigner{key: []byte("secret")}, record, s3OutputOptions{
+		bucket:      "test-bucket",
+		keyTemplate: "audit/{date}/{name}.{ext}",
+		time:        record.GeneratedAt,
+	})
+	if err != nil {
+		t.Fatalf("uploadAudit() error = %v", err)
+	}
+
+	if want := []string{"audit/2024-10-02/audit.json", "audit/2024-10-02/audit.sig"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("uploadAudit() keys = %v, want %v", keys, want)
+	}
+	var signature auditSignature
+
+	if err := json.Unmarshal(uploads["/test-bucket/audit/2024-10-02/audit.sig"], &signature); err != nil {
+		t.Fatalf("uploadAudit() signature %s: %v", uploads["/test-bucket/audit/2024-10-02/audit.sig"], err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(uploads["/test-bucket/audit/2024-10-02/audit.json"])
+
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); signature.Algorithm != hmacSigningAlgorithm || signature.Signature != want {
+		t.Errorf("uploadAudit() signature = %+v, want %s over the uploaded record", signature, want)
+	}
+}
+
+func Test_auditRecord_markdown(t *testing.T) {
+	r := &auditRecord{Repositories: []repositoryAudit{
+		{Repository: "dev/app", Tags: []tagAudit{
+			{ECRDigest: "sha256:aaaa", Status: auditInSync, Tag: "1.0.0", UpstreamDigest: "sha256:aaaa"},
+			{ECRDigest: "sha256:bbbb", Status: auditDigestMismatch, Tag: "1.1.0", UpstreamDigest: "sha256:cccc"},
+		}},
+		{Error: "unauthorized", Repository: "dev/private"},
+	}}
+
+	if got, want := r.summary(), "Audited 2 repositories: 1 digest-mismatch, 1 in-sync"; got != want {
+		t.Errorf("summary() = %q, want %q", got, want)
+	}
+	got := r.markdown()
+
+	for _, want := range []string{
+		"| dev/app | 1.1.0 | digest-mismatch | sha256:bbbb | sha256:cccc |",
+		"| dev/private |  | error: unauthorized |  |  |",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("markdown() = %s, want row %q", got, want)
+		}
+	}
+
+	if strings.Contains(got, "| 1.0.0 |") {
+		t.Errorf("markdown() = %s, want no row for tags in sync", got)
+	}
+}
@@ -1,15 +1,29 @@
 package lambda
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
 )
 
-const noConstraint string = "> 0, < 0"
+const (
+	groupByMajor        = "major"
+	groupByMinor        = "minor"
+	noConstraint string = "> 0, < 0"
+)
+
+// versionGroups limits the versions to the newest groups of a major or minor version line and the newest tags per group
+type versionGroups struct {
+	by       string
+	counts   map[string]int
+	groups   int // max number of groups, unlimited when 0
+	perGroup int // max number of tags per group, 1 when 0
+}
 
 func checkRelease(v *version.Version, c *version.Constraints) bool {
 	return v.Prerelease() == "" && c.Check(v)
@@ -94,7 +108,12 @@ func (i *inputRepository) checkVersionTags(v *version.Version, c *version.Constr
 
 func (i *inputRepository) createConstraint() (constraints version.Constraints, err error) {
 	if i.constraint != "" {
-		return version.NewConstraint(i.constraint)
+		constraint, err := parseConstraint(i.constraint)
+
+		if err != nil {
+			return nil, err
+		}
+		return version.NewConstraint(constraint)
 	}
 	return version.NewConstraint(noConstraint)
 }
@@ -127,13 +146,47 @@ func parseVersions(tags *[]string) (versionTags []string, nonVersionTags []strin
 	return versionTags, nonVersionTags
 }
 
+// parseCalVerTags returns the tags matching one of the calendar version layouts sorted from old to new, the other tags are
+// non version tags
+func parseCalVerTags(tags []string, layouts []string) (sortedTags []*version.Version, nonVersionTags []string, err error) {
+	formats := make([]*version.CalVerFormat, 0, len(layouts))
+
+	for _, l := range layouts {
+		f, err := version.NewCalVerFormat(l)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		formats = append(formats, f)
+	}
+
+	for _, t := range tags {
+		var v *version.Version
+
+		for _, f := range formats {
+			if v, err = f.Parse(t); err == nil {
+				break
+			}
+		}
+
+		if v == nil {
+			nonVersionTags = append(nonVersionTags, t)
+			continue
+		}
+		sortedTags = append(sortedTags, v)
+	}
+	sort.Strings(nonVersionTags)
+	sort.Sort(version.Collection(sortedTags))
+	return sortedTags, nonVersionTags, nil
+}
+
 func sortVersions(rawTags *[]string) (sortedTags []*version.Version, err error) {
 	for _, t := range *rawTags {
-		v, err := version.NewVersion(t)
+		v, err := version.NewDockerVersion(t)
 
 		if err != nil {
 			if strings.Contains(err.Error(), "Malformed version:") {
-				log.Println("Received malformed error:", err)
+				slog.Debug("skipping malformed version", logKeyPhase, phaseFilter, logKeyTag, t, logKeyError, err)
 				err = nil
 			} else {
 				return sortedTags, err
@@ -146,11 +199,81 @@ func sortVersions(rawTags *[]string) (sortedTags []*version.Version, err error)
 	return sortedTags, err
 }
 
+// sortTags returns the version tags of the repository sorted from old to new and the non version tags, versions are
+// calendar versions when the repository has calver layouts
+func (i *inputRepository) sortTags(tags []string) (sortedTags []*version.Version, nonVersionTags []string, err error) {
+	if len(i.calVer) > 0 {
+		return parseCalVerTags(tags, i.calVer)
+	}
+	versionTags, nonVersionTags := parseVersions(&tags)
+	sortedTags, err = sortVersions(&versionTags)
+
+	return sortedTags, nonVersionTags, err
+}
+
+// selectedVersions returns the versions sorted from old to new that pass the filters and the constraint of the repository
+func (i *inputRepository) selectedVersions(tags []string) (selected []*version.Version, err error) {
+	sortedTags, _, err := i.sortTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	versionConstraint, err := i.createConstraint()
+	if err != nil {
+		return nil, err
+	}
+	noFilter := i.checkFilter()
+
+	for _, v := range sortedTags {
+		if noFilter || i.checkVersionTags(v, &versionConstraint) {
+			selected = append(selected, v)
+		}
+	}
+	return selected, nil
+}
+
+// newVersionGroups returns the groups of the repository, nil when the versions are not grouped
+func (i *inputRepository) newVersionGroups() *versionGroups {
+	if i.groupBy == "" {
+		return nil
+	}
+	return &versionGroups{by: i.groupBy, counts: make(map[string]int), groups: i.groups, perGroup: maxInt(i.tagsPerGroup, 1)}
+}
+
+// groupKey returns the version line of the version, 1 for major and 1.2 for minor
+func groupKey(v *version.Version, by string) string {
+	segments := v.Segments()
+
+	if by == groupByMinor {
+		return fmt.Sprintf("%d.%d", segments[0], segments[1])
+	}
+	return strconv.Itoa(segments[0])
+}
+
+// add returns true if the version fits in its group, versions have to be added from new to old
+func (g *versionGroups) add(v *version.Version) bool {
+	if g == nil {
+		return true
+	}
+	key := groupKey(v, g.by)
+	count, found := g.counts[key]
+
+	if !found && g.groups > 0 && len(g.counts) >= g.groups {
+		return false
+	}
+
+	if count >= g.perGroup {
+		return false
+	}
+	g.counts[key] = count + 1
+	return true
+}
+
 func (i *inputRepository) checkTagsFromPublicRepo(inputTags *[]string, maxResults int) (result []string, err error) {
 	maxResults = i.getMaxResults(maxResults)
+	perVariant := maxResults // non version tags don't count for the variants
 	noFilter := i.checkFilter()
-	versionTags, nonVersionTags := parseVersions(inputTags)
-	sortedTags, err := sortVersions(&versionTags)
+	sortedTags, nonVersionTags, err := i.sortTags(*inputTags)
 
 	if err != nil {
 		return result, err
@@ -178,16 +301,18 @@ func (i *inputRepository) checkTagsFromPublicRepo(inputTags *[]string, maxResult
 		}
 	}
 
+	if len(i.variants) > 0 {
+		return append(result, i.checkVariantTags(sortedTags, versionConstraint, perVariant)...), err
+	}
+	groups := i.newVersionGroups()
+
 	// go through correct versioned tags
 	for x := len(sortedTags) - 1; x != -1; {
 		if maxResults == 0 {
 			break
 		}
 		switch {
-		case noFilter && maxResults != 0:
-			result = append(result, (sortedTags)[x].Original())
-			maxResults--
-		case i.checkVersionTags((sortedTags)[x], &versionConstraint) && maxResults != 0:
+		case (noFilter || i.checkVersionTags((sortedTags)[x], &versionConstraint)) && groups.add((sortedTags)[x]):
 			result = append(result, (sortedTags)[x].Original())
 			maxResults--
 		}
@@ -251,6 +251,145 @@ func Test_inputRepository_checkTagsFromPublicRepo(t *testing.T) {
 			wantResult: []string{"latest", "v1.4.9", "v1.4.7", "v1.4.6", "v1.4.1"},
 			wantErr:    false,
 		},
+		{
+			name: "TestGroupByMinor",
+			args: args{
+				inputTags: []string{"1.27.1", "1.27.2", "1.27.3", "1.28.0", "1.28.1", "1.29.0-rc.1", "1.29.0", "1.29.1", "1.26.9"},
+			},
+			i: &inputRepository{
+				groupBy:      groupByMinor,
+				groups:       3,
+				tagsPerGroup: 2,
+			},
+			wantResult: []string{"1.29.1", "1.29.0", "1.28.1", "1.28.0", "1.27.3", "1.27.2"},
+			wantErr:    false,
+		},
+		{
+			name: "TestGroupByMajorWithConstraint",
+			args: args{
+				inputTags: []string{"14.9", "14.10", "15.4", "15.5", "16.1", "16.2", "17.0"},
+			},
+			i: &inputRepository{
+				constraint: "< 17",
+				groupBy:    groupByMajor,
+			},
+			wantResult: []string{"16.2", "15.5", "14.10"},
+			wantErr:    false,
+		},
+		{
+			name: "TestVariants",
+			args: args{
+				inputTags:  []string{"1.25.1", "1.25.2", "1.25.3", "1.25.1-alpine", "1.25.2-alpine", "1.25.3-alpine", "1.25.3-bookworm", "latest"},
+				maxResults: 2,
+			},
+			i: &inputRepository{
+				variants: []string{variantDefault, "alpine"},
+			},
+			wantResult: []string{"latest", "1.25.3", "1.25.2", "1.25.3-alpine", "1.25.2-alpine"},
+			wantErr:    false,
+		},
+		{
+			name: "TestVariantsConstraintAndPattern",
+			args: args{
+				inputTags: []string{"1.24.0-alpine3.18", "1.25.1-alpine3.19", "1.25.2-alpine3.19", "1.26.0-alpine3.20", "1.25.2-slim"},
+			},
+			i: &inputRepository{
+				constraint:  "-lt 1.26",
+				excludeTags: []string{"1.25.1-alpine3.19"},
+				variants:    []string{"alpine*"},
+			},
+			wantResult: []string{"1.25.2-alpine3.19", "1.24.0-alpine3.18"},
+			wantErr:    false,
+		},
+		{
+			name: "TestVariantsReleaseFilters",
+			args: args{
+				inputTags: []string{"1.25.3-alpine", "1.26.0-rc1-alpine", "1.26.0-beta1-alpine", "1.25.3-ubuntu-alpine"},
+			},
+			i: &inputRepository{
+				excludeRLS: []string{"beta"},
+				includeRLS: []string{"rc", "beta"},
+				variants:   []string{"*alpine"},
+			},
+			wantResult: []string{"1.26.0-rc1-alpine", "1.25.3-alpine"},
+			wantErr:    false,
+		},
+		{
+			name: "TestVariantsReleaseOnly",
+			args: args{
+				inputTags: []string{"1.25.3-alpine", "1.26.0-rc1-alpine", "1.25.3-ubuntu-alpine"},
+			},
+			i: &inputRepository{
+				includeRLS:  []string{"ubuntu"},
+				releaseOnly: true,
+				variants:    []string{"*alpine"},
+			},
+			wantResult: []string{"1.25.3-ubuntu-alpine"},
+			wantErr:    false,
+		},
+		{
+			name: "TestCalVer",
+			args: args{
+				inputTags:  []string{"RELEASE.2024-05-01T00-00-00Z", "RELEASE.2024-10-02T17-50-41Z", "RELEASE.2024-10-02T09-00-00Z", "RELEASE.2023-12-31T23-59-59Z", "latest", "1.2.3"},
+				maxResults: 3,
+			},
+			i: &inputRepository{
+				calVer:     []string{"RELEASE.YYYY-0M-0DThh-mm-ssZ"},
+				constraint: "-ge 2024.06",
+			},
+			wantResult: []string{"RELEASE.2024-10-02T17-50-41Z", "RELEASE.2024-10-02T09-00-00Z"},
+			wantErr:    false,
+		},
+		{
+			name: "TestCalVerCompact",
+			args: args{
+				inputTags:  []string{"20240601-abc123", "20241018-def456", "20231231-0a1b2c", "main"},
+				maxResults: 2,
+			},
+			i: &inputRepository{
+				calVer: []string{"YYYY0M0D"},
+			},
+			wantResult: []string{"main", "20241018-def456"},
+			wantErr:    false,
+		},
+		{
+			name: "TestDockerBuildMetadata",
+			args: args{
+				inputTags:  []string{"1.2.3_build5", "1.2.3_build10", "1.2.3", "1.2.4-rc1", "1.2.2-r3", "v1.2.3-r1"},
+				maxResults: 3,
+			},
+			i: &inputRepository{
+				constraint: "-ge 1.2.2",
+			},
+			wantResult: []string{"v1.2.3-r1", "1.2.3_build10", "1.2.3_build5"},
+			wantErr:    false,
+		},
+		{
+			name: "TestDockerRevisionIsRelease",
+			args: args{
+				inputTags:  []string{"1.2.3-r1", "1.2.4-rc1", "1.2.2"},
+				maxResults: 5,
+			},
+			i: &inputRepository{
+				constraint: "-ge 1.2.0",
+				excludeRLS: []string{"r"},
+			},
+			wantResult: []string{"1.2.3-r1", "1.2.2"},
+			wantErr:    false,
+		},
+		{
+			name: "TestGroupByMajorMaxResults",
+			args: args{
+				inputTags:  []string{"14.9", "14.10", "15.4", "15.5", "16.1", "16.2"},
+				maxResults: 2,
+			},
+			i: &inputRepository{
+				groupBy:      groupByMajor,
+				tagsPerGroup: 2,
+			},
+			wantResult: []string{"16.2", "16.1"},
+			wantErr:    false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,442 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	checkpointDefaultMargin = 60 * time.Second // stop syncing when less time is left before the lambda deadline
+	checkpointDefaultPrefix = "checkpoints/"
+	checkpointMaxAge        = 24 * time.Hour  // checkpoints created longer ago are ignored and the run starts over
+	checkpointMaxAttempts   = 3               // a tag that failed this many times is dropped from the checkpoint
+	checkpointSaveInterval  = 5 * time.Second // finished tags are saved at most once per interval, finish always saves
+	checkpointStoreS3       = "s3"
+	checkpointTokenPrefix   = "ckpt-"
+	checkpointVersion       = "1"
+)
+
+var matchCheckpointToken = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+// checkpoint is the progress of a sync, saved while syncing and when the run stops
+type checkpoint struct {
+	Version   string           `json:"version"`
+	Token     string           `json:"token"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Failed    int              `json:"failed"`
+	Remaining []checkpointItem `json:"remaining"`
+	Synced    int              `json:"synced"`
+}
+
+type checkpointItem struct {
+	Attempts   map[string]int `json:"attempts,omitempty"` // failed attempts per tag
+	MaxSize    int64          `json:"max_size,omitempty"`
+	Repository string         `json:"repository"`
+	Rule       *WorkItem      `json:"rule,omitempty"`
+	Source     string         `json:"source"`
+	Tags       []string       `json:"tags"`
+}
+
+type checkpointStore interface {
+	delete(ctx context.Context, token string) error
+	load(ctx context.Context, token string) (*checkpoint, error) // nil when there is no checkpoint
+	save(ctx context.Context, cp *checkpoint) error
+}
+
+type fileCheckpointStore struct {
+	dir string
+}
+
+type s3CheckpointStore struct {
+	bucket string
+	prefix string
+	svc    s3iface.S3API
+}
+
+// checkpointTracker removes synced tags from the checkpoint and stops the sync before the lambda deadline
+type checkpointTracker struct {
+	interval time.Duration // minimum time between saves of finished tags
+	margin   time.Duration
+	mu       sync.Mutex
+	resumed  bool
+	saveMu   sync.Mutex // serializes the saves, held while writing to the store
+	saved    time.Time
+	state    *checkpoint
+	store    checkpointStore
+}
+
+// newCheckpointStore returns the store for the checkpoint setting: s3 for the output bucket, s3://bucket/prefix or a local directory
+func newCheckpointStore(setting string, env environmentVars) (checkpointStore, error) {
+	switch {
+	case setting == checkpointStoreS3 || strings.HasPrefix(setting, "s3://"):
+		bucket, prefix := env.awsBucket, checkpointDefaultPrefix
+
+		if setting != checkpointStoreS3 {
+			parts := strings.SplitN(strings.TrimPrefix(setting, "s3://"), "/", 2)
+			bucket, prefix = parts[0], ""
+
+			if len(parts) == 2 && parts[1] != "" {
+				prefix = strings.TrimSuffix(parts[1], "/") + "/"
+			}
+		}
+
+		if bucket == "" {
+			return nil, fmt.Errorf("checkpoint bucket not set")
+		}
+		svc, err := newS3Client(env.awsRegion, env.s3Endpoint)
+
+		if err != nil {
+			return nil, err
+		}
+		return &s3CheckpointStore{bucket: bucket, prefix: prefix, svc: svc}, nil
+	}
+	return &fileCheckpointStore{dir: strings.TrimPrefix(setting, "file://")}, nil
+}
+
+// loadCheckpoint returns the checkpoint tracker of the event
+func loadCheckpoint(ctx context.Context, event LambdaEvent, env environmentVars) (*checkpointTracker, error) {
+	store, err := newCheckpointStore(event.Checkpoint, env)
+
+	if err != nil {
+		return nil, err
+	}
+	token, err := checkpointToken(event)
+
+	if err != nil {
+		return nil, err
+	}
+	return newCheckpointTracker(ctx, store, token, time.Duration(event.CheckpointMargin)*time.Second, time.Now())
+}
+
+// checkpointToken returns the token of the checkpoint, the token is derived from the request so a new invocation
+// with the same event resumes the previous run
+func checkpointToken(event LambdaEvent) (string, error) {
+	if event.ContinuationToken != "" {
+		if !matchCheckpointToken.MatchString(event.ContinuationToken) {
+			return "", fmt.Errorf("invalid continuation token: %s", event.ContinuationToken)
+		}
+		return event.ContinuationToken, nil
+	}
+	repositories := append([]string{}, event.Repositories...)
+	sources := append([]string{}, event.Sources...)
+	tags := append([]string{}, event.Tags...)
+	sort.Strings(repositories)
+	sort.Strings(sources)
+	sort.Strings(tags)
+
+	scope, err := json.Marshal(struct {
+		Action       string    `json:"action"`
+		Item         *WorkItem `json:"item"`
+		Repositories []string  `json:"repositories"`
+		Sources      []string  `json:"sources"`
+		Tags         []string  `json:"tags,omitempty"`
+	}{tryString(event.Action, actionSync), event.Item, repositories, sources, tags})
+
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(scope)
+	return checkpointTokenPrefix + hex.EncodeToString(hash[:8]), nil
+}
+
+// newCheckpointTracker loads the checkpoint of the token, a missing or expired checkpoint starts a new run
+func newCheckpointTracker(ctx context.Context, store checkpointStore, token string, margin time.Duration, now time.Time) (*checkpointTracker, error) {
+	cp, err := store.load(ctx, token)
+
+	if err != nil {
+		return nil, fmt.Errorf("loading checkpoint %s: %w", token, err)
+	}
+	tracker := &checkpointTracker{interval: checkpointSaveInterval, margin: margin, saved: now, store: store}
+
+	if margin <= 0 {
+		tracker.margin = checkpointDefaultMargin
+	}
+
+	// the age counts from the creation, every save updates UpdatedAt so a tag that keeps failing would never expire
+	if cp != nil && cp.Version == checkpointVersion && now.Sub(cp.CreatedAt) < checkpointMaxAge {
+		tracker.resumed = true
+		tracker.state = cp
+		return tracker, nil
+	}
+	tracker.state = &checkpoint{Version: checkpointVersion, Token: token, CreatedAt: now, UpdatedAt: now}
+	return tracker, nil
+}
+
+// isResumed returns true when the run continues from a saved checkpoint
+func (c *checkpointTracker) isResumed() bool {
+	return c != nil && c.resumed
+}
+
+// syncOptions returns the remaining tags of a resumed checkpoint
+func (c *checkpointTracker) syncOptions() (options []syncOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, item := range c.state.Remaining {
+		options = append(options, syncOptions{
+			ecrImageName: item.Repository,
+			maxSize:      item.MaxSize,
+			rule:         item.Rule,
+			source:       item.Source,
+			tags:         append([]string{}, item.Tags...),
+		})
+	}
+	return options
+}
+
+// start saves the tags to sync as remaining
+func (c *checkpointTracker) start(ctx context.Context, options []syncOptions) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.state.Remaining = nil
+
+	for _, o := range options {
+		if len(o.tags) > 0 {
+			c.state.Remaining = append(c.state.Remaining, checkpointItem{MaxSize: o.maxSize, Repository: o.ecrImageName, Rule: o.rule, Source: o.source, Tags: append([]string{}, o.tags...)})
+		}
+	}
+	c.mu.Unlock()
+	return c.save(ctx)
+}
+
+// done removes a synced tag from the remaining tags, failed tags stay for the next run until they failed
+// checkpointMaxAttempts times. The checkpoint is saved when the save interval has passed and no other save is running
+func (c *checkpointTracker) done(ctx context.Context, repository, tag string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+
+	if err != nil {
+		c.state.Failed++
+
+		if c.failLocked(repository, tag) >= checkpointMaxAttempts {
+			slog.Warn("dropping tag from the checkpoint", logKeyPhase, phaseSync, logKeyRepository, repository, logKeyTag, tag, "attempts", checkpointMaxAttempts)
+			c.removeLocked(repository, tag)
+		}
+	} else {
+		c.state.Synced++
+		c.removeLocked(repository, tag)
+	}
+	due := time.Since(c.saved) >= c.interval
+	c.mu.Unlock()
+
+	if !due || !c.saveMu.TryLock() {
+		return
+	}
+	defer c.saveMu.Unlock()
+
+	if err := c.saveUnlocked(ctx); err != nil {
+		slog.Error("error saving checkpoint", logKeyPhase, phaseSync, "token", c.state.Token, logKeyError, err)
+	}
+}
+
+// failLocked counts a failed attempt of the tag of the repository and returns the attempts
+func (c *checkpointTracker) failLocked(repository, tag string) int {
+	for i, item := range c.state.Remaining {
+		if item.Repository != repository {
+			continue
+		}
+
+		if item.Attempts == nil {
+			c.state.Remaining[i].Attempts = make(map[string]int)
+		}
+		c.state.Remaining[i].Attempts[tag]++
+		return c.state.Remaining[i].Attempts[tag]
+	}
+	return 0
+}
+
+// removeLocked removes the tag of the repository from the remaining tags
+func (c *checkpointTracker) removeLocked(repository, tag string) {
+	for i, item := range c.state.Remaining {
+		if item.Repository != repository {
+			continue
+		}
+		for j, t := range item.Tags {
+			if t == tag {
+				c.state.Remaining[i].Tags = append(item.Tags[:j:j], item.Tags[j+1:]...)
+				delete(item.Attempts, tag)
+				break
+			}
+		}
+		if len(c.state.Remaining[i].Tags) == 0 {
+			c.state.Remaining = append(c.state.Remaining[:i:i], c.state.Remaining[i+1:]...)
+		}
+		return
+	}
+}
+
+// stop returns true when the lambda deadline is within the margin, the remaining tags are left for the next run
+func (c *checkpointTracker) stop(ctx context.Context) bool {
+	if c == nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < c.margin
+}
+
+// finish deletes the checkpoint when all tags are done, otherwise it returns the continuation token
+func (c *checkpointTracker) finish(ctx context.Context) (token string, remaining int, err error) {
+	if c == nil {
+		return "", 0, nil
+	}
+	c.mu.Lock()
+	for _, item := range c.state.Remaining {
+		remaining += len(item.Tags)
+	}
+	c.mu.Unlock()
+
+	if remaining == 0 {
+		c.saveMu.Lock()
+		defer c.saveMu.Unlock()
+		return "", 0, c.store.delete(ctx, c.state.Token)
+	}
+	return c.state.Token, remaining, c.save(ctx)
+}
+
+// save waits for a running save and saves the checkpoint
+func (c *checkpointTracker) save(ctx context.Context) error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	return c.saveUnlocked(ctx)
+}
+
+// saveUnlocked saves a copy of the checkpoint without holding the state lock, the caller holds saveMu
+func (c *checkpointTracker) saveUnlocked(ctx context.Context) error {
+	c.mu.Lock()
+	now := time.Now()
+	c.saved, c.state.UpdatedAt = now, now
+	snapshot := *c.state
+	snapshot.Remaining = make([]checkpointItem, len(c.state.Remaining))
+
+	for i, item := range c.state.Remaining {
+		snapshot.Remaining[i] = item
+		snapshot.Remaining[i].Tags = append([]string{}, item.Tags...)
+		snapshot.Remaining[i].Attempts = make(map[string]int, len(item.Attempts))
+
+		for tag, n := range item.Attempts {
+			snapshot.Remaining[i].Attempts[tag] = n
+		}
+	}
+	c.mu.Unlock()
+	return c.store.save(ctx, &snapshot)
+}
+
+func (f *fileCheckpointStore) path(token string) string {
+	return filepath.Join(f.dir, token+".json")
+}
+
+func (f *fileCheckpointStore) load(ctx context.Context, token string) (*checkpoint, error) {
+	content, err := os.ReadFile(f.path(token))
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	return cp, json.Unmarshal(content, cp)
+}
+
+func (f *fileCheckpointStore) save(ctx context.Context, cp *checkpoint) error {
+	content, err := json.Marshal(cp)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+	tmp := f.path(cp.Token) + ".tmp"
+
+	// write and rename so a timeout during the write does not leave a broken checkpoint
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(cp.Token))
+}
+
+func (f *fileCheckpointStore) delete(ctx context.Context, token string) error {
+	if err := os.Remove(f.path(token)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *s3CheckpointStore) key(token string) string {
+	return s.prefix + token + ".json"
+}
+
+func (s *s3CheckpointStore) load(ctx context.Context, token string) (*checkpoint, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(token)),
+	})
+	var awsErr awserr.Error
+
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	content, err := io.ReadAll(out.Body)
+
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	return cp, json.Unmarshal(content, cp)
+}
+
+func (s *s3CheckpointStore) save(ctx context.Context, cp *checkpoint) error {
+	content, err := json.Marshal(cp)
+
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(cp.Token)),
+		Body:                 bytes.NewReader(content),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	})
+	return err
+}
+
+func (s *s3CheckpointStore) delete(ctx context.Context, token string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(token)),
+	})
+	return err
+}
@@ -0,0 +1,153 @@
+package lambda
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_checkpointToken(t *testing.T) {
+	a, _ := checkpointToken(LambdaEvent{Repositories: []string{"dev/nginx", "dev/redis"}})
+	b, _ := checkpointToken(LambdaEvent{Action: "sync", Repositories: []string{"dev/redis", "dev/nginx"}})
+	c, _ := checkpointToken(LambdaEvent{Repositories: []string{"dev/nginx"}})
+
+	if a != b {
+		t.Errorf("checkpointToken() = %v and %v, want the same token for the same repositories", a, b)
+	}
+	if a == c {
+		t.Errorf("checkpointToken() = %v, want a different token for other repositories", c)
+	}
+	d, _ := checkpointToken(LambdaEvent{Sources: []string{"docker.io/nginx"}, Tags: []string{"1.25.3"}})
+	e, _ := checkpointToken(LambdaEvent{Sources: []string{"docker.io/nginx"}, Tags: []string{"1.25.4"}})
+
+	if d == e {
+		t.Errorf("checkpointToken() = %v, want a different token for other tags", e)
+	}
+	if got, err := checkpointToken(LambdaEvent{ContinuationToken: "ckpt-123"}); err != nil || got != "ckpt-123" {
+		t.Errorf("checkpointToken() = %v, %v, want ckpt-123", got, err)
+	}
+	if _, err := checkpointToken(LambdaEvent{ContinuationToken: "../../etc/passwd"}); err == nil {
+		t.Errorf("checkpointToken() accepted a path as token")
+	}
+}
+
+func Test_checkpointTracker(t *testing.T) {
+	ctx := context.Background()
+	store := &fileCheckpointStore{dir: t.TempDir()}
+	now := time.Now()
+
+	tracker, err := newCheckpointTracker(ctx, store, "ckpt-test", 0, now)
+	if err != nil || tracker.isResumed() {
+		t.Fatalf("newCheckpointTracker() = %v, %v, want a new checkpoint", tracker, err)
+	}
+	tracker.interval = 0
+	err = tracker.start(ctx, []syncOptions{
+		{ecrImageName: "dev/nginx", source: "docker.io/nginx", tags: []string{"1.23.3", "1.23.2"}},
+		{ecrImageName: "dev/redis", source: "docker.io/redis", tags: []string{"7.0.5"}},
+		{ecrImageName: "dev/skipped", source: "docker.io/skipped", skipped: []string{"1.0.0"}},
+	})
+	if err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	tracker.done(ctx, "dev/nginx", "1.23.3", nil)
+	tracker.done(ctx, "dev/nginx", "1.23.2", errors.New("denied"))
+	tracker.done(ctx, "dev/redis", "7.0.5", nil)
+
+	// a new invocation resumes with the remaining tags
+	resumed, err := newCheckpointTracker(ctx, store, "ckpt-test", 0, now)
+	if err != nil || !resumed.isResumed() {
+		t.Fatalf("newCheckpointTracker() = %v, %v, want a resumed checkpoint", resumed, err)
+	}
+	// the failed tag is retried
+	want := []syncOptions{{ecrImageName: "dev/nginx", source: "docker.io/nginx", tags: []string{"1.23.2"}}}
+	if got := resumed.syncOptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("syncOptions() = %v, want %v", got, want)
+	}
+	if token, remaining, err := resumed.finish(ctx); token != "ckpt-test" || remaining != 1 || err != nil {
+		t.Errorf("finish() = %v, %v, %v, want ckpt-test, 1", token, remaining, err)
+	}
+
+	resumed.interval = 0
+	resumed.done(ctx, "dev/nginx", "1.23.2", nil)
+	if token, remaining, err := resumed.finish(ctx); token != "" || remaining != 0 || err != nil {
+		t.Errorf("finish() = %v, %v, %v, want no token when all tags are done", token, remaining, err)
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, "ckpt-test.json")); !os.IsNotExist(err) {
+		t.Errorf("finish() did not delete the checkpoint: %v", err)
+	}
+
+	// finished tags are saved at most once per interval
+	debounced, _ := newCheckpointTracker(ctx, store, "ckpt-debounced", 0, now)
+	debounced.start(ctx, []syncOptions{{ecrImageName: "dev/nginx", source: "docker.io/nginx", tags: []string{"1.23.3", "1.23.2"}}})
+	debounced.done(ctx, "dev/nginx", "1.23.3", nil)
+
+	if saved, _ := store.load(ctx, "ckpt-debounced"); len(saved.Remaining[0].Tags) != 2 {
+		t.Errorf("done() saved %v within the save interval", saved.Remaining)
+	}
+	if _, remaining, _ := debounced.finish(ctx); remaining != 1 {
+		t.Errorf("finish() remaining = %v, want 1", remaining)
+	}
+	if saved, _ := store.load(ctx, "ckpt-debounced"); len(saved.Remaining[0].Tags) != 1 {
+		t.Errorf("finish() saved %v, want the remaining tag", saved.Remaining)
+	}
+
+	// expired checkpoints start over, also when they were saved recently
+	store.save(ctx, &checkpoint{Version: checkpointVersion, Token: "ckpt-old", CreatedAt: now.Add(-2 * checkpointMaxAge), UpdatedAt: now})
+	if expired, _ := newCheckpointTracker(ctx, store, "ckpt-old", 0, now); expired.isResumed() {
+		t.Errorf("newCheckpointTracker() resumed an expired checkpoint")
+	}
+}
+
+func Test_checkpointTracker_failingTag(t *testing.T) {
+	ctx := context.Background()
+	store := &fileCheckpointStore{dir: t.TempDir()}
+	now := time.Now()
+
+	// every scheduled invocation with the same event resumes the checkpoint and the same tag fails again
+	for i := 1; i <= checkpointMaxAttempts; i++ {
+		tracker, err := newCheckpointTracker(ctx, store, "ckpt-failing", 0, now.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatalf("newCheckpointTracker() error = %v", err)
+		}
+
+		if i == 1 {
+			tracker.start(ctx, []syncOptions{{ecrImageName: "dev/nginx", source: "docker.io/nginx", tags: []string{"1.23.3", "broken"}}})
+			tracker.done(ctx, "dev/nginx", "1.23.3", nil)
+		} else if !tracker.isResumed() || !reflect.DeepEqual(tracker.syncOptions()[0].tags, []string{"broken"}) {
+			t.Fatalf("invocation %d resumed %v, want the failed tag", i, tracker.syncOptions())
+		}
+		tracker.done(ctx, "dev/nginx", "broken", errors.New("manifest unknown"))
+		token, remaining, err := tracker.finish(ctx)
+
+		if i < checkpointMaxAttempts && (token != "ckpt-failing" || remaining != 1 || err != nil) {
+			t.Errorf("finish() after %d attempts = %v, %v, %v, want the tag retried", i, token, remaining, err)
+		}
+
+		if i == checkpointMaxAttempts && (token != "" || remaining != 0 || err != nil) {
+			t.Errorf("finish() after %d attempts = %v, %v, %v, want the tag dropped", i, token, remaining, err)
+		}
+	}
+
+	// the next invocation lists the repositories again
+	if tracker, _ := newCheckpointTracker(ctx, store, "ckpt-failing", 0, now.Add(4*time.Hour)); tracker.isResumed() {
+		t.Errorf("newCheckpointTracker() resumed a checkpoint with a dropped tag")
+	}
+}
+
+func Test_syncImages_stopBeforeDeadline(t *testing.T) {
+	store := &fileCheckpointStore{dir: t.TempDir()}
+	tracker, _ := newCheckpointTracker(context.Background(), store, "ckpt-test", time.Minute, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	svc := &ecrClient{checkpoint: tracker}
+	got, err := svc.syncImages(ctx, syncOptions{ecrImageName: "dev/nginx", source: "docker.io/nginx", tags: []string{"1.23.3", "1.23.2"}}, environmentVars{})
+
+	if got.failed != nil || err != nil || got.tags != nil || !reflect.DeepEqual(got.pending, []string{"1.23.3", "1.23.2"}) {
+		t.Errorf("syncImages() = %v, %v, %v, want all tags pending", got.failed, got.pending, err)
+	}
+}
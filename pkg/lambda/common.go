@@ -2,6 +2,7 @@ package lambda
 
 import (
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,6 +14,14 @@ func tryString(s1, s2 string) string {
 	return s2
 }
 
+// tryInt returns the first non zero int
+func tryInt(i1, i2 int) int {
+	if i1 != 0 {
+		return i1
+	}
+	return i2
+}
+
 // maxInt returns the max int
 func maxInt(x, y int) int {
 	if x > y {
@@ -37,3 +46,23 @@ func parseTime(s string) time.Time {
 	}
 	return t
 }
+
+// forEach calls fn for 0 to n-1 with at most max calls running at the same time
+func forEach(n, max int, fn func(i int)) {
+	var (
+		sem = make(chan struct{}, maxInt(max, 1))
+		wg  sync.WaitGroup
+	)
+
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,76 @@
+package lambda
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
+)
+
+// constraintOperators are the tag safe operators of ecr_sync_constraint, aws tags don't allow characters like > < ! ~ or ,
+var constraintOperators = map[string]string{
+	"-eq": "=",
+	"-ge": ">=",
+	"-gt": ">",
+	"-le": "<=",
+	"-lt": "<",
+	"-ne": "!=",
+	"-pe": "~>", // pessimistic, -pe 1.2 allows 1.x from 1.2 and -pe 1.2.3 allows 1.2.x from 1.2.3
+}
+
+// versionOperators are the operators of go-version, longest first so >= is matched before >
+var versionOperators = []string{"!=", "<=", ">=", "~>", "<", "=", ">"}
+
+// parseConstraint converts a constraint with tag safe operators like "-ge 1.2 -lt 2.0 -ne 1.5.3" to the
+// go-version constraint ">= 1.2, < 2.0, != 1.5.3", go-version operators and commas are accepted as well.
+// A version without operator is an exact match
+func parseConstraint(s string) (string, error) {
+	tokens := strings.Fields(strings.ReplaceAll(s, ",", " "))
+
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("empty constraint")
+	}
+	var (
+		clauses []string
+		op      string
+	)
+
+	for _, token := range tokens {
+		if tagOp, ok := constraintOperators[token]; ok {
+			if op != "" {
+				return "", fmt.Errorf("operator %q not followed by a version", op)
+			}
+			op = tagOp
+			continue
+		}
+
+		if strings.HasPrefix(token, "-") {
+			return "", fmt.Errorf("unknown operator %q, use one of %s", token, strings.Join(sortedKeys(constraintOperators), " "))
+		}
+
+		for _, vo := range versionOperators {
+			if strings.HasPrefix(token, vo) {
+				if op != "" {
+					return "", fmt.Errorf("operator %q not followed by a version", op)
+				}
+				op, token = vo, strings.TrimPrefix(token, vo)
+				break
+			}
+		}
+
+		if token == "" {
+			continue
+		}
+
+		if _, err := version.NewVersion(token); err != nil {
+			return "", fmt.Errorf("invalid version %q", token)
+		}
+		clauses = append(clauses, strings.TrimSpace(tryString(op, "=")+" "+token))
+		op = ""
+	}
+
+	if op != "" {
+		return "", fmt.Errorf("operator %q not followed by a version", op)
+	}
+	return strings.Join(clauses, ", "), nil
+}
@@ -0,0 +1,47 @@
+package lambda
+
+import (
+	"testing"
+
+	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
+)
+
+func Test_parseConstraint(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "TestSingle", input: "-ge v1.1.1", want: ">= v1.1.1"},
+		{name: "TestLessOrEqual", input: "-le 2.0", want: "<= 2.0"},
+		{name: "TestRange", input: "-ge 1.2 -lt 2.0 -ne 1.5.3", want: ">= 1.2, < 2.0, != 1.5.3"},
+		{name: "TestPessimistic", input: "-pe 1.2", want: "~> 1.2"},
+		{name: "TestEqual", input: "-eq 1.2.3", want: "= 1.2.3"},
+		{name: "TestNoOperator", input: "1.2.3", want: "= 1.2.3"},
+		{name: "TestGoVersion", input: ">= 1.2, < 2.0", want: ">= 1.2, < 2.0"},
+		{name: "TestGoVersionWithoutSpace", input: ">=1.2,<2.0", want: ">= 1.2, < 2.0"},
+		{name: "TestUnknownOperator", input: "-ap 1.2", wantErr: true},
+		{name: "TestMissingVersion", input: "-ge 1.2 -lt", wantErr: true},
+		{name: "TestDoubleOperator", input: "-ge -lt 2.0", wantErr: true},
+		{name: "TestInvalidVersion", input: "-ge one", wantErr: true},
+		{name: "TestEmpty", input: " ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConstraint(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseConstraint() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseConstraint() = %v, want %v", got, tt.want)
+			}
+			if !tt.wantErr {
+				if _, err := version.NewConstraint(got); err != nil {
+					t.Errorf("version.NewConstraint(%q) error = %v", got, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package lambda
+
+import (
+	"context"
+	"strings"
+)
+
+// duplicateVersionTags returns the pairs of v prefixed and bare tags of the same version like v1.2.3 and 1.2.3
+func duplicateVersionTags(tags []string) (pairs [][2]string) {
+	bare := make(map[string]bool, len(tags))
+
+	for _, t := range tags {
+		bare[t] = true
+	}
+
+	for _, t := range tags {
+		if len(t) < 2 || t[0] != 'v' || t[1] < '0' || t[1] > '9' {
+			continue
+		}
+
+		if b := strings.TrimPrefix(t, "v"); bare[b] {
+			pairs = append(pairs, [2]string{t, b})
+		}
+	}
+	return pairs
+}
+
+// dedupeTags drops the bare tags with the same digest as the v prefixed tag, tags with a different or unknown digest are kept
+func (svc *ecrClient) dedupeTags(ctx context.Context, source string, tags []string) []string {
+	pairs := duplicateVersionTags(tags)
+
+	if len(pairs) == 0 {
+		return tags
+	}
+	logger := svc.log().With(logKeyPhase, phaseFilter, logKeySource, source)
+	drop := make(map[string]bool, len(pairs))
+
+	for _, p := range pairs {
+		prefixed, err := getDigest(source+":"+p[0], svc.craneOptions(ctx)...)
+		if err != nil {
+			logger.Warn("error getting digest, keeping both tags", logKeyTag, p[0], logKeyError, err)
+			continue
+		}
+
+		bare, err := getDigest(source+":"+p[1], svc.craneOptions(ctx)...)
+		if err != nil {
+			logger.Warn("error getting digest, keeping both tags", logKeyTag, p[1], logKeyError, err)
+			continue
+		}
+
+		if prefixed != "" && prefixed == bare {
+			logger.Debug("skipping duplicate tag", logKeyTag, p[1], "duplicate_of", p[0])
+			drop[p[1]] = true
+		}
+	}
+
+	result := make([]string, 0, len(tags)-len(drop))
+
+	for _, t := range tags {
+		if !drop[t] {
+			result = append(result, t)
+		}
+	}
+	return result
+}
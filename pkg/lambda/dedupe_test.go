@@ -0,0 +1,32 @@
+package lambda
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_duplicateVersionTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		tags      []string
+		wantPairs [][2]string
+	}{
+		{
+			name:      "v prefixed and bare tags",
+			tags:      []string{"1.2.3", "v1.2.3", "v1.2.4", "1.2.5", "latest", "v1.2.5"},
+			wantPairs: [][2]string{{"v1.2.3", "1.2.3"}, {"v1.2.5", "1.2.5"}},
+		},
+		{
+			name:      "no duplicates",
+			tags:      []string{"1.2.3", "v1.2.4", "vnext", "next"},
+			wantPairs: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := duplicateVersionTags(tt.tags); !reflect.DeepEqual(got, tt.wantPairs) {
+				t.Errorf("duplicateVersionTags() = %v, want %v", got, tt.wantPairs)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package lambda
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"path"
 	"strconv"
 	"strings"
 
@@ -12,10 +15,20 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ecrClient struct {
 	ecriface.ECRAPI
+	checkpoint *checkpointTracker
+	jobs       int // layers copied in parallel per image, crane default when 0
+	logger     *slog.Logger
+	metrics    *metricsRecorder
+	provenance *provenanceRecorder // pushes a provenance artifact for every copied image when set
+	transport  http.RoundTripper   // transport for all registry calls, defaults to the crane transport
 }
 
 type ecrResults struct {
@@ -42,21 +55,44 @@ type repoTags struct {
 // function to start a new session with AWS for ECR
 func newEcrClient(region string) (*ecrClient, error) {
 	mySession, err := session.NewSession(&aws.Config{
-		Region: aws.String(region),
+		Region:     aws.String(region),
+		HTTPClient: &http.Client{Transport: httpTransport(http.DefaultTransport)},
 	})
 
 	if err != nil {
-		log.Printf("Failed to create ECR Client session, %v", err)
+		slog.Error("failed to create ECR client session", logKeyPhase, phaseSetup, logKeyError, err)
 		return nil, err
 	}
 	svc := ecr.New(mySession)
 
-	return &ecrClient{svc}, nil
+	return &ecrClient{ECRAPI: svc}, nil
+}
+
+// craneOptions returns the options used for all registry calls
+func (svc *ecrClient) craneOptions(ctx context.Context) []crane.Option {
+	opts := append(defaultCraneOptions(), crane.WithContext(ctx))
+
+	if svc.transport != nil {
+		opts = append(opts, crane.WithTransport(svc.transport))
+	}
+
+	if svc.jobs > 0 {
+		opts = append(opts, withJobs(svc.jobs))
+	}
+	return opts
+}
+
+// registryTransport returns the transport for registry calls
+func (svc *ecrClient) registryTransport() http.RoundTripper {
+	if svc.transport == nil {
+		return remote.DefaultTransport
+	}
+	return svc.transport
 }
 
 // getECRAuthData returns the temporary ECR auth data used to authenticate with the ECR
-func (svc *ecrClient) getECRAuthData() (authData, error) {
-	base64token, err := svc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+func (svc *ecrClient) getECRAuthData(ctx context.Context) (authData, error) {
+	base64token, err := svc.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
 	if err != nil {
 		return authData{}, fmt.Errorf("failed to retrieve ecr token: %w", err)
 	}
@@ -83,7 +119,7 @@ func (svc *ecrClient) getECRAuthData() (authData, error) {
 }
 
 // getECRRepositories returns a list of ECR repositories
-func (svc *ecrClient) getECRRepositories(inputRepositories []string) (repositories []repository, err error) {
+func (svc *ecrClient) getECRRepositories(ctx context.Context, inputRepositories []string) (repositories []repository, err error) {
 	input := &ecr.DescribeRepositoriesInput{}
 	if len(inputRepositories) > 0 {
 		input = &ecr.DescribeRepositoriesInput{
@@ -92,7 +128,7 @@ func (svc *ecrClient) getECRRepositories(inputRepositories []string) (repositori
 	}
 
 	// Call DescribeRepositories function with pagination
-	err = svc.DescribeRepositoriesPages(input,
+	err = svc.DescribeRepositoriesPagesWithContext(ctx, input,
 		func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
 			for _, repo := range page.Repositories {
 				repositories = append(repositories, repository{
@@ -104,7 +140,7 @@ func (svc *ecrClient) getECRRepositories(inputRepositories []string) (repositori
 		})
 
 	if err != nil {
-		log.Printf("Error: %s", err)
+		svc.log().Error("error describing repositories", logKeyPhase, phaseDiscover, logKeyError, err)
 		return nil, err
 	}
 
@@ -112,16 +148,16 @@ func (svc *ecrClient) getECRRepositories(inputRepositories []string) (repositori
 }
 
 // getTagsFromECRRepositories returns a map of tags from ECR repositories
-func (svc *ecrClient) getTagsFromECRRepositories(repositories *[]repository) (tags map[string]repoTags, err error) {
+func (svc *ecrClient) getTagsFromECRRepositories(ctx context.Context, repositories *[]repository) (tags map[string]repoTags, err error) {
 	// Create map to hold tags
 	tags = make(map[string]repoTags)
 
 	for _, repo := range *repositories {
 		// Get tags for repo
-		repository_tags, err := svc.ListTagsForResource(&ecr.ListTagsForResourceInput{ResourceArn: aws.String(repo.arn)})
+		repository_tags, err := svc.ListTagsForResourceWithContext(ctx, &ecr.ListTagsForResourceInput{ResourceArn: aws.String(repo.arn)})
 
 		if err != nil {
-			log.Printf("Error: %s", err)
+			svc.log().Error("error listing tags of repository", logKeyPhase, phaseDiscover, logKeyRepository, repo.name, logKeyError, err)
 		}
 
 		// Skip if no tags
@@ -140,30 +176,40 @@ func (svc *ecrClient) getTagsFromECRRepositories(repositories *[]repository) (ta
 	return tags, err
 }
 
-// getinputRepositorysFromTags returns a list of inputRepositorys from the tags of ECR repositories
-func (svc *ecrClient) getinputRepositorysFromTags(inputRepositories []string) (images []inputRepository, err error) {
-	repositories, err := svc.getECRRepositories(inputRepositories)
+// getinputRepositorysFromTags returns a list of inputRepositorys from the tags of ECR repositories and the problems in their tags,
+// repositories with invalid tags are left out
+func (svc *ecrClient) getinputRepositorysFromTags(ctx context.Context, inputRepositories []string) (images []inputRepository, problems []tagProblem, err error) {
+	ctx, span := startSpan(ctx, phaseDiscover)
+	defer func() { endSpan(span, err) }()
+
+	repositories, err := svc.getECRRepositories(ctx, inputRepositories)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	tags, err := svc.getTagsFromECRRepositories(&repositories)
+	tags, err := svc.getTagsFromECRRepositories(ctx, &repositories)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	for repo, tag := range tags {
-		image := parseinputRepositoryFromTags(repo, parseTags(tag.tags))
+		problems = append(problems, validateRepositoryTags(repo, tag.tags)...)
+		image, err := parseinputRepositoryFromTags(repo, parseTags(tag.tags))
+
+		if err != nil {
+			svc.log().Warn("skipping repository with invalid ecr_sync tags", logKeyPhase, phaseDiscover, logKeyRepository, repo, logKeyError, err)
+			continue
+		}
 		images = append(images, image)
 	}
+	sortTagProblems(problems)
 
-	return images, err
+	return images, problems, nil
 }
 
 // getImagesFromECR returns a map of images from ECR
-func (svc *ecrClient) getImagesFromECR(ecrImageName, region string, i *inputRepository) (results map[string]ecrResults, err error) {
-	var ecrResult *ecr.ListImagesOutput
+func (svc *ecrClient) getImagesFromECR(ctx context.Context, ecrImageName, region string, i *inputRepository) (results map[string]ecrResults, err error) {
 	results = make(map[string]ecrResults)
 
 	input := &ecr.ListImagesInput{
@@ -172,73 +218,121 @@ func (svc *ecrClient) getImagesFromECR(ecrImageName, region string, i *inputRepo
 			TagStatus: aws.String("TAGGED"),
 		},
 	}
-	ecrResult, err = svc.ListImages(input)
+
+	err = svc.ListImagesPagesWithContext(ctx, input, func(page *ecr.ListImagesOutput, lastPage bool) bool {
+		for _, id := range page.ImageIds {
+			results[i.source+":"+*id.ImageTag] = ecrResults{
+				name: ecrImageName,
+				tag:  *id.ImageTag,
+				hash: *id.ImageDigest,
+			}
+		}
+		return !lastPage
+	})
 
 	if err != nil {
+		logger := svc.log().With(logKeyPhase, phaseFilter, logKeyRepository, ecrImageName, logKeySource, i.source)
+
 		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case ecr.ErrCodeServerException:
-				fmt.Println(ecr.ErrCodeServerException, awsErr.Error())
-			case ecr.ErrCodeInvalidParameterException:
-				fmt.Println(ecr.ErrCodeInvalidParameterException, awsErr.Error())
-			case ecr.ErrCodeRepositoryNotFoundException:
-				fmt.Println(ecr.ErrCodeRepositoryNotFoundException, awsErr.Error())
-			default:
-				fmt.Println(awsErr.Error())
-			}
+			logger.Error("error listing ecr images", "code", awsErr.Code(), logKeyError, awsErr.Message())
 		} else {
-			fmt.Println(err.Error())
+			logger.Error("error listing ecr images", logKeyError, err)
 		}
 		return nil, err
 	}
-	for _, id := range ecrResult.ImageIds {
-		results[i.source+":"+*id.ImageTag] = ecrResults{
-			name: ecrImageName,
-			tag:  *id.ImageTag,
-			hash: *id.ImageDigest,
-		}
-	}
-
 	return results, err
 }
 
 // getTagsToSync returns a list of tags to sync from the public repo to ECR
-func (svc *ecrClient) getTagsToSync(i *inputRepository, ecrImageName string, maxResults int, chkDigest bool, env environmentVars) (syncOptions, error) {
-	resultsFromEcr, err := svc.getImagesFromECR(ecrImageName, env.awsRegion, i)
+func (svc *ecrClient) getTagsToSync(ctx context.Context, i *inputRepository, ecrImageName string, maxResults int, chkDigest bool, env environmentVars) (_ syncOptions, err error) {
+	ctx, span := startSpan(ctx, phaseFilter+" "+ecrImageName, attribute.String(attrRepository, ecrImageName), attribute.String(attrSource, i.source))
+	defer func() { endSpan(span, err) }()
+
+	logger := svc.log().With(logKeyPhase, phaseFilter, logKeyRepository, ecrImageName, logKeySource, i.source)
+	resultsFromEcr, err := svc.getImagesFromECR(ctx, ecrImageName, env.awsRegion, i)
 	if err != nil {
-		log.Printf("Error getting tags from ecr: %s", err)
 		return syncOptions{}, err
 	}
 
-	tags, err := i.getTagsFromPublicRepo()
+	svc.metrics.registerSource(i.source, ecrImageName)
+	tags := i.tags
+
+	if len(tags) == 0 {
+		tags, err = i.getTagsFromPublicRepo(svc.craneOptions(ctx)...)
+	}
 	if err != nil {
-		log.Printf("Error getting tags from public repo: %s", err)
+		logger.Error("error getting tags from public repo", logKeyError, err)
 		return syncOptions{}, err
 	}
+	seen := len(tags)
 
 	tags, err = i.checkTagsFromPublicRepo(&tags, maxResults)
 	if err != nil {
-		log.Printf("Error checking tags from public repo: %s", err)
+		logger.Error("error checking tags from public repo", logKeyError, err)
 		return syncOptions{}, err
 	}
 
+	if i.dedupe {
+		tags = svc.dedupeTags(ctx, i.source, tags)
+	}
+
+	selected := tags
+
 	if chkDigest {
-		tags, err = checkDigest(i.source, &tags, &resultsFromEcr)
+		tags, err = checkDigest(i.source, &tags, &resultsFromEcr, svc.craneOptions(ctx)...)
 	} else {
 		tags, err = checkNoDigest(i.source, &tags, &resultsFromEcr)
 	}
 	if err != nil {
-		log.Printf("Error checking digest: %s", err)
+		logger.Error("error checking digest", logKeyError, err)
 		return syncOptions{}, err
 	}
 
+	logger.Debug("selected tags", "seen", seen, "selected", len(selected), "to_sync", len(tags))
+	span.SetAttributes(attribute.Int(attrTagsSeen, seen), attribute.Int(attrTagsSelected, len(selected)), attribute.Int(attrTags, len(tags)))
+	svc.metrics.add(ecrImageName, func(r *repositoryMetrics) {
+		r.tagsSeen += int64(seen)
+		r.tagsFiltered += int64(seen - len(selected))
+
+		if chkDigest {
+			r.digestMismatches += int64(countExisting(i.source, tags, resultsFromEcr))
+		}
+	})
+
 	return syncOptions{
 		tags:         tags,
 		source:       i.source,
 		ecrImageName: ecrImageName,
+		maxSize:      i.maxSize,
+		rule:         i.workItem(),
+		skipped:      skippedTags(selected, tags),
 	}, err
 }
 
+// countExisting returns the number of tags that already exist on ecr
+func countExisting(source string, tags []string, resultsFromEcr map[string]ecrResults) (count int) {
+	for _, t := range tags {
+		if resultsFromEcr[source+":"+t].hash != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// skippedTags returns the selected tags that are not synced
+func skippedTags(selected, toSync []string) (skipped []string) {
+	sync := make(map[string]bool, len(toSync))
+	for _, t := range toSync {
+		sync[t] = true
+	}
+	for _, t := range selected {
+		if !sync[t] {
+			skipped = append(skipped, t)
+		}
+	}
+	return skipped
+}
+
 // checkRepoTag checks if a tag exists in a list of tags
 func checkRepoTag(key, value string, tags []*ecr.Tag) bool {
 
@@ -252,41 +346,84 @@ func checkRepoTag(key, value string, tags []*ecr.Tag) bool {
 }
 
 // parseinputRepositoryFromTags parses the tags from the repository and returns an inputRepository
-func parseinputRepositoryFromTags(repo string, tags map[string]string) inputRepository {
-	repository := inputRepository{}
-
+func parseinputRepositoryFromTags(repo string, tags map[string]string) (repository inputRepository, err error) {
 	if tags["ecr_sync_source"] == "" {
-		log.Printf("ecr source not set of %v", repo)
-		return inputRepository{}
+		return inputRepository{}, fmt.Errorf("ecr_sync_source not set")
 	}
 
-	if tags["ecr_sync_release_only"] == "true" {
-		repository.releaseOnly = true
+	for key, value := range map[string]*bool{"ecr_sync_release_only": &repository.releaseOnly, "ecr_sync_dedupe": &repository.dedupe} {
+		if tags[key] != "" {
+			*value, err = strconv.ParseBool(tags[key])
+
+			if err != nil {
+				return inputRepository{}, fmt.Errorf("%s: %w", key, err)
+			}
+		}
 	}
 
-	if tags["ecr_sync_max_results"] != "" {
-		repository.maxResults, _ = strconv.Atoi(tags["ecr_sync_max_results"])
+	switch tags["ecr_sync_group_by"] {
+	case "", groupByMajor, groupByMinor:
+		repository.groupBy = tags["ecr_sync_group_by"]
+	default:
+		return inputRepository{}, fmt.Errorf("ecr_sync_group_by: %q is not major or minor", tags["ecr_sync_group_by"])
+	}
+
+	for key, value := range map[string]*int{"ecr_sync_groups": &repository.groups, "ecr_sync_max_results": &repository.maxResults, "ecr_sync_tags_per_group": &repository.tagsPerGroup, "ecr_sync_untagged_days": &repository.untaggedDays} {
+		if tags[key] != "" {
+			*value, err = strconv.Atoi(tags[key])
+
+			if err != nil {
+				return inputRepository{}, fmt.Errorf("%s: %w", key, err)
+			}
+
+			// validate reports negative counts as errors, so the repository is not synced either
+			if *value < 0 {
+				return inputRepository{}, fmt.Errorf("%s: %q is not a non-negative number", key, tags[key])
+			}
+		}
+	}
+	if tags["ecr_sync_max_size"] != "" {
+		repository.maxSize, err = parseSize(tags["ecr_sync_max_size"])
+
+		if err != nil {
+			return inputRepository{}, fmt.Errorf("ecr_sync_max_size: %w", err)
+		}
+	}
+	if tags["ecr_sync_constraint"] != "" {
+		repository.constraint, err = parseConstraint(tags["ecr_sync_constraint"])
+
+		if err != nil {
+			return inputRepository{}, fmt.Errorf("ecr_sync_constraint: %w", err)
+		}
 	}
-	repository.constraint = tags["ecr_sync_constraint"]
 	repository.ecrImageName = repo
 	repository.excludeRLS = stringToSlice(tags["ecr_sync_exclude_rls"])
 	repository.excludeTags = stringToSlice(tags["ecr_sync_exclude_tags"])
 	repository.source = tags["ecr_sync_source"]
 	repository.includeRLS = stringToSlice(tags["ecr_sync_include_rls"])
 	repository.includeTags = stringToSlice(tags["ecr_sync_include_tags"])
+	repository.variants = stringToSlice(tags["ecr_sync_variants"])
+	repository.calVer = stringToSlice(tags["ecr_sync_calver"])
+	repository.lifecyclePrefixes = stringToSlice(tags["ecr_sync_lifecycle_prefixes"])
+	repository.namespace = newNamespaceTemplate(tags)
+
+	for _, l := range repository.calVer {
+		if _, err := version.NewCalVerFormat(l); err != nil {
+			return inputRepository{}, fmt.Errorf("ecr_sync_calver: %w", err)
+		}
+	}
+
+	for _, p := range repository.variants {
+		if _, err := path.Match(p, ""); err != nil {
+			return inputRepository{}, fmt.Errorf("ecr_sync_variants: %q: %w", p, err)
+		}
+	}
 
-	return repository
+	return repository, nil
 }
 
 // parseTags parses the tags from the repository and returns a map of tags
 func parseTags(tags []*ecr.Tag) map[string]string {
-
-	operators := map[string]string{
-		"-gt": ">",
-		"-ge": ">=",
-		"-lt": "<",
-		"-le": "=<",
-	}
 	tagMap := make(map[string]string)
 
 	// Loop through tags
@@ -298,11 +435,12 @@ func parseTags(tags []*ecr.Tag) map[string]string {
 		}
 		newVal := *tag.Value
 
-		// Check for ecr_sync_constraint tag and replace with correct operator for constraint
+		// Check for ecr_sync_constraint tag and replace the tag safe operators, invalid constraints are left as is
+		// and fail when the repository is parsed
 		if *tag.Key == "ecr_sync_constraint" {
-			prefix := strings.SplitN(*tag.Value, " ", 3)[0]
-			op := operators[prefix]
-			newVal = op + strings.TrimPrefix(*tag.Value, prefix)
+			if constraint, err := parseConstraint(*tag.Value); err == nil {
+				newVal = constraint
+			}
 		}
 
 		tagMap[*tag.Key] = newVal
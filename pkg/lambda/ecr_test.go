@@ -1,10 +1,12 @@
 package lambda
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 )
@@ -57,6 +59,40 @@ func (m *mockECRClient) ListImages(input *ecr.ListImagesInput) (*ecr.ListImagesO
 	return output, nil
 }
 
+// mock ListImages pages with two images per page
+func (m *mockECRClient) ListImagesPagesWithContext(ctx aws.Context, input *ecr.ListImagesInput, fn func(*ecr.ListImagesOutput, bool) bool, opts ...request.Option) error {
+	output, _ := m.ListImages(input)
+
+	for i := 0; i < len(output.ImageIds); i += 2 {
+		page := &ecr.ListImagesOutput{ImageIds: output.ImageIds[i:min(i+2, len(output.ImageIds))]}
+
+		if !fn(page, i+2 >= len(output.ImageIds)) {
+			break
+		}
+	}
+	return nil
+}
+
+// mock DescribeImages pages with the push times of the images
+func (m *mockECRClient) DescribeImagesPagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, fn func(*ecr.DescribeImagesOutput, bool) bool, opts ...request.Option) error {
+	pages := []*ecr.DescribeImagesOutput{
+		{ImageDetails: []*ecr.ImageDetail{
+			{ImageTags: aws.StringSlice([]string{"v1.1.1"}), ImagePushedAt: aws.Time(parseTime("2023-01-10T10:00:00Z"))},
+			{ImageTags: aws.StringSlice([]string{"v1.1.3"}), ImagePushedAt: aws.Time(parseTime("2023-03-10T10:00:00Z"))},
+		}},
+		{ImageDetails: []*ecr.ImageDetail{
+			{ImageTags: aws.StringSlice([]string{"v1.1.2"}), ImagePushedAt: aws.Time(parseTime("2023-02-10T10:00:00Z"))},
+		}},
+	}
+
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
 // mock tags for the repository
 func (m *mockECRClient) ListTagsForResource(*ecr.ListTagsForResourceInput) (*ecr.ListTagsForResourceOutput, error) {
 	output := &ecr.ListTagsForResourceOutput{
@@ -113,10 +149,66 @@ func Test_parseinputRepositoryFromTags(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "test parseinputRepositoryFromTags with max size",
+			args: args{
+				repo: "dev/ml/pytorch",
+				tags: map[string]string{"ecr_sync_source": "docker.io/pytorch/pytorch", "ecr_sync_max_size": "5GB"},
+			},
+			wantImage: inputRepository{ecrImageName: "dev/ml/pytorch", maxSize: 5e9, source: "docker.io/pytorch/pytorch"},
+			wantErr:   false,
+		},
+		{
+			name: "test parseinputRepositoryFromTags with invalid max size",
+			args: args{
+				repo: "dev/ml/pytorch",
+				tags: map[string]string{"ecr_sync_source": "docker.io/pytorch/pytorch", "ecr_sync_max_size": "huge"},
+			},
+			wantImage: inputRepository{},
+			wantErr:   true,
+		},
+		{
+			name: "test parseinputRepositoryFromTags without source",
+			args: args{
+				repo: "dev/test/datadog/datadog-operator",
+				tags: map[string]string{"ecr_sync_opt": "in"},
+			},
+			wantImage: inputRepository{},
+			wantErr:   true,
+		},
+		{
+			name: "test parseinputRepositoryFromTags invalid max results",
+			args: args{
+				repo: "dev/test/datadog/datadog-operator",
+				tags: map[string]string{
+					"ecr_sync_max_results": "ten",
+					"ecr_sync_source":      "docker.io/datadog/datadog-operator",
+				},
+			},
+			wantImage: inputRepository{},
+			wantErr:   true,
+		},
+		{
+			name: "test parseinputRepositoryFromTags negative groups",
+			args: args{
+				repo: "dev/test/datadog/datadog-operator",
+				tags: map[string]string{
+					"ecr_sync_group_by": "minor",
+					"ecr_sync_groups":   "-1",
+					"ecr_sync_source":   "docker.io/datadog/datadog-operator",
+				},
+			},
+			wantImage: inputRepository{},
+			wantErr:   true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotImage := parseinputRepositoryFromTags(tt.args.repo, tt.args.tags)
+			gotImage, err := parseinputRepositoryFromTags(tt.args.repo, tt.args.tags)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseinputRepositoryFromTags() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
 			if !reflect.DeepEqual(gotImage, tt.wantImage) {
 				t.Errorf("parseinputRepositoryFromTags() = %v, want %v", gotImage, tt.wantImage)
 			}
@@ -187,9 +279,9 @@ func Test_inputRepository_getImagesFromECR(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			svc := ecrClient{&mockECRClient{}}
+			svc := ecrClient{ECRAPI: &mockECRClient{}}
 
-			gotResults, err := svc.getImagesFromECR(tt.args.ecrsource, tt.args.region, tt.args.inputRepository)
+			gotResults, err := svc.getImagesFromECR(context.Background(), tt.args.ecrsource, tt.args.region, tt.args.inputRepository)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("inputRepository.getImagesFromECR() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -200,3 +292,31 @@ func Test_inputRepository_getImagesFromECR(t *testing.T) {
 		})
 	}
 }
+
+func Test_skippedTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		selected []string
+		toSync   []string
+		want     []string
+	}{
+		{
+			name:     "TestSomeSkipped",
+			selected: []string{"v1.1.3", "v1.1.2", "v1.1.1"},
+			toSync:   []string{"v1.1.3"},
+			want:     []string{"v1.1.2", "v1.1.1"},
+		},
+		{
+			name:     "TestNoneSkipped",
+			selected: []string{"v1.1.3"},
+			toSync:   []string{"v1.1.3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := skippedTags(tt.selected, tt.toSync); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("skippedTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	envelopeDirect      = "direct"
+	envelopeEventBridge = "eventbridge"
+	envelopeHTTP        = "http"
+	envelopeSNS         = "sns"
+	envelopeSQS         = "sqs"
+	snsNotificationType = "Notification"
+)
+
+type sqsBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// sqsBatchResponse is returned for sqs events, only the failed messages are retried when ReportBatchItemFailures is enabled
+type sqsBatchResponse struct {
+	BatchItemFailures []sqsBatchItemFailure `json:"batchItemFailures"`
+}
+
+// startSync runs a sync for a single request, replaced in tests
+var startSync = Start
+
+// Handler is the lambda entrypoint, it accepts a LambdaEvent, an sqs, sns or eventbridge event carrying sync requests,
+// or a registry webhook through a function url or api gateway
+func Handler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	switch detectEnvelope(payload) {
+	case envelopeSQS:
+		var event events.SQSEvent
+
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("decoding sqs event: %w", err)
+		}
+		return handleSQSEvent(ctx, event), nil
+	case envelopeSNS:
+		var event events.SNSEvent
+
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("decoding sns event: %w", err)
+		}
+		return handleSNSEvent(ctx, event)
+	case envelopeHTTP:
+		var req httpRequest
+
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, fmt.Errorf("decoding http request: %w", err)
+		}
+		return handleHTTPRequest(ctx, req)
+	case envelopeEventBridge:
+		var event events.CloudWatchEvent
+
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("decoding eventbridge event: %w", err)
+		}
+		var request LambdaEvent
+		var err error
+
+		if isECRTagEvent(event.Source, event.DetailType) {
+			request, err = parseECRTagEvent(event.Detail)
+		} else {
+			request, err = parseSyncRequest(event.Detail)
+		}
+
+		if errors.Is(err, errEventIgnored) {
+			return response{Message: "No ecr_sync tags changed", Ok: true}, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("eventbridge event %s: %w", event.ID, err)
+		}
+		return startSync(ctx, request)
+	}
+	var event LambdaEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("decoding lambda event: %w", err)
+	}
+	return startSync(ctx, event)
+}
+
+// detectEnvelope returns the type of event, keys are matched case sensitive as sqs and sns only differ in the case of eventSource
+func detectEnvelope(payload []byte) string {
+	var probe struct {
+		Records []map[string]json.RawMessage `json:"Records"`
+	}
+	var keys map[string]json.RawMessage
+
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return envelopeDirect
+	}
+
+	if _, ok := keys["Records"]; ok && json.Unmarshal(payload, &probe) == nil && len(probe.Records) > 0 {
+		switch {
+		case jsonString(probe.Records[0]["eventSource"]) == "aws:sqs":
+			return envelopeSQS
+		case jsonString(probe.Records[0]["EventSource"]) == "aws:sns":
+			return envelopeSNS
+		}
+	}
+	_, hasRequestContext := keys["requestContext"]
+	_, hasRawPath := keys["rawPath"]
+	_, hasHTTPMethod := keys["httpMethod"]
+
+	// function urls and api gateway http apis send rawPath, api gateway rest apis send httpMethod
+	if hasRequestContext && (hasRawPath || hasHTTPMethod) {
+		return envelopeHTTP
+	}
+	_, hasDetailType := keys["detail-type"]
+	_, hasDetail := keys["detail"]
+
+	if hasDetailType && hasDetail {
+		return envelopeEventBridge
+	}
+	return envelopeDirect
+}
+
+// jsonString returns the raw json value as string, empty if it is not a string
+func jsonString(raw json.RawMessage) (s string) {
+	json.Unmarshal(raw, &s)
+	return s
+}
+
+// handleSQSEvent runs a sync for every message and reports the failed messages
+func handleSQSEvent(ctx context.Context, event events.SQSEvent) (response sqsBatchResponse) {
+	response.BatchItemFailures = []sqsBatchItemFailure{}
+
+	for _, record := range event.Records {
+		request, err := parseSyncRequest([]byte(record.Body))
+
+		if errors.Is(err, errEventIgnored) {
+			continue
+		}
+
+		if err == nil {
+			_, err = startSync(ctx, request)
+		}
+
+		if err != nil {
+			slog.Error("error processing sqs message", "message_id", record.MessageId, logKeyError, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, sqsBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return response
+}
+
+// handleSNSEvent runs a sync for every notification, sns retries the whole event on errors
+func handleSNSEvent(ctx context.Context, event events.SNSEvent) (responses []response, err error) {
+	for _, record := range event.Records {
+		request, parseErr := parseSyncRequest([]byte(record.SNS.Message))
+
+		if errors.Is(parseErr, errEventIgnored) {
+			continue
+		}
+
+		if parseErr != nil {
+			return responses, fmt.Errorf("sns message %s: %w", record.SNS.MessageID, parseErr)
+		}
+		resp, syncErr := startSync(ctx, request)
+		responses = append(responses, resp)
+
+		if syncErr != nil && err == nil {
+			err = syncErr
+		}
+	}
+	return responses, err
+}
+
+// parseSyncRequest returns the sync request of a message body, the body is a LambdaEvent, a list of repositories and
+// source references, or an sns notification or eventbridge event wrapping one of them
+func parseSyncRequest(body []byte) (event LambdaEvent, err error) {
+	body = bytes.TrimSpace(body)
+
+	if len(body) == 0 {
+		return event, fmt.Errorf("empty sync request")
+	}
+
+	if body[0] == '[' {
+		var references []string
+
+		if err := json.Unmarshal(body, &references); err != nil {
+			return event, fmt.Errorf("decoding sync request: %w", err)
+		}
+
+		for _, r := range references {
+			if isSourceReference(r) {
+				event.Sources = append(event.Sources, r)
+			} else {
+				event.Repositories = append(event.Repositories, r)
+			}
+		}
+		return event, err
+	}
+	var keys map[string]json.RawMessage
+
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return event, fmt.Errorf("decoding sync request: %w", err)
+	}
+
+	// sns to sqs subscriptions without raw message delivery
+	if jsonString(keys["Type"]) == snsNotificationType && keys["Message"] != nil {
+		return parseSyncRequest([]byte(jsonString(keys["Message"])))
+	}
+
+	// eventbridge rules with an sqs or sns target
+	if _, ok := keys["detail-type"]; ok && keys["detail"] != nil {
+		if isECRTagEvent(jsonString(keys["source"]), jsonString(keys["detail-type"])) {
+			return parseECRTagEvent(keys["detail"])
+		}
+		return parseSyncRequest(keys["detail"])
+	}
+	err = json.Unmarshal(body, &event)
+
+	if err != nil {
+		return event, fmt.Errorf("decoding sync request: %w", err)
+	}
+	return event, err
+}
+
+// isSourceReference returns true if s is an image reference with a registry like docker.io/nginx,
+// ecr repository names and arns are not source references
+func isSourceReference(s string) bool {
+	if strings.HasPrefix(s, "arn:") {
+		return false
+	}
+	parts := strings.SplitN(s, "/", 2)
+
+	return len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost")
+}
+
+// normalizeSource returns the fully qualified repository name of the source, docker.io/nginx becomes index.docker.io/library/nginx
+func normalizeSource(source string) string {
+	ref, err := name.NewRepository(source)
+
+	if err != nil {
+		return source
+	}
+	return ref.Name()
+}
+
+// sourceSet is the set of normalized sources selected by an event, an empty set selects all sources
+type sourceSet map[string]bool
+
+func newSourceSet(sources []string) sourceSet {
+	set := make(sourceSet, len(sources))
+
+	for _, s := range sources {
+		set[normalizeSource(s)] = true
+	}
+	return set
+}
+
+// has returns true when the source is selected
+func (s sourceSet) has(source string) bool {
+	return len(s) == 0 || s[normalizeSource(source)]
+}
+
+// hasNamespace returns true when a selected source is a repository of the namespace like quay.io/cilium
+func (s sourceSet) hasNamespace(namespace string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	prefix := normalizeSource(namespace) + "/"
+
+	for source := range s {
+		if strings.HasPrefix(source, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRepositoriesBySource returns the repositories with one of the sources and the namespace templates of the
+// sources, all repositories if no sources are given
+func filterRepositoriesBySource(repositories []inputRepository, sources []string) (filtered []inputRepository) {
+	if len(sources) == 0 {
+		return repositories
+	}
+	match := newSourceSet(sources)
+
+	for _, r := range repositories {
+		if match.has(r.source) || (r.namespace != nil && match.hasNamespace(r.namespace.source)) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
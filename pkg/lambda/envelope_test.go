@@ -0,0 +1,178 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// stubStartSync replaces the sync with a stub recording the requests, repositories named fail return an error
+func stubStartSync(t *testing.T) *[]LambdaEvent {
+	var requests []LambdaEvent
+	previous := startSync
+	startSync = func(ctx context.Context, event LambdaEvent) (response, error) {
+		requests = append(requests, event)
+		for _, r := range event.Repositories {
+			if r == "fail" {
+				return response{}, errors.New("sync failed")
+			}
+		}
+		return response{Ok: true}, nil
+	}
+	t.Cleanup(func() { startSync = previous })
+	return &requests
+}
+
+func Test_detectEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{name: "TestLambdaEvent", payload: `{"action":"sync","repositories":["dev/nginx"]}`, want: envelopeDirect},
+		{name: "TestSQS", payload: `{"Records":[{"messageId":"1","eventSource":"aws:sqs","body":"{}"}]}`, want: envelopeSQS},
+		{name: "TestSNS", payload: `{"Records":[{"EventSource":"aws:sns","Sns":{"Message":"{}"}}]}`, want: envelopeSNS},
+		{name: "TestEventBridge", payload: `{"detail-type":"sync","source":"custom","detail":{"action":"s3"}}`, want: envelopeEventBridge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectEnvelope([]byte(tt.payload)); got != tt.want {
+				t.Errorf("detectEnvelope() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseSyncRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    LambdaEvent
+		wantErr bool
+	}{
+		{
+			name: "TestLambdaEvent",
+			body: `{"action":"s3","repositories":["dev/nginx"]}`,
+			want: LambdaEvent{Action: "s3", Repositories: []string{"dev/nginx"}},
+		},
+		{
+			name: "TestReferences",
+			body: `["arn:aws:ecr:eu-west-1:123:repository/dev/nginx","dev/redis","docker.io/bitnami/redis","localhost:5000/app"]`,
+			want: LambdaEvent{
+				Repositories: []string{"arn:aws:ecr:eu-west-1:123:repository/dev/nginx", "dev/redis"},
+				Sources:      []string{"docker.io/bitnami/redis", "localhost:5000/app"},
+			},
+		},
+		{
+			name: "TestSNSNotification",
+			body: `{"Type":"Notification","MessageId":"1","Message":"[\"gcr.io/datadoghq/agent\"]"}`,
+			want: LambdaEvent{Sources: []string{"gcr.io/datadoghq/agent"}},
+		},
+		{
+			name: "TestEventBridgeDetail",
+			body: `{"detail-type":"sync","source":"custom","detail":{"check_digest":true}}`,
+			want: LambdaEvent{CheckDigest: true},
+		},
+		{
+			name:    "TestPlainText",
+			body:    `dev/nginx`,
+			wantErr: true,
+		},
+		{
+			name:    "TestEmpty",
+			body:    ` `,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSyncRequest([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSyncRequest() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSyncRequest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handleSQSEvent(t *testing.T) {
+	requests := stubStartSync(t)
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: `["dev/nginx"]`},
+		{MessageId: "2", Body: `["fail"]`},
+		{MessageId: "3", Body: `not json`},
+	}}
+	got := handleSQSEvent(context.Background(), event)
+	want := []sqsBatchItemFailure{{ItemIdentifier: "2"}, {ItemIdentifier: "3"}}
+
+	if !reflect.DeepEqual(got.BatchItemFailures, want) {
+		t.Errorf("handleSQSEvent() = %v, want %v", got.BatchItemFailures, want)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("handleSQSEvent() started %v syncs, want 2", len(*requests))
+	}
+}
+
+func Test_Handler(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		wantSyncs int
+		wantErr   bool
+	}{
+		{name: "TestLambdaEvent", payload: `{"repositories":["dev/nginx"]}`, wantSyncs: 1},
+		{name: "TestSNS", payload: `{"Records":[{"EventSource":"aws:sns","Sns":{"MessageId":"1","Message":"[\"dev/nginx\"]"}},{"EventSource":"aws:sns","Sns":{"MessageId":"2","Message":"[\"fail\"]"}}]}`, wantSyncs: 2, wantErr: true},
+		{name: "TestEventBridge", payload: `{"id":"1","detail-type":"sync","source":"custom","detail":{"repositories":["dev/nginx"]}}`, wantSyncs: 1},
+		{name: "TestSQS", payload: `{"Records":[{"messageId":"1","eventSource":"aws:sqs","body":"[\"fail\"]"}]}`, wantSyncs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := stubStartSync(t)
+			got, err := Handler(context.Background(), json.RawMessage(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Handler() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(*requests) != tt.wantSyncs {
+				t.Errorf("Handler() started %v syncs, want %v, response %v", len(*requests), tt.wantSyncs, got)
+			}
+		})
+	}
+}
+
+func Test_filterRepositoriesBySource(t *testing.T) {
+	repositories := []inputRepository{
+		{ecrImageName: "dev/nginx", source: "docker.io/nginx"},
+		{ecrImageName: "dev/agent", source: "gcr.io/datadoghq/agent"},
+		{ecrImageName: "mirror/cilium", source: "quay.io/cilium/*", namespace: &namespaceTemplate{source: "quay.io/cilium"}},
+	}
+	tests := []struct {
+		name    string
+		sources []string
+		want    []string
+	}{
+		{name: "TestNoSources", want: []string{"dev/nginx", "dev/agent", "mirror/cilium"}},
+		{name: "TestNamespace", sources: []string{"quay.io/cilium/hubble"}, want: []string{"mirror/cilium"}},
+		{name: "TestNamespaceWildcard", sources: []string{"quay.io/cilium/*"}, want: []string{"mirror/cilium"}},
+		{name: "TestNormalized", sources: []string{"index.docker.io/library/nginx"}, want: []string{"dev/nginx"}},
+		{name: "TestNoMatch", sources: []string{"quay.io/prometheus/prometheus"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range filterRepositoriesBySource(repositories, tt.sources) {
+				got = append(got, r.ecrImageName)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterRepositoriesBySource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
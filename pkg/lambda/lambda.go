@@ -4,54 +4,106 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // LambdaEvent lambda input event data, fields have to be exported
 type LambdaEvent struct {
-	Action             string   `json:"action"` // s3 or sync
-	CheckDigest        bool     `json:"check_digest"`
-	Concurrent         int      `json:"concurrent"` // number of concurrent syncs
-	Repositories       []string `json:"repositories"`
-	MaxResults         int      `json:"max_results"`
-	SlackChannelID     string   `json:"slack_channel_id"`
-	SlackErrorsOnly    bool     `json:"slack_errors_only"`
-	SlackMSGErrSubject string   `json:"slack_msg_err_subject"`
-	SlackMSGHeader     string   `json:"slack_msg_header"`
-	SlackMSGSubject    string   `json:"slack_msg_subject"`
+	Action                string            `json:"action"`          // s3, sync, discover, sync-one, validate, report, audit or lifecycle
+	BandwidthLimit        string            `json:"bandwidth_limit"` // bytes per second over all copies like 20MB, default BANDWIDTH_LIMIT or unlimited
+	CheckDigest           bool              `json:"check_digest"`
+	Checkpoint            string            `json:"checkpoint"`              // s3, s3://bucket/prefix or a local directory to save the progress of a sync
+	CheckpointMargin      int               `json:"checkpoint_margin"`       // seconds before the lambda deadline to stop syncing, default 60
+	ContinuationToken     string            `json:"continuation_token"`      // token of the checkpoint to resume
+	CopyJobs              int               `json:"copy_jobs"`               // layers copied in parallel per image, default COPY_JOBS or 4
+	EMFMetrics            bool              `json:"emf_metrics"`             // write cloudwatch embedded metric format log lines
+	EMFNamespace          string            `json:"emf_namespace"`           // cloudwatch namespace, default ECRImageSync
+	Item                  *WorkItem         `json:"item"`                    // repository to sync with action sync-one
+	LifecycleApply        bool              `json:"lifecycle_apply"`         // put the changed lifecycle policies, only show the diffs when false
+	LifecycleUntaggedDays int               `json:"lifecycle_untagged_days"` // days before untagged images expire, default for ecr_sync_untagged_days
+	LogLevel              string            `json:"log_level"`               // debug, info, warn or error, default LOG_LEVEL or info
+	Concurrent            int               `json:"concurrent"`              // number of concurrent syncs
+	Repositories          []string          `json:"repositories"`
+	MaxConnsPerHost       int               `json:"max_conns_per_host"` // connections per registry host, default MAX_CONNS_PER_HOST or unlimited
+	MaxResults            int               `json:"max_results"`
+	Provenance            bool              `json:"provenance"`      // push a provenance artifact for every copied image
+	Notifiers             []NotifierConfig  `json:"notifiers"`       // notification backends, see README
+	S3KeyTemplate         string            `json:"s3_key_template"` // object key template with placeholders like {date} and {run_id}
+	S3KMSKeyID            string            `json:"s3_kms_key_id"`   // kms key arn used with sse aws:kms
+	S3Manifest            bool              `json:"s3_manifest"`     // upload a manifest listing all outputs
+	S3ObjectMetadata      map[string]string `json:"s3_object_metadata"`
+	S3ObjectTags          map[string]string `json:"s3_object_tags"`
+	S3OutputFormats       []string          `json:"s3_output_formats"` // csv, json, ndjson, skopeo or crane
+	S3SSE                 string            `json:"s3_sse"`            // AES256 (default) or aws:kms
+	SlackChannelID        string            `json:"slack_channel_id"`
+	SlackErrorsOnly       bool              `json:"slack_errors_only"`
+	SlackMSGErrSubject    string            `json:"slack_msg_err_subject"`
+	SlackMSGHeader        string            `json:"slack_msg_header"`
+	SlackMSGSubject       string            `json:"slack_msg_subject"`
+	Sources               []string          `json:"sources"`       // only sync repositories with one of these ecr_sync_source values
+	Tags                  []string          `json:"tags"`          // only consider these source tags instead of listing the source, they still have to pass the filters
+	ValidateTags          bool              `json:"validate_tags"` // send problems in the ecr_sync tags of the repositories to the notifiers
 }
 
 type inputRepository struct {
+	tags         []string // source tags to consider, all tags of the source when empty
+	calVer       []string // calendar version layouts like YYYY.0M.0D, only tags matching a layout are versions
 	constraint   string
+	dedupe       bool // drop bare tags like 1.2.3 with the same digest as v1.2.3
 	ecrImageName string
 	excludeRLS   []string
 	excludeTags  []string
+	groupBy      string   // major or minor, keep the newest tags of every version line
+	groups       int      // number of version lines, all when 0
+	tagsPerGroup int      // number of tags per version line, default 1
+	variants     []string // tag suffix patterns like alpine, the newest tags are selected per variant
 	source       string
 	includeRLS   []string
 	includeTags  []string
 	maxResults   int
+	maxSize      int64 // max compressed size of an image in bytes, no limit when 0
 	releaseOnly  bool
+
+	lifecyclePrefixes []string           // tag prefixes of the lifecycle policy, derived from the mirrored tags when empty
+	namespace         *namespaceTemplate // set when the source is a namespace like quay.io/cilium/*
+	untaggedDays      int                // days before untagged images expire with the lifecycle action, default lifecycle_untagged_days
 }
 
 type process struct {
-	wg  *sync.WaitGroup
-	mu  *sync.Mutex
-	svc *ecrClient
+	wg     *sync.WaitGroup
+	mu     *sync.Mutex
+	svc    *ecrClient
+	logger *slog.Logger
 }
 
 type response struct {
-	Message string `json:"message"`
-	Ok      bool   `json:"ok"`
+	Audit             *auditRecord    `json:"audit,omitempty"`              // result of the audit action
+	ContinuationToken string          `json:"continuation_token,omitempty"` // set when tags are left for the next run
+	Items             []WorkItem      `json:"items,omitempty"`              // repositories found by the discover action
+	Lifecycle         []lifecyclePlan `json:"lifecycle,omitempty"`          // lifecycle policy changes of the lifecycle action
+	Message           string          `json:"message"`
+	Ok                bool            `json:"ok"`
+	Problems          []tagProblem    `json:"problems,omitempty"`       // problems in the ecr_sync tags with validate_tags
+	Report            *staleReport    `json:"report,omitempty"`         // result of the report action
+	BytesUploaded     int64           `json:"bytes_uploaded,omitempty"` // bytes of the blobs uploaded to the ecr
+	BytesSkipped      int64           `json:"bytes_skipped,omitempty"`  // bytes of the blobs already on the ecr or mounted
 }
 
 type environmentVars struct {
 	awsAccount      string
 	awsBucket       string
 	awsRegion       string
+	s3Endpoint      string
 	slackOAuthToken string
 }
 
@@ -63,6 +115,7 @@ func getEnvironmentVars() (vars environmentVars, err error) {
 		awsRegion:       os.Getenv("AWS_REGION"),
 		awsBucket:       os.Getenv("BUCKET_NAME"),
 		awsAccount:      os.Getenv("AWS_ACCOUNT_ID"),
+		s3Endpoint:      os.Getenv("S3_ENDPOINT"),
 		slackOAuthToken: os.Getenv("SLACK_OAUTH_TOKEN"),
 	}
 
@@ -82,18 +135,56 @@ func init() {
 	}
 }
 
-// returnErr returns an error and sends a slack notification
-func returnErr(err error, slackOAuthTokenm, slackChannelID, errSubject, errText string) (response, error) {
-	sendSlackNotification(slackOAuthTokenm, slackChannelID, errSubject, fmt.Sprint(err))
-	errMessage := fmt.Sprintf(errText+" %f", err)
-	log.Print(errSubject)
-	log.Print(errMessage)
+// getRunID returns the lambda request id or a generated id when running outside of lambda
+func getRunID(ctx context.Context) string {
+	if ctx != nil {
+		if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+			return lc.AwsRequestID
+		}
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// returnErr returns an error and sends it to the notifiers
+func returnErr(ctx context.Context, err error, n notifiers, result *runResult, errText string) (response, error) {
+	errMessage := fmt.Sprintf("%s %v", errText, err)
+	slog.Error(strings.TrimSuffix(errText, ":"), logKeyError, err)
+	recordError(trace.SpanFromContext(ctx), err)
+
+	result.Ok = false
+	result.Error = fmt.Sprint(err)
+	result.Message = errMessage
+	result.Finished = time.Now()
+	n.notify(ctx, result)
+
 	return response{
 		Message: errMessage,
 		Ok:      false,
 	}, err
 }
 
+// s3OutputOptionsFromEvent returns the options of the s3 output of the run
+func s3OutputOptionsFromEvent(event LambdaEvent, env environmentVars, result *runResult) s3OutputOptions {
+	return s3OutputOptions{
+		bucket:      env.awsBucket,
+		formats:     event.S3OutputFormats,
+		keyTemplate: event.S3KeyTemplate,
+		kmsKeyID:    event.S3KMSKeyID,
+		manifest:    event.S3Manifest,
+		metadata:    event.S3ObjectMetadata,
+		region:      env.awsRegion,
+		runID:       result.RunID,
+		sse:         event.S3SSE,
+		tags:        event.S3ObjectTags,
+		time:        result.Started,
+	}
+}
+
+// ecrRegistryHost returns the hostname of the ecr registry
+func ecrRegistryHost(env environmentVars) string {
+	return env.awsAccount + ".dkr.ecr." + env.awsRegion + ".amazonaws.com"
+}
+
 // ecrRepoNamesFromAWSARNs returns a slice of repository names from a slice of AWS ARNs
 func ecrRepoNamesFromAWSARNs(arns []string, region, account string) []string {
 	var names []string
@@ -104,7 +195,7 @@ func ecrRepoNamesFromAWSARNs(arns []string, region, account string) []string {
 }
 
 // processRepositories processes repositories in batches
-func (proc *process) processRepositories(repositories []inputRepository, max, maxResults int, checkDigest bool, environmentVars environmentVars) (allTagsToSync []syncOptions) {
+func (proc *process) processRepositories(ctx context.Context, repositories []inputRepository, max, maxResults int, checkDigest bool, environmentVars environmentVars) (allTagsToSync []syncOptions, repoErrors []error) {
 	totalItems := len(repositories)
 
 	for i := 0; i < totalItems; i += max {
@@ -116,15 +207,19 @@ func (proc *process) processRepositories(repositories []inputRepository, max, ma
 		proc.wg.Add(limit)
 		for j := 0; j < limit; j++ {
 			repo := repositories[i+j]
-			log.Printf("Processing repository: %s", repo.source)
+			proc.log().Info("processing repository", logKeyPhase, phaseFilter, logKeyRepository, repo.ecrImageName, logKeySource, repo.source)
 			go func(j int) {
 				defer proc.wg.Done()
-				tagsToSync, err := proc.svc.getTagsToSync(&repo, repo.ecrImageName, maxResults, checkDigest, environmentVars)
+				tagsToSync, err := proc.svc.getTagsToSync(ctx, &repo, repo.ecrImageName, maxResults, checkDigest, environmentVars)
 				if err != nil {
-					log.Fatal(err)
+					proc.svc.metrics.addError(repo.ecrImageName, err)
+					proc.mu.Lock()
+					repoErrors = append(repoErrors, fmt.Errorf("%s: %w", repo.ecrImageName, err))
+					proc.mu.Unlock()
+					return
 				}
 				proc.mu.Lock()
-				if len(tagsToSync.tags) > 0 {
+				if len(tagsToSync.tags) > 0 || len(tagsToSync.skipped) > 0 {
 					allTagsToSync = append(allTagsToSync, tagsToSync)
 				}
 				proc.mu.Unlock()
@@ -132,11 +227,11 @@ func (proc *process) processRepositories(repositories []inputRepository, max, ma
 		}
 		proc.wg.Wait()
 	}
-	return allTagsToSync
+	return allTagsToSync, repoErrors
 }
 
 // processTags processes tags in batches
-func (proc *process) processTags(allTagsToSync []syncOptions, max int, environmentVars environmentVars) (total int, syncErrors []error) {
+func (proc *process) processTags(ctx context.Context, allTagsToSync []syncOptions, max int, environmentVars environmentVars) (total int, syncErrors []error) {
 	totalItems := len(allTagsToSync)
 
 	for i := 0; i < totalItems; i += max {
@@ -148,15 +243,19 @@ func (proc *process) processTags(allTagsToSync []syncOptions, max int, environme
 		proc.wg.Add(limit)
 		for j := 0; j < limit; j++ {
 			tags := allTagsToSync[i+j]
-			log.Printf("Syncing image: %s", tags.source)
+			proc.log().Info("syncing repository", logKeyPhase, phaseSync, logKeyRepository, tags.ecrImageName, logKeySource, tags.source, "tags", len(tags.tags))
 			go func(j int) {
 				defer proc.wg.Done()
-				err := proc.svc.syncImages(tags, environmentVars)
+				synced, err := proc.svc.syncImages(ctx, tags, environmentVars)
+				// every goroutine owns its own element of allTagsToSync, pending and too large tags are not synced
+				allTagsToSync[i+j] = synced
+				proc.mu.Lock()
+				total -= len(tags.tags) - len(synced.tags)
+				proc.mu.Unlock()
 				if err != nil {
 					proc.mu.Lock()
 					syncErrors = append(syncErrors, err)
 					proc.mu.Unlock()
-					log.Fatal(err)
 				}
 			}(j)
 			proc.mu.Lock()
@@ -170,114 +269,337 @@ func (proc *process) processTags(allTagsToSync []syncOptions, max int, environme
 
 // Start Lambda Function for syncing ecr images with public repositories, outputs csv with needed images to S3 bucket.
 func Start(ctx context.Context, event LambdaEvent) (response, error) {
-	const (
-		imagesZipFile = "images.zip"
-		imagesCSVFile = "images.csv"
-	)
+	var n notifiers
 
-	var (
-		csvContent   []csvFormat
-		syncErrors   []error
-		dockerConfig = filepath.Dir(tmpDir)
-		errSubject   = tryString(event.SlackMSGErrSubject, "The following error has occurred during the lambda ecr-image-sync:")
-		repositories []inputRepository
-		total        int
-	)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	result := &runResult{
+		Action:  tryString(event.Action, actionSync),
+		RunID:   getRunID(ctx),
+		Started: time.Now(),
+	}
+	tp, tracingErr := initTracing(ctx)
+
+	if tp != nil {
+		// spans are exported in batches, flush them before the lambda instance is frozen
+		defer tp.ForceFlush(context.Background())
+	}
+	ctx, span := startSpan(ctx, "ecr-image-sync "+result.Action, attribute.String(attrRunID, result.RunID), attribute.String(attrAction, result.Action))
+	defer span.End()
+
+	logger, logErr := newLogger(os.Stdout, event.LogLevel, result.RunID)
+
+	// free functions and the notifiers log with the default logger
+	slog.SetDefault(logger)
 	environmentVars, err := getEnvironmentVars()
+	os.Setenv("DOCKER_CONFIG", filepath.Dir(tmpDir))
 
-	zipFile := filepath.Join(tmpDir, imagesZipFile)
-	csvFile := filepath.Join(tmpDir, imagesCSVFile)
-	os.Setenv("DOCKER_CONFIG", dockerConfig)
+	notifierConfigs, notifierErr := getNotifierConfigs(event, environmentVars)
 
-	if err != nil {
-		return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
-			"Error reading environment variables , or not set:")
+	if notifierErr == nil {
+		n, notifierErr = newNotifiers(notifierConfigs, environmentVars)
+	}
+
+	for _, setup := range []struct {
+		err  error
+		text string
+	}{
+		{err, "Error reading environment variables , or not set:"},
+		{logErr, "Error configuring logger:"},
+		{tracingErr, "Error configuring tracing:"},
+		{notifierErr, "Error configuring notifiers:"},
+	} {
+		if setup.err != nil {
+			return returnErr(ctx, setup.err, n, result, setup.text)
+		}
 	}
 	svc, err := newEcrClient(environmentVars.awsRegion)
 
 	if err != nil {
-		return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
+		return returnErr(ctx, err, n, result,
 			"Error creating ECR client:")
 	}
+	svc.logger = logger
+	limits, err := getCopyLimits(event)
+
+	if err != nil {
+		return returnErr(ctx, err, n, result,
+			"Error configuring copy limits:")
+	}
+	svc.configure(event, environmentVars, limits, result.RunID, tp != nil)
+
+	if svc.metrics != nil {
+
+		defer func() {
+			if err := svc.metrics.flush(os.Stdout, result.RunID, result.Action, time.Now()); err != nil {
+				logger.Error("error writing metrics", logKeyPhase, phaseOutput, logKeyError, err)
+			}
+		}()
+	}
+	dockerHubLogin(logger)
+
+	return svc.run(ctx, event, environmentVars, n, result)
+}
+
+// configure sets the copy limits, provenance, metrics and tracing of the run on the client
+func (svc *ecrClient) configure(event LambdaEvent, environmentVars environmentVars, limits copyLimits, runID string, tracing bool) {
+	svc.jobs = limits.jobs
+	svc.transport = limits.transport()
+
+	if event.Provenance {
+		svc.provenance = newProvenanceRecorder(runID)
+	}
+
+	if event.EMFMetrics {
+		svc.metrics = newMetricsRecorder(event.EMFNamespace)
+		svc.metrics.registerPushHost(ecrRegistryHost(environmentVars))
+		svc.transport = &metricsTransport{inner: svc.registryTransport(), metrics: svc.metrics}
+	}
+
+	if tracing {
+		svc.transport = newTracingTransport(svc.registryTransport())
+	}
+}
+
+// dockerHubLogin logs in to docker.io when DOCKER_USERNAME and DOCKER_PASSWORD are set
+func dockerHubLogin(logger *slog.Logger) {
+	if os.Getenv("DOCKER_USERNAME") == "" || os.Getenv("DOCKER_PASSWORD") == "" {
+		return
+	}
+	err := login(loginOptions{
+		serverAddress: "docker.io",
+		user:          os.Getenv("DOCKER_USERNAME"),
+		password:      os.Getenv("DOCKER_PASSWORD"),
+	})
+	if err != nil {
+		logger.Error("error logging in to docker.io", logKeyPhase, phaseSetup, logKeyError, err)
+	}
+}
+
+// usesCheckpoint returns true for the actions that copy images and can be resumed
+func usesCheckpoint(action string) bool {
+	switch action {
+	case actionS3, actionAudit, actionDiscover, actionLifecycle, actionValidate, actionReport:
+		return false
+	}
+	return true
+}
+
+// createsRepositories returns true for the actions that create the missing repositories of namespaces
+func createsRepositories(action string) bool {
+	return action == actionSync || action == actionDiscover
+}
+
+// run selects the repositories of the event and runs the action on them
+func (svc *ecrClient) run(ctx context.Context, event LambdaEvent, environmentVars environmentVars, n notifiers, result *runResult) (response, error) {
+	var (
+		err          error
+		logger       = svc.log()
+		problems     []tagProblem
+		repositories []inputRepository
+	)
+
+	if event.Checkpoint != "" && usesCheckpoint(result.Action) {
+		svc.checkpoint, err = loadCheckpoint(ctx, event, environmentVars)
 
-	if os.Getenv("DOCKER_USERNAME") != "" && os.Getenv("DOCKER_PASSWORD") != "" {
-		err = login(loginOptions{
-			serverAddress: "docker.io",
-			user:          os.Getenv("DOCKER_USERNAME"),
-			password:      os.Getenv("DOCKER_PASSWORD"),
-		})
 		if err != nil {
-			log.Println("error logging in to docker.io: ", err)
+			return returnErr(ctx, err, n, result,
+				"Error loading checkpoint:")
 		}
 	}
-	names := ecrRepoNamesFromAWSARNs(event.Repositories, environmentVars.awsRegion, environmentVars.awsAccount)
-	repositories, err = svc.getinputRepositorysFromTags(names)
 
-	if err != nil {
-		if strings.Contains(err.Error(), "RepositoryNotFoundException") {
-			return response{
-				Message: "Repository not found",
-				Ok:      true,
-			}, nil
+	if svc.checkpoint.isResumed() {
+		logger.Info("resuming from checkpoint", logKeyPhase, phaseDiscover, "token", svc.checkpoint.state.Token)
+	} else if result.Action == actionSyncOne {
+		repo, err := event.Item.inputRepository()
+
+		if err != nil {
+			return returnErr(ctx, err, n, result,
+				"Error reading work item:")
+		}
+		repositories = []inputRepository{repo}
+	} else {
+		names := ecrRepoNamesFromAWSARNs(event.Repositories, environmentVars.awsRegion, environmentVars.awsAccount)
+		repositories, problems, err = svc.getinputRepositorysFromTags(ctx, names)
+
+		if err != nil {
+			if strings.Contains(err.Error(), "RepositoryNotFoundException") {
+				return response{
+					Message: "Repository not found",
+					Ok:      true,
+				}, nil
+			}
+			return returnErr(ctx, err, n, result,
+				"Error getting input images from tags")
 		}
-		return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
-			"Error getting input images from tags")
+		repositories = filterRepositoriesBySource(repositories, event.Sources)
+		repositories = svc.expandNamespaces(ctx, repositories, createsRepositories(result.Action), event.Sources)
 	}
 
-	log.Printf("Starting lambda for %s repositories", strconv.Itoa(len(repositories)))
+	for i := range repositories {
+		repositories[i].tags = event.Tags
+	}
 	maxConcurrent := maxInt(event.Concurrent, 1)
 
+	if result.Action == actionValidate {
+		problems = append(problems, svc.checkSources(ctx, repositories, maxConcurrent)...)
+		sortTagProblems(problems)
+	}
+
+	if event.ValidateTags || result.Action == actionValidate {
+		logTagProblems(logger, problems)
+		notifyTagProblems(ctx, n, result.RunID, problems)
+	} else {
+		problems = nil
+	}
+
+	switch result.Action {
+	case actionValidate:
+		return response{
+			Message:  fmt.Sprintf("Found %d problems in the ecr_sync tags", len(problems)),
+			Ok:       true,
+			Problems: problems,
+		}, nil
+	case actionDiscover:
+		items := workItemsFromRepositories(repositories)
+		logger.Info("discovered repositories", logKeyPhase, phaseDiscover, "repositories", len(items))
+
+		return response{
+			Items:   items,
+			Message: fmt.Sprintf("Discovered %d repositories", len(items)),
+			Ok:      true,
+		}, nil
+	case actionReport:
+		return svc.runReport(ctx, event, environmentVars, repositories, maxConcurrent, n, result)
+	case actionAudit:
+		return svc.runAudit(ctx, event, environmentVars, repositories, maxConcurrent, n, result)
+	case actionLifecycle:
+		return svc.runLifecycle(ctx, event, environmentVars, repositories, maxConcurrent, n, result)
+	}
+	return svc.syncRepositories(ctx, event, environmentVars, repositories, problems, n, result)
+}
+
+// logTagProblems logs the problems in the ecr_sync tags as warnings
+func logTagProblems(logger *slog.Logger, problems []tagProblem) {
+	for _, p := range problems {
+		logger.Warn("invalid ecr_sync tag", logKeyPhase, phaseDiscover, logKeyRepository, p.Repository, "key", p.Key, "level", p.Level, logKeyError, p.Message)
+	}
+}
+
+// syncRepositories syncs the tags of the repositories to the ecr, or writes them to the s3 bucket with the s3 action
+func (svc *ecrClient) syncRepositories(ctx context.Context, event LambdaEvent, environmentVars environmentVars, repositories []inputRepository, problems []tagProblem, n notifiers, result *runResult) (response, error) {
+	var (
+		allTagsToSync     []syncOptions
+		continuationToken string
+		logger            = svc.log()
+		maxConcurrent     = maxInt(event.Concurrent, 1)
+		remaining         int
+		repoErrors        []error
+		syncErrors        []error
+	)
+	logger.Info("starting sync", logKeyPhase, phaseDiscover, "action", result.Action, "repositories", len(repositories))
+
 	proc := process{
-		wg:  &sync.WaitGroup{},
-		mu:  &sync.Mutex{},
-		svc: svc,
+		wg:     &sync.WaitGroup{},
+		mu:     &sync.Mutex{},
+		svc:    svc,
+		logger: logger,
 	}
-	allTagsToSync := proc.processRepositories(repositories, maxConcurrent, event.MaxResults, event.CheckDigest, environmentVars)
 
-	switch {
-	case event.Action == "s3":
-		csvContent, total, err = buildCSVFile(allTagsToSync, environmentVars)
-		if err != nil {
-			return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
-				"Error building csv output:")
+	if svc.checkpoint.isResumed() {
+		allTagsToSync = svc.checkpoint.syncOptions()
+	} else {
+		filterCtx, filterSpan := startSpan(ctx, phaseFilter)
+		allTagsToSync, repoErrors = proc.processRepositories(filterCtx, repositories, maxConcurrent, event.MaxResults, event.CheckDigest, environmentVars)
+		filterSpan.End()
+
+		if err := svc.checkpoint.start(ctx, allTagsToSync); err != nil {
+			return returnErr(ctx, err, n, result,
+				"Error saving checkpoint:")
 		}
-	default:
-		err = proc.svc.authToECR(environmentVars)
+	}
+	csvContent, total, err := buildCSVFile(allTagsToSync, environmentVars)
+
+	if err != nil {
+		return returnErr(ctx, err, n, result,
+			"Error building csv output:")
+	}
+	result.Images = imageResultsFromSyncOptions(allTagsToSync, environmentVars, statusPending)
+
+	if event.Action != actionS3 {
+		err = proc.svc.authToECR(ctx, environmentVars)
 		if err != nil {
-			return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
+			return returnErr(ctx, err, n, result,
 				"Error authenticating to ECR:")
 		}
-		total, syncErrors = proc.processTags(allTagsToSync, maxConcurrent, environmentVars)
+		syncCtx, syncSpan := startSpan(ctx, phaseSync)
+		total, syncErrors = proc.processTags(syncCtx, allTagsToSync, maxConcurrent, environmentVars)
+		syncSpan.End()
+		result.Images = imageResultsFromSyncOptions(allTagsToSync, environmentVars, statusSynced)
+		result.BytesUploaded, result.BytesSkipped = transferTotals(allTagsToSync)
+		result.Total = total
+		continuationToken, remaining, err = svc.checkpoint.finish(ctx)
+
+		if err != nil {
+			logger.Error("error saving checkpoint", logKeyPhase, phaseSync, logKeyError, err)
+		}
+
 		for _, err := range syncErrors {
-			return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
+			resp, err := returnErr(ctx, err, n, result,
 				"Error syncing repositories:")
+			// the failed and remaining tags are retried with the token
+			resp.ContinuationToken = continuationToken
+			return resp, err
 		}
-
 	}
 
 	resultMessage := fmt.Sprintf("Successfully synced %s images to the ecr", strconv.Itoa(total))
 
-	if csvContent != nil && event.Action == "s3" && environmentVars.awsBucket != "" {
+	if continuationToken != "" {
+		resultMessage = fmt.Sprintf("Synced %d images to the ecr, %d images remaining, continue with token %s", total, remaining, continuationToken)
+	}
 
-		if err := outputToS3Bucket(csvContent, csvFile, zipFile, environmentVars.awsRegion, environmentVars.awsBucket); err != nil {
-			return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
-				"Error while writing zip file to the S3 Bucket with error:")
+	if csvContent != nil && event.Action == actionS3 && environmentVars.awsBucket != "" {
+
+		uploader, err := newS3Uploader(environmentVars.awsRegion, environmentVars.s3Endpoint)
+
+		if err != nil {
+			return returnErr(ctx, err, n, result,
+				"Error creating S3 client:")
 		}
 
-		if !event.SlackErrorsOnly {
-			sendResultsToSlack(event.SlackMSGHeader, event.SlackMSGSubject, &csvContent, environmentVars.slackOAuthToken, event.SlackChannelID)
+		outputCtx, outputSpan := startSpan(ctx, phaseOutput)
+		err = outputToS3Bucket(outputCtx, uploader, csvContent, s3OutputOptionsFromEvent(event, environmentVars, result))
+		endSpan(outputSpan, err)
+
+		if err != nil {
+			return returnErr(ctx, err, n, result,
+				"Error while writing zip file to the S3 Bucket with error:")
 		}
 		resultMessage = fmt.Sprintf("Successfully added %s images to the csv", strconv.Itoa(total))
 	}
+	for _, err := range repoErrors {
+		return returnErr(ctx, err, n, result,
+			"Error processing repositories:")
+	}
+	logger.Info(resultMessage, logKeyPhase, phaseOutput, "total", total)
 
-	if err != nil {
-		return returnErr(err, environmentVars.slackOAuthToken, event.SlackChannelID, errSubject,
-			"Lambda function resulted with error:")
+	result.Ok = true
+	result.Message = resultMessage
+	result.Total = total
+	result.Finished = time.Now()
+
+	if total > 0 {
+		n.notify(ctx, result)
 	}
-	log.Print(resultMessage)
 
 	return response{
-		Message: resultMessage,
-		Ok:      true,
+		BytesSkipped:      result.BytesSkipped,
+		BytesUploaded:     result.BytesUploaded,
+		ContinuationToken: continuationToken,
+		Message:           resultMessage,
+		Ok:                true,
+		Problems:          problems,
 	}, nil
 }
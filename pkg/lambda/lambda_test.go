@@ -93,11 +93,9 @@ func Test_maxInt(t *testing.T) {
 
 func Test_returnErr(t *testing.T) {
 	type args struct {
-		err              error
-		slackOAuthTokenm string
-		slackChannelID   string
-		errSubject       string
-		errText          string
+		err     error
+		result  *runResult
+		errText string
 	}
 	tests := []struct {
 		name    string
@@ -109,7 +107,7 @@ func Test_returnErr(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := returnErr(tt.args.err, tt.args.slackOAuthTokenm, tt.args.slackChannelID, tt.args.errSubject, tt.args.errText)
+			got, err := returnErr(context.Background(), tt.args.err, nil, tt.args.result, tt.args.errText)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("returnErr() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -140,7 +138,7 @@ func TestLambda(t *testing.T) {
 				},
 			},
 			want: response{
-				Message: "Error reading environment variables , or not set: &{%!f(string=error no environment variables set)}",
+				Message: "Error reading environment variables , or not set: error no environment variables set",
 				Ok:      false,
 			},
 			wantErr: true,
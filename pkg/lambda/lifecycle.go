@@ -0,0 +1,326 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+const (
+	actionLifecycle = "lifecycle"
+
+	lifecycleDescriptionPrefix = "ecr-image-sync: "
+	lifecycleTagged            = "tagged" // lifecycle policies use lower case tag statuses unlike the ecr api
+	lifecycleUntagged          = "untagged"
+)
+
+// lifecyclePolicy is an ecr lifecycle policy document
+type lifecyclePolicy struct {
+	Rules []lifecycleRule `json:"rules"`
+}
+
+type lifecycleRule struct {
+	RulePriority int                `json:"rulePriority"`
+	Description  string             `json:"description,omitempty"`
+	Selection    lifecycleSelection `json:"selection"`
+	Action       lifecycleAction    `json:"action"`
+}
+
+type lifecycleSelection struct {
+	TagStatus     string   `json:"tagStatus"`
+	TagPrefixList []string `json:"tagPrefixList,omitempty"`
+	CountType     string   `json:"countType"`
+	CountUnit     string   `json:"countUnit,omitempty"`
+	CountNumber   int      `json:"countNumber"`
+}
+
+type lifecycleAction struct {
+	Type string `json:"type"`
+}
+
+// lifecyclePlan is the lifecycle policy change of a repository, the fields are part of the public interface
+type lifecyclePlan struct {
+	Applied    bool   `json:"applied"`
+	Changed    bool   `json:"changed"`
+	Diff       string `json:"diff,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Policy     string `json:"policy,omitempty"`
+	Repository string `json:"repository"`
+}
+
+// policyPrefixes returns the ecr_sync_lifecycle_prefixes or the prefixes of the mirrored versions up to and including
+// the separator after the major version, like v1. for v1.2.3 and 10. for 10.0.1 so 1. doesn't match 10.0.1. Versions
+// without a separator like 2 have no prefix
+func (i *inputRepository) policyPrefixes(ecrTags []string) ([]string, error) {
+	if len(i.lifecyclePrefixes) > 0 {
+		return i.lifecyclePrefixes, nil
+	}
+	versions, err := i.selectedVersions(ecrTags)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make(map[string]bool)
+
+	for _, v := range versions {
+		tag := v.Original()
+		start := strings.IndexFunc(tag, unicode.IsDigit)
+
+		if start < 0 {
+			continue
+		}
+
+		if end := strings.IndexFunc(tag[start:], func(r rune) bool { return !unicode.IsDigit(r) }); end >= 0 {
+			prefixes[tag[:start+end+1]] = true
+		}
+	}
+	return sortedKeys(prefixes), nil
+}
+
+// keptImages returns the number of images the sync keeps, 0 when unlimited. Groups keep at most the groups times the
+// tags per group and variants keep them per variant
+func (i *inputRepository) keptImages(globalMaxResults int) int {
+	kept := max(i.getMaxResults(globalMaxResults), 0)
+
+	if g := i.newVersionGroups(); g != nil && g.groups > 0 && (kept == 0 || g.groups*g.perGroup < kept) {
+		kept = g.groups * g.perGroup
+	}
+	return kept * max(len(i.variants), 1)
+}
+
+// buildLifecyclePolicy returns the policy expiring untagged images after the untagged days, keeping the newest kept
+// images per prefix, nil when there is nothing to expire. Provenance artifacts are not expired, a count can't tell
+// which of them belong to images that are still tagged
+func buildLifecyclePolicy(untaggedDays, kept int, prefixes []string) *lifecyclePolicy {
+	policy := &lifecyclePolicy{}
+
+	if untaggedDays > 0 {
+		policy.Rules = append(policy.Rules, lifecycleRule{
+			Description: fmt.Sprintf("%sexpire untagged images after %d days", lifecycleDescriptionPrefix, untaggedDays),
+			Selection:   lifecycleSelection{TagStatus: lifecycleUntagged, CountType: "sinceImagePushed", CountUnit: "days", CountNumber: untaggedDays},
+		})
+	}
+
+	if kept > 0 && len(prefixes) > 0 {
+		for _, p := range prefixes {
+			policy.Rules = append(policy.Rules, lifecycleRule{
+				Description: fmt.Sprintf("%skeep the newest %d %s* images", lifecycleDescriptionPrefix, kept, p),
+				Selection:   lifecycleSelection{TagStatus: lifecycleTagged, TagPrefixList: []string{p}, CountType: "imageCountMoreThan", CountNumber: kept},
+			})
+		}
+	}
+
+	if len(policy.Rules) == 0 {
+		return nil
+	}
+
+	for i := range policy.Rules {
+		policy.Rules[i].RulePriority = i + 1
+		policy.Rules[i].Action = lifecycleAction{Type: "expire"}
+	}
+	return policy
+}
+
+// normalizePolicy returns the policy text indented with the keys in a fixed order so policies can be compared
+func normalizePolicy(text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	var policy lifecyclePolicy
+
+	if err := json.Unmarshal([]byte(text), &policy); err != nil {
+		return "", fmt.Errorf("parsing lifecycle policy: %w", err)
+	}
+	sort.Slice(policy.Rules, func(i, j int) bool { return policy.Rules[i].RulePriority < policy.Rules[j].RulePriority })
+	out, err := json.MarshalIndent(policy, "", "  ")
+
+	return string(out), err
+}
+
+// diffLines returns the lines removed from a with - and the lines added in b with +, using the longest common subsequence
+func diffLines(a, b string) string {
+	x, y := splitLines(a), splitLines(b)
+	lcs := make([][]int, len(x)+1)
+
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out strings.Builder
+	i, j := 0, 0
+
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			out.WriteString("  " + x[i] + "\n")
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + x[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + y[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
+
+// splitLines returns the lines of s, none when s is empty
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// getLifecyclePolicy returns the lifecycle policy text of the repository, empty without policy
+func (svc *ecrClient) getLifecyclePolicy(ctx context.Context, repo string) (string, error) {
+	out, err := svc.GetLifecyclePolicyWithContext(ctx, &ecr.GetLifecyclePolicyInput{RepositoryName: aws.String(repo)})
+	var awsErr awserr.Error
+
+	if errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeLifecyclePolicyNotFoundException {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.LifecyclePolicyText), nil
+}
+
+// planLifecycle compares the generated policy with the current policy of the repository and puts it when apply is set
+func (svc *ecrClient) planLifecycle(ctx context.Context, repo inputRepository, region string, maxResults, untaggedDays int, apply bool) (plan lifecyclePlan, err error) {
+	plan.Repository = repo.ecrImageName
+	images, err := svc.getImagesFromECR(ctx, repo.ecrImageName, region, &repo)
+	if err != nil {
+		return plan, err
+	}
+	ecrTags := make([]string, 0, len(images))
+
+	for _, image := range images {
+		ecrTags = append(ecrTags, image.tag)
+	}
+	prefixes, err := repo.policyPrefixes(ecrTags)
+	if err != nil {
+		return plan, err
+	}
+	policy := buildLifecyclePolicy(tryInt(repo.untaggedDays, untaggedDays), repo.keptImages(maxResults), prefixes)
+
+	if policy == nil {
+		return plan, nil
+	}
+	generated, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return plan, err
+	}
+	current, err := svc.getLifecyclePolicy(ctx, repo.ecrImageName)
+	if err != nil {
+		return plan, err
+	}
+	if current, err = normalizePolicy(current); err != nil {
+		return plan, err
+	}
+	plan.Policy = string(generated)
+	plan.Changed = current != plan.Policy
+
+	if !plan.Changed {
+		return plan, nil
+	}
+	plan.Diff = diffLines(current, plan.Policy)
+
+	if apply {
+		_, err = svc.PutLifecyclePolicyWithContext(ctx, &ecr.PutLifecyclePolicyInput{
+			LifecyclePolicyText: aws.String(plan.Policy),
+			RepositoryName:      aws.String(repo.ecrImageName),
+		})
+		plan.Applied = err == nil
+	}
+	return plan, err
+}
+
+// planLifecycles returns the lifecycle plans of the repositories sorted by repository
+func (svc *ecrClient) planLifecycles(ctx context.Context, repositories []inputRepository, event LambdaEvent, region string, max int) []lifecyclePlan {
+	plans := make([]lifecyclePlan, len(repositories))
+
+	forEach(len(repositories), max, func(i int) {
+		plan, err := svc.planLifecycle(ctx, repositories[i], region, event.MaxResults, event.LifecycleUntaggedDays, event.LifecycleApply)
+
+		if err != nil {
+			svc.log().Error("error planning lifecycle policy", logKeyPhase, phaseSync, logKeyRepository, repositories[i].ecrImageName, logKeyError, err)
+			plan.Error = err.Error()
+		}
+		plans[i] = plan
+	})
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Repository < plans[j].Repository })
+	return plans
+}
+
+// lifecycleMarkdown returns the diffs of the changed policies and the errors
+func lifecycleMarkdown(plans []lifecyclePlan, summary string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# ECR lifecycle policies\n\n%s\n", summary)
+
+	for _, p := range plans {
+		switch {
+		case p.Error != "":
+			fmt.Fprintf(&b, "\n## %s\n\nerror: %s\n", p.Repository, p.Error)
+		case p.Changed:
+			fmt.Fprintf(&b, "\n## %s\n\n```diff\n%s```\n", p.Repository, p.Diff)
+		}
+	}
+	return b.String()
+}
+
+// runLifecycle plans the lifecycle policies of the repositories, applies the changed policies with lifecycle_apply
+// and sends the diffs to the notifiers
+func (svc *ecrClient) runLifecycle(ctx context.Context, event LambdaEvent, env environmentVars, repositories []inputRepository, max int, n notifiers, result *runResult) (response, error) {
+	plans := svc.planLifecycles(ctx, repositories, event, env.awsRegion, max)
+	changed, applied, failed := 0, 0, 0
+
+	for _, p := range plans {
+		if p.Changed {
+			changed++
+		}
+
+		if p.Applied {
+			applied++
+		}
+
+		if p.Error != "" {
+			failed++
+		}
+	}
+	result.Message = fmt.Sprintf("%d of %d lifecycle policies changed, %d applied, %d failed", changed, len(plans), applied, failed)
+	svc.log().Info(result.Message, logKeyPhase, phaseOutput, "changed", changed, "applied", applied)
+
+	result.Ok = true
+	result.Report = lifecycleMarkdown(plans, result.Message)
+	result.Finished = time.Now()
+
+	if changed > 0 || failed > 0 {
+		n.notify(ctx, result)
+	}
+
+	return response{
+		Lifecycle: plans,
+		Message:   result.Message,
+		Ok:        true,
+	}, nil
+}
@@ -0,0 +1,206 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+type mockLifecycleECRClient struct {
+	mockECRClient
+	policy string
+	put    *ecr.PutLifecyclePolicyInput
+}
+
+func (m *mockLifecycleECRClient) GetLifecyclePolicyWithContext(ctx aws.Context, input *ecr.GetLifecyclePolicyInput, opts ...request.Option) (*ecr.GetLifecyclePolicyOutput, error) {
+	if m.policy == "" {
+		return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "no policy", nil)
+	}
+	return &ecr.GetLifecyclePolicyOutput{LifecyclePolicyText: aws.String(m.policy), RepositoryName: input.RepositoryName}, nil
+}
+
+func (m *mockLifecycleECRClient) PutLifecyclePolicyWithContext(ctx aws.Context, input *ecr.PutLifecyclePolicyInput, opts ...request.Option) (*ecr.PutLifecyclePolicyOutput, error) {
+	m.put = input
+	return &ecr.PutLifecyclePolicyOutput{LifecyclePolicyText: input.LifecyclePolicyText, RepositoryName: input.RepositoryName}, nil
+}
+
+func Test_buildLifecyclePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		untaggedDays int
+		kept         int
+		prefixes     []string
+		want         []lifecycleSelection
+	}{
+		{
+			name:         "untagged and prefixes",
+			untaggedDays: 14,
+			kept:         5,
+			prefixes:     []string{"v1.", "v2."},
+			want: []lifecycleSelection{
+				{TagStatus: "untagged", CountType: "sinceImagePushed", CountUnit: "days", CountNumber: 14},
+				{TagStatus: "tagged", TagPrefixList: []string{"v1."}, CountType: "imageCountMoreThan", CountNumber: 5},
+				{TagStatus: "tagged", TagPrefixList: []string{"v2."}, CountType: "imageCountMoreThan", CountNumber: 5},
+			},
+		},
+		{
+			name:     "unlimited results",
+			prefixes: []string{"v1."},
+		},
+		{
+			name: "no prefixes",
+			kept: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := buildLifecyclePolicy(tt.untaggedDays, tt.kept, tt.prefixes)
+			if tt.want == nil {
+				if policy != nil {
+					t.Errorf("buildLifecyclePolicy() = %+v, want nil", policy)
+				}
+				return
+			}
+			var got []lifecycleSelection
+
+			for i, r := range policy.Rules {
+				if r.RulePriority != i+1 || r.Action.Type != "expire" {
+					t.Errorf("buildLifecyclePolicy() rule %d = %+v, want priority %d and expire", i, r, i+1)
+				}
+				got = append(got, r.Selection)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildLifecyclePolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_inputRepository_policyPrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		i    *inputRepository
+		tags []string
+		want []string
+	}{
+		{
+			name: "derived from the mirrored versions",
+			i:    &inputRepository{},
+			tags: []string{"v1.1.1", "v1.2.0", "v2.0.0", "latest"},
+			want: []string{"v1.", "v2."},
+		},
+		{
+			name: "filtered by the constraint",
+			i:    &inputRepository{constraint: ">= 2.0.0"},
+			tags: []string{"1.9.0", "2.0.0", "3.1.0"},
+			want: []string{"2.", "3."},
+		},
+		{
+			name: "up to the separator",
+			i:    &inputRepository{},
+			tags: []string{"1.2.0", "10.1.0", "v2-alpine", "3"},
+			want: []string{"1.", "10.", "v2-"},
+		},
+		{
+			name: "explicit prefixes",
+			i:    &inputRepository{lifecyclePrefixes: []string{"release-"}},
+			tags: []string{"v1.1.1"},
+			want: []string{"release-"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.i.policyPrefixes(tt.tags)
+			if err != nil {
+				t.Fatalf("policyPrefixes() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("policyPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_inputRepository_keptImages(t *testing.T) {
+	tests := []struct {
+		name       string
+		i          *inputRepository
+		maxResults int
+		want       int
+	}{
+		{name: "max results", i: &inputRepository{maxResults: 5}, want: 5},
+		{name: "unlimited", i: &inputRepository{}, want: 0},
+		{name: "groups", i: &inputRepository{groupBy: groupByMinor, groups: 3, tagsPerGroup: 2}, want: 6},
+		{name: "groups limited by max results", i: &inputRepository{groupBy: groupByMinor, groups: 3, tagsPerGroup: 2, maxResults: 4}, want: 4},
+		{name: "variants", i: &inputRepository{variants: []string{"", "alpine"}}, maxResults: 3, want: 6},
+		{name: "grouped variants", i: &inputRepository{variants: []string{"", "alpine"}, groupBy: groupByMajor, groups: 2}, maxResults: 10, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.i.keptImages(tt.maxResults); got != tt.want {
+				t.Errorf("keptImages() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_diffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{name: "changed line", a: "a\nb\nc", b: "a\nx\nc", want: "  a\n- b\n+ x\n  c\n"},
+		{name: "new", a: "", b: "a\nb", want: "+ a\n+ b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffLines(tt.a, tt.b); got != tt.want {
+				t.Errorf("diffLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_planLifecycle(t *testing.T) {
+	repo := inputRepository{ecrImageName: "dev/app", maxResults: 2}
+	current, _ := json.Marshal(buildLifecyclePolicy(0, 2, []string{"v1."}))
+
+	tests := []struct {
+		name        string
+		policy      string
+		apply       bool
+		wantChanged bool
+		wantApplied bool
+	}{
+		{name: "no policy", apply: true, wantChanged: true, wantApplied: true},
+		{name: "unchanged", policy: string(current), apply: true},
+		{name: "dry run", policy: `{"rules":[]}`, wantChanged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockLifecycleECRClient{policy: tt.policy}
+			svc := &ecrClient{ECRAPI: client}
+
+			got, err := svc.planLifecycle(context.Background(), repo, "eu-west-1", 0, 0, tt.apply)
+			if err != nil {
+				t.Fatalf("planLifecycle() error = %v", err)
+			}
+
+			if got.Changed != tt.wantChanged || got.Applied != tt.wantApplied || (client.put != nil) != tt.wantApplied {
+				t.Errorf("planLifecycle() = %+v, want changed %v and applied %v", got, tt.wantChanged, tt.wantApplied)
+			}
+
+			if tt.wantChanged && !strings.Contains(got.Diff, `"v1."`) {
+				t.Errorf("planLifecycle() diff = %s, want the v1. prefix added", got.Diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	bandwidthLimitEnvVar  = "BANDWIDTH_LIMIT"
+	copyJobsEnvVar        = "COPY_JOBS"
+	maxConnsPerHostEnvVar = "MAX_CONNS_PER_HOST"
+)
+
+// copyLimits limit the connections and the bandwidth of all registry calls of a run
+type copyLimits struct {
+	bandwidth    int64 // bytes per second over all copies, unlimited when 0
+	connsPerHost int   // connections per registry host, unlimited when 0
+	jobs         int   // layers copied in parallel per image, crane default when 0
+}
+
+// tokenBucket limits the bytes per second, the bucket holds one second of bytes
+type tokenBucket struct {
+	mu     sync.Mutex
+	last   time.Time
+	rate   float64
+	tokens float64
+}
+
+// bandwidthTransport limits the response bodies to the bandwidth of the bucket
+type bandwidthTransport struct {
+	bucket *tokenBucket
+	inner  http.RoundTripper
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	bucket *tokenBucket
+	ctx    context.Context
+}
+
+// getCopyLimits returns the limits of the event, the environment variables are used for the limits not set in the event
+func getCopyLimits(event LambdaEvent) (limits copyLimits, err error) {
+	limits.jobs, limits.connsPerHost = event.CopyJobs, event.MaxConnsPerHost
+
+	for key, value := range map[string]*int{copyJobsEnvVar: &limits.jobs, maxConnsPerHostEnvVar: &limits.connsPerHost} {
+		if *value == 0 && os.Getenv(key) != "" {
+			if *value, err = strconv.Atoi(os.Getenv(key)); err != nil {
+				return copyLimits{}, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+
+		if *value < 0 {
+			return copyLimits{}, fmt.Errorf("%s: %d is negative", key, *value)
+		}
+	}
+
+	if bandwidth := tryString(event.BandwidthLimit, os.Getenv(bandwidthLimitEnvVar)); bandwidth != "" {
+		if limits.bandwidth, err = parseSize(strings.TrimSuffix(bandwidth, "/s")); err != nil {
+			return copyLimits{}, fmt.Errorf("%s: %w", bandwidthLimitEnvVar, err)
+		}
+	}
+	return limits, nil
+}
+
+// transport returns the transport with the connection and bandwidth limits, nil without limits
+func (l copyLimits) transport() http.RoundTripper {
+	if l.connsPerHost == 0 && l.bandwidth == 0 {
+		return nil
+	}
+	var t http.RoundTripper = remote.DefaultTransport
+
+	if l.connsPerHost > 0 {
+		base := remote.DefaultTransport.(*http.Transport).Clone()
+		base.MaxConnsPerHost = l.connsPerHost
+		t = base
+	}
+
+	if l.bandwidth > 0 {
+		t = &bandwidthTransport{bucket: newTokenBucket(l.bandwidth), inner: t}
+	}
+	return t
+}
+
+// withJobs sets the number of layers copied in parallel, crane v0.13 has no option for it
+func withJobs(jobs int) crane.Option {
+	return func(o *crane.Options) {
+		o.Remote = append(o.Remote, remote.WithJobs(jobs))
+	}
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	return &tokenBucket{last: time.Now(), rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond)}
+}
+
+// wait takes n bytes from the bucket and blocks until they are available or the context is done
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate) - float64(n)
+	b.last = now
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+
+	if n > 0 {
+		if waitErr := r.bucket.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// RoundTrip limits the bytes downloaded by the request, a copy uploads the layers it downloads so the uploads are
+// limited as well without counting every byte twice
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &limitedReader{ReadCloser: resp.Body, bucket: t.bucket, ctx: req.Context()}
+	return resp, nil
+}
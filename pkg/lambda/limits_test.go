@@ -0,0 +1,121 @@
+package lambda
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_getCopyLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   LambdaEvent
+		env     map[string]string
+		want    copyLimits
+		wantErr bool
+	}{
+		{
+			name:  "event",
+			event: LambdaEvent{BandwidthLimit: "20MB/s", CopyJobs: 2, MaxConnsPerHost: 8},
+			want:  copyLimits{bandwidth: 20e6, connsPerHost: 8, jobs: 2},
+		},
+		{
+			name:  "environment variables",
+			event: LambdaEvent{CopyJobs: 1},
+			env:   map[string]string{bandwidthLimitEnvVar: "1MiB", copyJobsEnvVar: "3", maxConnsPerHostEnvVar: "4"},
+			want:  copyLimits{bandwidth: 1 << 20, connsPerHost: 4, jobs: 1},
+		},
+		{
+			name: "no limits",
+			want: copyLimits{},
+		},
+		{
+			name:    "invalid bandwidth",
+			event:   LambdaEvent{BandwidthLimit: "fast"},
+			wantErr: true,
+		},
+		{
+			name:    "negative jobs",
+			event:   LambdaEvent{CopyJobs: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{bandwidthLimitEnvVar, copyJobsEnvVar, maxConnsPerHostEnvVar} {
+				t.Setenv(key, tt.env[key])
+			}
+			got, err := getCopyLimits(tt.event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getCopyLimits() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getCopyLimits() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_copyLimits_transport(t *testing.T) {
+	if got := (copyLimits{jobs: 2}).transport(); got != nil {
+		t.Errorf("transport() = %T, want nil without connection or bandwidth limits", got)
+	}
+
+	got, ok := (copyLimits{bandwidth: 1000, connsPerHost: 2}).transport().(*bandwidthTransport)
+	if !ok {
+		t.Fatalf("transport() is not a bandwidth transport")
+	}
+
+	if inner, ok := got.inner.(*http.Transport); !ok || inner.MaxConnsPerHost != 2 {
+		t.Errorf("transport() inner = %T, want http.Transport with MaxConnsPerHost 2", got.inner)
+	}
+}
+
+func Test_tokenBucket_wait(t *testing.T) {
+	b := newTokenBucket(100_000)
+	start := time.Now()
+
+	if err := b.wait(context.Background(), 100_000); err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("wait() = %v after %v, want the burst without delay", err, time.Since(start))
+	}
+
+	if err := b.wait(context.Background(), 10_000); err != nil || time.Since(start) < 80*time.Millisecond {
+		t.Errorf("wait() = %v after %v, want about 100ms delay", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.wait(ctx, 100_000); err == nil {
+		t.Errorf("wait() = nil, want the context error")
+	}
+}
+
+func Test_bandwidthTransport_RoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &bandwidthTransport{bucket: newTokenBucket(20_000), inner: http.DefaultTransport}}
+	start := time.Now()
+	resp, err := client.Post(server.URL, "application/octet-stream", strings.NewReader(strings.Repeat("x", 40_000)))
+	if err != nil {
+		t.Fatalf("Post() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	// only the 40KB down count at 20KB/s with a burst of 20KB, that takes about a second instead of three
+	if len(body) != 40_000 || elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("RoundTrip() read %d bytes in %v, want 40000 bytes in about a second", len(body), elapsed)
+	}
+}
@@ -0,0 +1,64 @@
+package lambda
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// log field names, these are used in cloudwatch logs insights queries and documented in the README
+const (
+	logKeyError      = "error"
+	logKeyPhase      = "phase"
+	logKeyRepository = "repository"
+	logKeyRunID      = "run_id"
+	logKeySource     = "source"
+	logKeyTag        = "tag"
+	logLevelEnvVar   = "LOG_LEVEL"
+	phaseDiscover    = "discover" // reading the ecr repositories and their ecr_sync tags
+	phaseFilter      = "filter"   // listing and filtering the tags of the source
+	phaseNotify      = "notify"
+	phaseOutput      = "output"
+	phaseSetup       = "setup"
+	phaseSync        = "sync"
+)
+
+// parseLogLevel returns the slog level for debug, info, warn or error, default info
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(level))); err != nil {
+		return slog.LevelInfo, fmt.Errorf("invalid log level: %s", level)
+	}
+	return l, nil
+}
+
+// newLogger returns a json logger for the run, the level of the event takes precedence over the LOG_LEVEL environment variable
+func newLogger(w io.Writer, level, runID string) (*slog.Logger, error) {
+	l, err := parseLogLevel(tryString(level, os.Getenv(logLevelEnvVar)))
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})
+
+	return slog.New(handler).With(logKeyRunID, runID), err
+}
+
+// log returns the logger of the client or the default logger
+func (svc *ecrClient) log() *slog.Logger {
+	if svc.logger == nil {
+		return slog.Default()
+	}
+	return svc.logger
+}
+
+// log returns the logger of the process or the default logger
+func (proc *process) log() *slog.Logger {
+	if proc.logger == nil {
+		return slog.Default()
+	}
+	return proc.logger
+}
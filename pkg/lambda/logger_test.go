@@ -0,0 +1,54 @@
+package lambda
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func Test_parseLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{name: "TestDefault", level: "", want: slog.LevelInfo},
+		{name: "TestDebug", level: "debug", want: slog.LevelDebug},
+		{name: "TestUpperCase", level: "WARN", want: slog.LevelWarn},
+		{name: "TestInvalid", level: "verbose", want: slog.LevelInfo, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLogLevel(tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseLogLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newLogger(t *testing.T) {
+	var b bytes.Buffer
+	t.Setenv(logLevelEnvVar, "error")
+
+	logger, err := newLogger(&b, "", "run1")
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+	logger.Info("skipped")
+	logger.Error("copying image", logKeyRepository, "dev/nginx", logKeyTag, "1.23.3")
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("newLogger() invalid json %s: %v", b.String(), err)
+	}
+	if got[logKeyRunID] != "run1" || got[logKeyRepository] != "dev/nginx" || got[logKeyTag] != "1.23.3" || got["level"] != "ERROR" {
+		t.Errorf("newLogger() line = %v", got)
+	}
+}
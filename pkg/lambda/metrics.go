@@ -0,0 +1,355 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const defaultMetricsNamespace = "ECRImageSync"
+
+// metric names, these are part of the public interface and documented in the README
+const (
+	metricBytesPushed       = "BytesPushed"
+	metricDigestMismatches  = "DigestMismatches"
+	metricErrors            = "Errors"
+	metricTagsCopied        = "TagsCopied"
+	metricTagsFiltered      = "TagsFiltered"
+	metricTagsSeen          = "TagsSeen"
+	metricUpstreamDuration  = "UpstreamRequestDuration"
+	metricUpstreamRequests  = "UpstreamRequests"
+	dimensionAction         = "Action"
+	dimensionErrorClass     = "ErrorClass"
+	dimensionRepository     = "Repository"
+	errorClassAuth          = "Auth"
+	errorClassNetwork       = "Network"
+	errorClassNotFound      = "NotFound"
+	errorClassOther         = "Other"
+	errorClassRateLimit     = "RateLimit"
+	errorClassTimeout       = "Timeout"
+	unitBytes               = "Bytes"
+	unitCount               = "Count"
+	unitMilliseconds        = "Milliseconds"
+	registryTokenScopeParam = "scope"
+)
+
+var matchRegistryPath = regexp.MustCompile(`^/v2/(.+?)/(manifests|blobs|tags)/`)
+
+type repositoryMetrics struct {
+	bytesPushed      int64
+	digestMismatches int64
+	errors           map[string]int64
+	tagsCopied       int64
+	tagsFiltered     int64
+	tagsSeen         int64
+	upstreamDuration time.Duration
+	upstreamRequests int64
+}
+
+// metricsRecorder collects the metrics of a run for each repository
+type metricsRecorder struct {
+	mu           sync.Mutex
+	namespace    string
+	pushHosts    map[string]bool
+	references   map[string]string
+	repositories map[string]*repositoryMetrics
+}
+
+type metricsTransport struct {
+	inner   http.RoundTripper
+	metrics *metricsRecorder
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+func newMetricsRecorder(namespace string) *metricsRecorder {
+	return &metricsRecorder{
+		namespace:    tryString(namespace, defaultMetricsNamespace),
+		pushHosts:    make(map[string]bool),
+		references:   make(map[string]string),
+		repositories: make(map[string]*repositoryMetrics),
+	}
+}
+
+// registerSource maps requests for the source image to the ecr repository
+func (m *metricsRecorder) registerSource(source, repository string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ref, err := name.NewRepository(source); err == nil {
+		m.references[ref.RegistryStr()+"/"+ref.RepositoryStr()] = repository
+		m.references[ref.RepositoryStr()] = repository
+	}
+	m.references[source] = repository
+}
+
+// registerPushHost marks requests to the host as pushes to the ecr repository
+func (m *metricsRecorder) registerPushHost(host string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pushHosts[host] = true
+}
+
+// add updates the metrics of the repository
+func (m *metricsRecorder) add(repository string, update func(r *repositoryMetrics)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.repositories[repository]
+
+	if !ok {
+		r = &repositoryMetrics{errors: make(map[string]int64)}
+		m.repositories[repository] = r
+	}
+	update(r)
+}
+
+// addError counts the error by class for the repository
+func (m *metricsRecorder) addError(repository string, err error) {
+	if err == nil {
+		return
+	}
+	class := classifyError(err)
+	m.add(repository, func(r *repositoryMetrics) { r.errors[class]++ })
+}
+
+// lookup returns the ecr repository of a registry request
+func (m *metricsRecorder) lookup(req *http.Request) (repository string, push bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	push = m.pushHosts[req.URL.Host]
+	path := ""
+
+	if match := matchRegistryPath.FindStringSubmatch(req.URL.Path); match != nil {
+		path = match[1]
+	} else if scope := req.URL.Query().Get(registryTokenScopeParam); strings.HasPrefix(scope, "repository:") {
+		path = strings.SplitN(strings.TrimPrefix(scope, "repository:"), ":", 2)[0]
+	}
+
+	if path == "" {
+		return "", push
+	}
+
+	if push {
+		return path, push
+	}
+
+	if repository, ok := m.references[req.URL.Host+"/"+path]; ok {
+		return repository, push
+	}
+	return m.references[path], push
+}
+
+// classifyError returns the error class used as metric dimension
+func classifyError(err error) string {
+	var terr *transport.Error
+	var nerr net.Error
+	msg := strings.ToLower(err.Error())
+
+	switch {
+	case errors.As(err, &terr) && terr.StatusCode == http.StatusTooManyRequests,
+		strings.Contains(msg, "toomanyrequests"), strings.Contains(msg, "rate limit"):
+		return errorClassRateLimit
+	case errors.As(err, &terr) && (terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden),
+		strings.Contains(msg, "unauthorized"), strings.Contains(msg, "denied"):
+		return errorClassAuth
+	case errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound,
+		strings.Contains(msg, "manifest_unknown"), strings.Contains(msg, "name_unknown"), strings.Contains(msg, "not found"):
+		return errorClassNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return errorClassTimeout
+	case errors.As(err, &nerr):
+		return errorClassNetwork
+	}
+	return errorClassOther
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// RoundTrip counts the upstream requests and the bytes pushed to ecr
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	repository, push := t.metrics.lookup(req)
+	var body *countingReader
+
+	if push && req.Body != nil {
+		body = &countingReader{ReadCloser: req.Body}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	start := time.Now()
+	resp, err := t.inner.RoundTrip(req)
+	duration := time.Since(start)
+
+	t.metrics.add(repository, func(r *repositoryMetrics) {
+		if push {
+			if body != nil && err == nil && resp.StatusCode < http.StatusBadRequest {
+				r.bytesPushed += body.count
+			}
+			return
+		}
+		r.upstreamRequests++
+		r.upstreamDuration += duration
+	})
+	return resp, err
+}
+
+// emfLine returns a single embedded metric format log line
+func (m *metricsRecorder) emfLine(timestamp time.Time, dimensions [][]string, metrics []emfMetric, values map[string]interface{}) ([]byte, error) {
+	values["_aws"] = emfMetadata{
+		Timestamp: timestamp.UnixMilli(),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  m.namespace,
+			Dimensions: dimensions,
+			Metrics:    metrics,
+		}},
+	}
+	return json.Marshal(values)
+}
+
+// repositoryMetricValues returns the metric values of the repository
+func repositoryMetricValues(r *repositoryMetrics) map[string]interface{} {
+	return map[string]interface{}{
+		metricBytesPushed:      r.bytesPushed,
+		metricDigestMismatches: r.digestMismatches,
+		metricTagsCopied:       r.tagsCopied,
+		metricTagsFiltered:     r.tagsFiltered,
+		metricTagsSeen:         r.tagsSeen,
+		metricUpstreamDuration: r.upstreamDuration.Milliseconds(),
+		metricUpstreamRequests: r.upstreamRequests,
+	}
+}
+
+var repositoryMetricDefinitions = []emfMetric{
+	{metricBytesPushed, unitBytes},
+	{metricDigestMismatches, unitCount},
+	{metricTagsCopied, unitCount},
+	{metricTagsFiltered, unitCount},
+	{metricTagsSeen, unitCount},
+	{metricUpstreamDuration, unitMilliseconds},
+	{metricUpstreamRequests, unitCount},
+}
+
+// flush writes the metrics for each repository and the run totals as embedded metric format log lines
+func (m *metricsRecorder) flush(w io.Writer, runID, action string, timestamp time.Time) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := &repositoryMetrics{errors: make(map[string]int64)}
+	var lines [][]byte
+
+	for _, repository := range sortedKeys(m.repositories) {
+		r := m.repositories[repository]
+		total.bytesPushed += r.bytesPushed
+		total.digestMismatches += r.digestMismatches
+		total.tagsCopied += r.tagsCopied
+		total.tagsFiltered += r.tagsFiltered
+		total.tagsSeen += r.tagsSeen
+		total.upstreamDuration += r.upstreamDuration
+		total.upstreamRequests += r.upstreamRequests
+
+		for class, count := range r.errors {
+			total.errors[class] += count
+		}
+
+		if repository == "" {
+			continue
+		}
+		values := repositoryMetricValues(r)
+		values[dimensionRepository] = repository
+		values["RunID"] = runID
+		line, err := m.emfLine(timestamp, [][]string{{dimensionRepository}}, repositoryMetricDefinitions, values)
+
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+
+		for _, class := range sortedKeys(r.errors) {
+			line, err := m.emfLine(timestamp, [][]string{{dimensionRepository, dimensionErrorClass}}, []emfMetric{{metricErrors, unitCount}}, map[string]interface{}{
+				dimensionRepository: repository,
+				dimensionErrorClass: class,
+				metricErrors:        r.errors[class],
+				"RunID":             runID,
+			})
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+	}
+	values := repositoryMetricValues(total)
+	values[dimensionAction] = action
+	values["RunID"] = runID
+	line, err := m.emfLine(timestamp, [][]string{{dimensionAction}}, repositoryMetricDefinitions, values)
+
+	if err != nil {
+		return err
+	}
+	lines = append(lines, line)
+
+	for _, class := range sortedKeys(total.errors) {
+		line, err := m.emfLine(timestamp, [][]string{{dimensionAction, dimensionErrorClass}}, []emfMetric{{metricErrors, unitCount}}, map[string]interface{}{
+			dimensionAction:     action,
+			dimensionErrorClass: class,
+			metricErrors:        total.errors[class],
+			"RunID":             runID,
+		})
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line := range lines {
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
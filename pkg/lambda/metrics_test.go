@@ -0,0 +1,193 @@
+package lambda
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "TestRateLimit",
+			err:  &transport.Error{StatusCode: http.StatusTooManyRequests},
+			want: errorClassRateLimit,
+		},
+		{
+			name: "TestRateLimitMessage",
+			err:  errors.New("TOOMANYREQUESTS: You have reached your pull rate limit"),
+			want: errorClassRateLimit,
+		},
+		{
+			name: "TestAuth",
+			err:  fmt.Errorf("copying: %w", &transport.Error{StatusCode: http.StatusUnauthorized}),
+			want: errorClassAuth,
+		},
+		{
+			name: "TestNotFound",
+			err:  &transport.Error{StatusCode: http.StatusNotFound},
+			want: errorClassNotFound,
+		},
+		{
+			name: "TestTimeout",
+			err:  fmt.Errorf("listing tags: %w", context.DeadlineExceeded),
+			want: errorClassTimeout,
+		},
+		{
+			name: "TestNetwork",
+			err:  &url.Error{Op: "Get", URL: "https://gcr.io", Err: errors.New("connection refused")},
+			want: errorClassNetwork,
+		},
+		{
+			name: "TestOther",
+			err:  errors.New("something went wrong"),
+			want: errorClassOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_metricsRecorder_lookup(t *testing.T) {
+	m := newMetricsRecorder("")
+	m.registerSource("docker.io/bitnami/nginx", "dev/nginx")
+	m.registerSource("gcr.io/datadoghq/agent", "base/datadoghq/agent")
+	m.registerPushHost("123.dkr.ecr.eu-west-1.amazonaws.com")
+
+	tests := []struct {
+		name           string
+		url            string
+		wantRepository string
+		wantPush       bool
+	}{
+		{
+			name:           "TestManifest",
+			url:            "https://gcr.io/v2/datadoghq/agent/manifests/7.40.0",
+			wantRepository: "base/datadoghq/agent",
+		},
+		{
+			name:           "TestDockerHubBlob",
+			url:            "https://index.docker.io/v2/bitnami/nginx/blobs/sha256:abc",
+			wantRepository: "dev/nginx",
+		},
+		{
+			name:           "TestTokenScope",
+			url:            "https://auth.docker.io/token?scope=repository%3Abitnami%2Fnginx%3Apull&service=registry.docker.io",
+			wantRepository: "dev/nginx",
+		},
+		{
+			name:           "TestPush",
+			url:            "https://123.dkr.ecr.eu-west-1.amazonaws.com/v2/dev/nginx/blobs/uploads/",
+			wantRepository: "dev/nginx",
+			wantPush:       true,
+		},
+		{
+			name: "TestUnknown",
+			url:  "https://gcr.io/v2/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			gotRepository, gotPush := m.lookup(req)
+			if gotRepository != tt.wantRepository || gotPush != tt.wantPush {
+				t.Errorf("lookup() = %v, %v, want %v, %v", gotRepository, gotPush, tt.wantRepository, tt.wantPush)
+			}
+		})
+	}
+}
+
+func Test_metricsTransport_RoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	m := newMetricsRecorder("")
+	m.registerSource(host+"/library/nginx", "dev/nginx")
+	client := &http.Client{Transport: &metricsTransport{inner: http.DefaultTransport, metrics: m}}
+
+	resp, err := client.Get(server.URL + "/v2/library/nginx/manifests/latest")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+
+	m.registerPushHost(host)
+	resp, err = client.Post(server.URL+"/v2/dev/nginx/blobs/uploads/", "application/octet-stream", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatalf("Post() error = %v", err)
+	}
+	resp.Body.Close()
+
+	r := m.repositories["dev/nginx"]
+	if r == nil || r.upstreamRequests != 1 || r.bytesPushed != 10 {
+		t.Errorf("RoundTrip() metrics = %+v, want 1 upstream request and 10 bytes pushed", r)
+	}
+}
+
+func Test_metricsRecorder_flush(t *testing.T) {
+	m := newMetricsRecorder("Test")
+	m.add("dev/nginx", func(r *repositoryMetrics) {
+		r.tagsSeen = 10
+		r.tagsCopied = 2
+	})
+	m.add("dev/redis", func(r *repositoryMetrics) { r.tagsSeen = 5 })
+	m.addError("dev/redis", &transport.Error{StatusCode: http.StatusTooManyRequests})
+
+	var b bytes.Buffer
+	if err := m.flush(&b, "run1", "sync", time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&b)
+
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("flush() invalid json line %s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	// nginx, redis, redis errors, run total, run total errors
+	if len(lines) != 5 {
+		t.Fatalf("flush() wrote %v lines, want 5", len(lines))
+	}
+	total := lines[3]
+	if total[dimensionAction] != "sync" || total[metricTagsSeen] != float64(15) || total["RunID"] != "run1" {
+		t.Errorf("flush() total line = %v", total)
+	}
+	if lines[4][dimensionErrorClass] != errorClassRateLimit || lines[4][metricErrors] != float64(1) {
+		t.Errorf("flush() error line = %v", lines[4])
+	}
+	aws := lines[0]["_aws"].(map[string]interface{})
+	if aws["Timestamp"] != float64(1700000000000) {
+		t.Errorf("flush() timestamp = %v", aws["Timestamp"])
+	}
+	if directive := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{}); directive["Namespace"] != "Test" {
+		t.Errorf("flush() namespace = %v, want Test", directive["Namespace"])
+	}
+}
@@ -0,0 +1,353 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	githubTokenEnvVar = "GITHUB_TOKEN"
+	namespaceWildcard = "/*"
+)
+
+// errNotFound is returned by getJSON for a 404 response
+var errNotFound = errors.New("not found")
+
+// registry apis used to list a namespace, variables so they can be replaced in tests
+var (
+	dockerHubAPI = "https://hub.docker.com"
+	githubAPI    = "https://api.github.com"
+	quayAPI      = "https://quay.io"
+)
+
+// namespaceTemplate is a repository with a wildcard source like quay.io/cilium/*, the repositories of the namespace are
+// mirrored below the template repository with the ecr_sync tags of the template
+type namespaceTemplate struct {
+	exclude []string // repository name patterns like *-dev
+	include []string // repository name patterns, all repositories when empty
+	source  string   // namespace without the wildcard like quay.io/cilium
+	tags    map[string]string
+}
+
+// namespaceLister lists the repositories of a namespace relative to the namespace
+type namespaceLister func(ctx context.Context, client *http.Client, registry, namespace string, opts ...crane.Option) ([]string, error)
+
+// isNamespaceSource returns true for wildcard sources like quay.io/cilium/*
+func isNamespaceSource(source string) bool {
+	return strings.HasSuffix(source, namespaceWildcard)
+}
+
+// newNamespaceTemplate returns the template of the repository tags, nil when the source is not a namespace
+func newNamespaceTemplate(tags map[string]string) *namespaceTemplate {
+	if !isNamespaceSource(tags["ecr_sync_source"]) {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return &namespaceTemplate{
+		exclude: stringToSlice(tags["ecr_sync_exclude_repos"]),
+		include: stringToSlice(tags["ecr_sync_include_repos"]),
+		source:  strings.TrimSuffix(tags["ecr_sync_source"], namespaceWildcard),
+		tags:    copied,
+	}
+}
+
+// match returns true when the repository name matches an include pattern and no exclude pattern
+func (t *namespaceTemplate) match(repo string) bool {
+	for _, p := range t.exclude {
+		if ok, _ := path.Match(p, repo); ok {
+			return false
+		}
+	}
+
+	for _, p := range t.include {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+	return len(t.include) == 0
+}
+
+// repositoryTags returns the ecr tags of a repository of the namespace, the tags of the template with the source of the repository
+func (t *namespaceTemplate) repositoryTags(repo string) map[string]string {
+	tags := map[string]string{"ecr_sync_opt": "in"}
+
+	for k, v := range t.tags {
+		if k != "ecr_sync_include_repos" && k != "ecr_sync_exclude_repos" {
+			tags[k] = v
+		}
+	}
+	tags["ecr_sync_source"] = t.source + "/" + repo
+	return tags
+}
+
+// namespaceListerFor returns the registry specific lister, registries without one are listed with the _catalog api
+func namespaceListerFor(registry string) namespaceLister {
+	switch registry {
+	case name.DefaultRegistry, "docker.io", "registry-1.docker.io":
+		return listDockerHubNamespace
+	case "quay.io":
+		return listQuayNamespace
+	case "ghcr.io":
+		return listGitHubNamespace
+	}
+	return listCatalogNamespace
+}
+
+// listNamespace returns the repositories of the namespace of the template that match the patterns, sorted
+func (svc *ecrClient) listNamespace(ctx context.Context, t *namespaceTemplate) ([]string, error) {
+	ref, err := name.NewRepository(t.source)
+	if err != nil {
+		return nil, fmt.Errorf("namespace %s: %w", t.source, err)
+	}
+	client := &http.Client{Transport: svc.registryTransport()}
+	repos, err := namespaceListerFor(ref.RegistryStr())(ctx, client, ref.RegistryStr(), ref.RepositoryStr(), svc.craneOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("listing namespace %s: %w", t.source, err)
+	}
+	var matched []string
+
+	for _, r := range repos {
+		if t.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// getJSON decodes the json response of the url
+func getJSON(ctx context.Context, client *http.Client, u string, header http.Header, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("GET %s: %w", u, errNotFound)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// listDockerHubNamespace lists the repositories of a docker hub user or organization
+func listDockerHubNamespace(ctx context.Context, client *http.Client, registry, namespace string, opts ...crane.Option) (repos []string, err error) {
+	next := fmt.Sprintf("%s/v2/repositories/%s/?page_size=100", dockerHubAPI, url.PathEscape(namespace))
+
+	for next != "" {
+		var page struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		}
+
+		if err := getJSON(ctx, client, next, nil, &page); err != nil {
+			return nil, err
+		}
+
+		for _, r := range page.Results {
+			repos = append(repos, r.Name)
+		}
+		next = page.Next
+	}
+	return repos, nil
+}
+
+// listQuayNamespace lists the public repositories of a quay organization
+func listQuayNamespace(ctx context.Context, client *http.Client, registry, namespace string, opts ...crane.Option) (repos []string, err error) {
+	base := fmt.Sprintf("%s/api/v1/repository?public=true&namespace=%s", quayAPI, url.QueryEscape(namespace))
+	next := base
+
+	for next != "" {
+		var page struct {
+			NextPage     string `json:"next_page"`
+			Repositories []struct {
+				Name string `json:"name"`
+			} `json:"repositories"`
+		}
+
+		if err := getJSON(ctx, client, next, nil, &page); err != nil {
+			return nil, err
+		}
+
+		for _, r := range page.Repositories {
+			repos = append(repos, r.Name)
+		}
+		next = ""
+
+		if page.NextPage != "" {
+			next = base + "&next_page=" + url.QueryEscape(page.NextPage)
+		}
+	}
+	return repos, nil
+}
+
+// listGitHubNamespace lists the container packages of a github organization or user, GITHUB_TOKEN needs the
+// read:packages scope
+func listGitHubNamespace(ctx context.Context, client *http.Client, registry, namespace string, opts ...crane.Option) (repos []string, err error) {
+	token := os.Getenv(githubTokenEnvVar)
+
+	if token == "" {
+		return nil, fmt.Errorf("%s is required to list ghcr.io packages", githubTokenEnvVar)
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}, "Accept": {"application/vnd.github+json"}}
+	repos, err = listGitHubPackages(ctx, client, "orgs/"+url.PathEscape(namespace), header)
+
+	// a namespace that is not an organization is a user
+	if errors.Is(err, errNotFound) {
+		return listGitHubPackages(ctx, client, "users/"+url.PathEscape(namespace), header)
+	}
+	return repos, err
+}
+
+// listGitHubPackages lists the container packages of the owner like orgs/cilium or users/octocat
+func listGitHubPackages(ctx context.Context, client *http.Client, owner string, header http.Header) (repos []string, err error) {
+	for page := 1; ; page++ {
+		var packages []struct {
+			Name string `json:"name"`
+		}
+		u := fmt.Sprintf("%s/%s/packages?package_type=container&per_page=100&page=%d", githubAPI, owner, page)
+
+		if err := getJSON(ctx, client, u, header, &packages); err != nil {
+			return nil, err
+		}
+
+		for _, p := range packages {
+			repos = append(repos, p.Name)
+		}
+
+		if len(packages) < 100 {
+			return repos, nil
+		}
+	}
+}
+
+// listCatalogNamespace lists the repositories of the namespace with the registry _catalog api
+func listCatalogNamespace(ctx context.Context, client *http.Client, registry, namespace string, opts ...crane.Option) (repos []string, err error) {
+	catalog, err := crane.Catalog(registry, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range catalog {
+		if strings.HasPrefix(r, namespace+"/") {
+			repos = append(repos, strings.TrimPrefix(r, namespace+"/"))
+		}
+	}
+	return repos, nil
+}
+
+// createRepository creates the ecr repository with the tags
+func (svc *ecrClient) createRepository(ctx context.Context, repo string, tags map[string]string) error {
+	input := &ecr.CreateRepositoryInput{RepositoryName: aws.String(repo)}
+
+	for _, k := range sortedKeys(tags) {
+		input.Tags = append(input.Tags, &ecr.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	_, err := svc.CreateRepositoryWithContext(ctx, input)
+	return err
+}
+
+// expandNamespace returns the selected repositories of the namespace that are not in existing, the missing ecr
+// repositories are created when create is set and left out otherwise
+func (svc *ecrClient) expandNamespace(ctx context.Context, template inputRepository, existing map[string]bool, create bool, selected sourceSet) (repositories []inputRepository, err error) {
+	t := template.namespace
+	all := selected.has(template.source)
+	logger := svc.log().With(logKeyPhase, phaseDiscover, logKeyRepository, template.ecrImageName, logKeySource, template.source)
+	names, err := svc.listNamespace(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range names {
+		repo := template.ecrImageName + "/" + n
+
+		if existing[repo] || !(all || selected.has(t.source+"/"+n)) {
+			continue
+		}
+
+		if !create {
+			logger.Info("skipping missing namespace repository", "namespace_repository", repo)
+			continue
+		}
+		tags := t.repositoryTags(n)
+
+		err := svc.createRepository(ctx, repo, tags)
+		var awsErr awserr.Error
+
+		switch {
+		case errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeRepositoryAlreadyExistsException:
+			// the repository exists but is not selected by the event
+			continue
+		case err != nil:
+			return repositories, fmt.Errorf("creating repository %s: %w", repo, err)
+		}
+		logger.Info("created namespace repository", "namespace_repository", repo)
+		r, err := parseinputRepositoryFromTags(repo, tags)
+		if err != nil {
+			return repositories, err
+		}
+		repositories = append(repositories, r)
+	}
+	return repositories, nil
+}
+
+// expandNamespaces replaces the namespace templates with the repositories of their namespaces with one of the sources,
+// all repositories without sources. create creates the missing ecr repositories. A namespace that can't be expanded is
+// logged and skipped
+func (svc *ecrClient) expandNamespaces(ctx context.Context, repositories []inputRepository, create bool, sources []string) (expanded []inputRepository) {
+	existing := make(map[string]bool, len(repositories))
+	selected := newSourceSet(sources)
+	var templates []inputRepository
+
+	for _, r := range repositories {
+		existing[r.ecrImageName] = true
+
+		if r.namespace != nil {
+			templates = append(templates, r)
+		} else {
+			expanded = append(expanded, r)
+		}
+	}
+
+	for _, t := range templates {
+		repos, err := svc.expandNamespace(ctx, t, existing, create, selected)
+		expanded = append(expanded, repos...)
+
+		if err != nil {
+			svc.log().Error("error expanding namespace", logKeyPhase, phaseDiscover, logKeyRepository, t.ecrImageName, logKeyError, err)
+			svc.metrics.addError(t.ecrImageName, err)
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,173 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+type mockNamespaceECRClient struct {
+	mockECRClient
+	created map[string]map[string]string
+}
+
+func (m *mockNamespaceECRClient) CreateRepositoryWithContext(ctx aws.Context, input *ecr.CreateRepositoryInput, opts ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+	if aws.StringValue(input.RepositoryName) == "mirror/cilium/hubble" {
+		return nil, awserr.New(ecr.ErrCodeRepositoryAlreadyExistsException, "exists", nil)
+	}
+	m.created[aws.StringValue(input.RepositoryName)] = parseTags(input.Tags)
+	return &ecr.CreateRepositoryOutput{}, nil
+}
+
+func Test_namespaceTemplate_match(t *testing.T) {
+	tests := []struct {
+		name     string
+		template namespaceTemplate
+		repo     string
+		want     bool
+	}{
+		{name: "all", repo: "cilium", want: true},
+		{name: "included", template: namespaceTemplate{include: []string{"cilium*"}}, repo: "cilium-operator", want: true},
+		{name: "not included", template: namespaceTemplate{include: []string{"cilium*"}}, repo: "hubble", want: false},
+		{name: "excluded", template: namespaceTemplate{include: []string{"cilium*"}, exclude: []string{"*-dev"}}, repo: "cilium-dev", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.template.match(tt.repo); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newNamespaceTemplate(t *testing.T) {
+	if got := newNamespaceTemplate(map[string]string{"ecr_sync_source": "quay.io/cilium/cilium"}); got != nil {
+		t.Errorf("newNamespaceTemplate() = %+v, want nil for a repository source", got)
+	}
+	template := newNamespaceTemplate(map[string]string{
+		"ecr_sync_constraint":    ">= 1.14",
+		"ecr_sync_exclude_repos": "*-dev",
+		"ecr_sync_source":        "quay.io/cilium/*",
+	})
+	want := map[string]string{"ecr_sync_constraint": ">= 1.14", "ecr_sync_opt": "in", "ecr_sync_source": "quay.io/cilium/operator"}
+
+	if got := template.repositoryTags("operator"); !reflect.DeepEqual(got, want) {
+		t.Errorf("repositoryTags() = %v, want %v", got, want)
+	}
+}
+
+func Test_namespaceListers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/repositories/bitnami/" && r.URL.Query().Get("page") == "":
+			fmt.Fprintf(w, `{"next": "http://%s/v2/repositories/bitnami/?page=2", "results": [{"name": "redis"}]}`, r.Host)
+		case r.URL.Path == "/v2/repositories/bitnami/":
+			fmt.Fprint(w, `{"next": null, "results": [{"name": "nginx"}]}`)
+		case r.URL.Path == "/api/v1/repository" && r.URL.Query().Get("next_page") == "":
+			fmt.Fprint(w, `{"next_page": "abc", "repositories": [{"name": "cilium"}]}`)
+		case r.URL.Path == "/api/v1/repository":
+			fmt.Fprint(w, `{"repositories": [{"name": "hubble"}]}`)
+		case r.URL.Path == "/orgs/org/packages" && r.Header.Get("Authorization") == "Bearer token":
+			fmt.Fprint(w, `[{"name": "app"}, {"name": "tools/cli"}]`)
+		case r.URL.Path == "/users/user/packages" && r.Header.Get("Authorization") == "Bearer token":
+			fmt.Fprint(w, `[{"name": "dotfiles"}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, api := range []*string{&dockerHubAPI, &githubAPI, &quayAPI} {
+		defer func(api *string, url string) { *api = url }(api, *api)
+		*api = server.URL
+	}
+	t.Setenv(githubTokenEnvVar, "token")
+
+	tests := []struct {
+		name      string
+		registry  string
+		namespace string
+		want      []string
+	}{
+		{name: "docker hub", registry: "index.docker.io", namespace: "bitnami", want: []string{"redis", "nginx"}},
+		{name: "quay", registry: "quay.io", namespace: "cilium", want: []string{"cilium", "hubble"}},
+		{name: "github organization", registry: "ghcr.io", namespace: "org", want: []string{"app", "tools/cli"}},
+		{name: "github user", registry: "ghcr.io", namespace: "user", want: []string{"dotfiles"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := namespaceListerFor(tt.registry)(context.Background(), server.Client(), tt.registry, tt.namespace)
+			if err != nil {
+				t.Fatalf("lister error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lister = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_expandNamespaces(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, _ := random.Image(256, 1)
+	for _, repo := range []string{"cilium/cilium", "cilium/cilium-dev", "cilium/hubble", "cilium/operator", "other/app"} {
+		if err := crane.Push(img, host+"/"+repo+":v1.0.0"); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+	template := inputRepository{
+		ecrImageName: "mirror/cilium",
+		source:       host + "/cilium/*",
+		namespace: newNamespaceTemplate(map[string]string{
+			"ecr_sync_exclude_repos": "*-dev",
+			"ecr_sync_max_results":   "3",
+			"ecr_sync_source":        host + "/cilium/*",
+		}),
+	}
+	existing := inputRepository{ecrImageName: "mirror/cilium/operator", source: host + "/cilium/operator"}
+	client := &mockNamespaceECRClient{created: make(map[string]map[string]string)}
+	svc := &ecrClient{ECRAPI: client}
+
+	got := svc.expandNamespaces(context.Background(), []inputRepository{template, existing}, true, nil)
+	var names []string
+
+	for _, r := range got {
+		names = append(names, r.ecrImageName+"="+r.source)
+	}
+	want := []string{"mirror/cilium/operator=" + host + "/cilium/operator", "mirror/cilium/cilium=" + host + "/cilium/cilium"}
+
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expandNamespaces() = %v, want %v", names, want)
+	}
+
+	if tags := client.created["mirror/cilium/cilium"]; tags["ecr_sync_max_results"] != "3" || tags["ecr_sync_opt"] != "in" || len(client.created) != 1 {
+		t.Errorf("expandNamespaces() created %v, want only mirror/cilium/cilium with the template tags", client.created)
+	}
+
+	if got := svc.expandNamespaces(context.Background(), []inputRepository{template}, false, nil); len(got) != 0 {
+		t.Errorf("expandNamespaces() without create = %+v, want no repositories", got)
+	}
+	client.created = make(map[string]map[string]string)
+	got = svc.expandNamespaces(context.Background(), []inputRepository{template}, true, []string{host + "/cilium/operator"})
+
+	if _, ok := client.created["mirror/cilium/operator"]; len(got) != 1 || len(client.created) != 1 || !ok {
+		t.Errorf("expandNamespaces() with sources = %+v, created %v, want only mirror/cilium/operator", got, client.created)
+	}
+}
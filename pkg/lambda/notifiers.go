@@ -0,0 +1,520 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/nikoksr/notify/service/mail"
+	"github.com/nikoksr/notify/service/msteams"
+)
+
+const (
+	defaultSubjectTemplate     = `{{if .Ok}}Lambda ECR-IMAGE-SYNC has run.{{else}}The following error has occurred during the lambda ecr-image-sync:{{end}}`
+	defaultMessageTemplate     = `{{if .Report}}{{.Report}}{{else if .Ok}}The following ecr images are being Synced to ECR:{{"\n"}}{{range .Images}}{{if ne .Status "skipped"}}{{.Source}}:{{.Tag}}{{"\n"}}{{end}}{{end}}{{"\n"}}{{if or .BytesUploaded .BytesSkipped}}{{.Transferred}}{{"\n"}}{{end}}{{.Finished.Format "2006-01-02 15:04:05"}}{{else}}{{.Error}}{{end}}`
+	snsSubjectMaxLength        = 100
+	webhookNotifierTimeout     = 10 * time.Second
+	notifiersEnvironmentVar    = "NOTIFIERS"
+	pagerDutyEventsURL         = "https://events.pagerduty.com/v2/enqueue"
+	pagerDutyKeyEnvironmentVar = "PAGERDUTY_ROUTING_KEY"
+	pagerDutySummaryMaxLength  = 1024
+	smtpPasswordEnvironmentVar = "SMTP_PASSWORD"
+)
+
+// NotifierConfig configures a single notification backend, fields have to be exported
+type NotifierConfig struct {
+	Type            string            `json:"type"`             // slack, teams, webhook, pagerduty, sns or email
+	ErrorsOnly      bool              `json:"errors_only"`      // only send errors, no run summaries, always set for pagerduty
+	SyncSummaries   bool              `json:"sync_summaries"`   // also send summaries of the sync and sync-one actions
+	SubjectTemplate string            `json:"subject_template"` // go text/template executed with the run result
+	MessageTemplate string            `json:"message_template"` // go text/template executed with the run result
+	ChannelID       string            `json:"channel_id"`       // slack
+	Token           string            `json:"token"`            // slack, defaults to SLACK_OAUTH_TOKEN
+	SlackFormat     string            `json:"slack_format"`     // slack, blocks (default) or text
+	Header          string            `json:"header"`           // slack blocks, text shown below the summary
+	AttachCSV       bool              `json:"attach_csv"`       // slack blocks, attach all images as csv file
+	URL             string            `json:"url"`              // teams and webhook, pagerduty defaults to the events api v2
+	Headers         map[string]string `json:"headers"`          // webhook
+	RoutingKey      string            `json:"routing_key"`      // pagerduty, defaults to PAGERDUTY_ROUTING_KEY
+	TopicARN        string            `json:"topic_arn"`        // sns
+	From            string            `json:"from"`             // email
+	To              []string          `json:"to"`               // email
+	SMTPAddress     string            `json:"smtp_address"`     // email host:port
+	SMTPUsername    string            `json:"smtp_username"`    // email
+	SMTPPassword    string            `json:"smtp_password"`    // email, defaults to SMTP_PASSWORD
+}
+
+type runResult struct {
+	Action        string        `json:"action"`
+	BytesSkipped  int64         `json:"bytes_skipped"`  // bytes of the blobs already on the ecr or mounted
+	BytesUploaded int64         `json:"bytes_uploaded"` // bytes of the blobs uploaded to the ecr
+	Error         string        `json:"error,omitempty"`
+	Finished      time.Time     `json:"finished"`
+	Images        []imageResult `json:"images"`
+	Message       string        `json:"message"`
+	Ok            bool          `json:"ok"`
+	Report        string        `json:"report,omitempty"` // markdown report of the report and audit actions
+	RunID         string        `json:"run_id"`
+	Started       time.Time     `json:"started"`
+	Total         int           `json:"total"`
+}
+
+type imageResult struct {
+	BytesSkipped  int64  `json:"bytes_skipped,omitempty"`
+	BytesUploaded int64  `json:"bytes_uploaded,omitempty"`
+	ECRURL        string `json:"ecr_url"`
+	Error         string `json:"error,omitempty"`
+	Reason        string `json:"reason,omitempty"` // why a tag is skipped, empty when it's already on ECR
+	Source        string `json:"source"`
+	Status        string `json:"status"` // synced, pending, deferred, skipped or failed
+	Tag           string `json:"tag"`
+}
+
+const (
+	statusDeferred = "deferred" // not copied before the lambda deadline, left for the next run
+	statusFailed   = "failed"
+	statusPending  = "pending" // added to the s3 output
+	statusSkipped  = "skipped" // already on ECR or too large
+	statusSynced   = "synced"
+)
+
+type notification struct {
+	subject string
+	message string
+	result  *runResult
+}
+
+// notifier sends a notification to a single backend
+type notifier interface {
+	send(ctx context.Context, n notification) error
+}
+
+type registeredNotifier struct {
+	errorsOnly      bool
+	messageTemplate *template.Template
+	name            string
+	notifier        notifier
+	subjectTemplate *template.Template
+	syncSummaries   bool
+}
+
+type notifiers []registeredNotifier
+
+type slackNotifier struct {
+	apiURL    string
+	attachCSV bool
+	channelID string
+	format    string
+	header    string
+	token     string
+}
+
+type teamsNotifier struct {
+	url string
+}
+
+type webhookNotifier struct {
+	client  *http.Client
+	headers map[string]string
+	url     string
+}
+
+type webhookPayload struct {
+	Subject string     `json:"subject"`
+	Message string     `json:"message"`
+	Result  *runResult `json:"result"`
+}
+
+type pagerDutyNotifier struct {
+	client     *http.Client
+	routingKey string
+	url        string
+}
+
+// pagerDutyEvent is a pagerduty events api v2 event
+type pagerDutyEvent struct {
+	DedupKey    string           `json:"dedup_key"`
+	EventAction string           `json:"event_action"`
+	Payload     pagerDutyPayload `json:"payload"`
+	RoutingKey  string           `json:"routing_key"`
+}
+
+type pagerDutyPayload struct {
+	CustomDetails webhookPayload `json:"custom_details"`
+	Severity      string         `json:"severity"`
+	Source        string         `json:"source"`
+	Summary       string         `json:"summary"`
+}
+
+type snsNotifier struct {
+	svc      snsiface.SNSAPI
+	topicARN string
+}
+
+type emailNotifier struct {
+	from         string
+	smtpAddress  string
+	smtpPassword string
+	smtpUsername string
+	to           []string
+}
+
+func (t *teamsNotifier) send(ctx context.Context, n notification) error {
+	service := msteams.New()
+	// workflow webhook urls do not match the validation patterns of the teams client
+	service.DisableWebhookValidation()
+	service.AddReceivers(t.url)
+	return service.Send(ctx, n.subject, n.message)
+}
+
+func (w *webhookNotifier) send(ctx context.Context, n notification) error {
+	return postJSON(ctx, w.client, w.url, w.headers, webhookPayload{Subject: n.subject, Message: n.message, Result: n.result})
+}
+
+// send triggers a pagerduty incident for a failed run deduplicated per run, successful runs are not sent
+func (p *pagerDutyNotifier) send(ctx context.Context, n notification) error {
+	if n.result != nil && n.result.Ok {
+		return nil
+	}
+	summary := strings.ReplaceAll(strings.TrimSpace(n.subject), "\n", " ")
+
+	if len(summary) > pagerDutySummaryMaxLength {
+		summary = summary[:pagerDutySummaryMaxLength]
+	}
+	event := pagerDutyEvent{
+		EventAction: "trigger",
+		Payload: pagerDutyPayload{
+			CustomDetails: webhookPayload{Subject: n.subject, Message: n.message, Result: n.result},
+			Severity:      "error",
+			Source:        "lambda-ecr-image-sync",
+			Summary:       summary,
+		},
+		RoutingKey: p.routingKey,
+	}
+
+	if n.result != nil {
+		event.DedupKey = "ecr-image-sync/" + n.result.RunID
+	}
+	return postJSON(ctx, p.client, p.url, nil, event)
+}
+
+// postJSON posts v as json to the url, status codes of 300 and above are errors
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, v interface{}) error {
+	payload, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %s", url, resp.Status)
+	}
+	return err
+}
+
+func (s *snsNotifier) send(ctx context.Context, n notification) error {
+	subject := strings.ReplaceAll(strings.TrimSpace(n.subject), "\n", " ")
+
+	if len(subject) > snsSubjectMaxLength {
+		subject = subject[:snsSubjectMaxLength]
+	}
+	_, err := s.svc.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicARN),
+		Subject:  aws.String(subject),
+		Message:  aws.String(n.message),
+	})
+	return err
+}
+
+func (e *emailNotifier) send(ctx context.Context, n notification) error {
+	service := mail.New(e.from, e.smtpAddress)
+
+	if e.smtpUsername != "" {
+		host, _, err := net.SplitHostPort(e.smtpAddress)
+		if err != nil {
+			return err
+		}
+		service.AuthenticateSMTP("", e.smtpUsername, e.smtpPassword, host)
+	}
+	service.AddReceivers(e.to...)
+	return service.Send(ctx, n.subject, n.message)
+}
+
+// newNotifier returns the notifier backend for the config
+func newNotifier(config NotifierConfig, env environmentVars) (notifier, error) {
+	switch strings.ToLower(config.Type) {
+	case "slack":
+		if config.ChannelID == "" {
+			return nil, fmt.Errorf("slack notifier requires a channel_id")
+		}
+		format := strings.ToLower(tryString(config.SlackFormat, slackFormatBlocks))
+		if format != slackFormatBlocks && format != slackFormatText {
+			return nil, fmt.Errorf("unknown slack_format: %s", config.SlackFormat)
+		}
+		return &slackNotifier{
+			attachCSV: config.AttachCSV,
+			channelID: config.ChannelID,
+			format:    format,
+			header:    config.Header,
+			token:     tryString(config.Token, env.slackOAuthToken),
+		}, nil
+	case "teams":
+		if config.URL == "" {
+			return nil, fmt.Errorf("teams notifier requires an url")
+		}
+		return &teamsNotifier{url: config.URL}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("webhook notifier requires an url")
+		}
+		return &webhookNotifier{
+			client:  &http.Client{Timeout: webhookNotifierTimeout},
+			headers: config.Headers,
+			url:     config.URL,
+		}, nil
+	case "pagerduty":
+		routingKey := tryString(config.RoutingKey, os.Getenv(pagerDutyKeyEnvironmentVar))
+
+		if routingKey == "" {
+			return nil, fmt.Errorf("pagerduty notifier requires a routing_key")
+		}
+		return &pagerDutyNotifier{
+			client:     &http.Client{Timeout: webhookNotifierTimeout},
+			routingKey: routingKey,
+			url:        tryString(config.URL, pagerDutyEventsURL),
+		}, nil
+	case "sns":
+		if config.TopicARN == "" {
+			return nil, fmt.Errorf("sns notifier requires a topic_arn")
+		}
+		s, err := session.NewSession(&aws.Config{
+			Region:     aws.String(env.awsRegion),
+			HTTPClient: &http.Client{Transport: httpTransport(http.DefaultTransport)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &snsNotifier{svc: sns.New(s), topicARN: config.TopicARN}, nil
+	case "email":
+		if config.From == "" || len(config.To) == 0 || config.SMTPAddress == "" {
+			return nil, fmt.Errorf("email notifier requires from, to and smtp_address")
+		}
+		return &emailNotifier{
+			from:         config.From,
+			smtpAddress:  config.SMTPAddress,
+			smtpPassword: tryString(config.SMTPPassword, os.Getenv(smtpPasswordEnvironmentVar)),
+			smtpUsername: config.SMTPUsername,
+			to:           config.To,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type: %s", config.Type)
+}
+
+// getNotifierConfigs returns the notifier configs from the event, the NOTIFIERS environment variable and the legacy slack fields
+func getNotifierConfigs(event LambdaEvent, env environmentVars) (configs []NotifierConfig, err error) {
+	configs = append(configs, event.Notifiers...)
+
+	if raw := os.Getenv(notifiersEnvironmentVar); raw != "" {
+		var envConfigs []NotifierConfig
+		if err := json.Unmarshal([]byte(raw), &envConfigs); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", notifiersEnvironmentVar, err)
+		}
+		configs = append(configs, envConfigs...)
+	}
+
+	if event.SlackChannelID != "" && env.slackOAuthToken != "" {
+		configs = append(configs, NotifierConfig{
+			Type:            "slack",
+			ChannelID:       event.SlackChannelID,
+			ErrorsOnly:      event.SlackErrorsOnly,
+			Header:          event.SlackMSGHeader,
+			SubjectTemplate: legacySlackSubjectTemplate(event),
+			MessageTemplate: legacySlackMessageTemplate(event),
+		})
+	}
+	return configs, err
+}
+
+// legacySlackSubjectTemplate returns a subject template using the slack_msg_* event fields
+func legacySlackSubjectTemplate(event LambdaEvent) string {
+	if event.SlackMSGSubject == "" && event.SlackMSGErrSubject == "" {
+		return ""
+	}
+	return fmt.Sprintf(`{{if .Ok}}%s{{else}}%s{{end}}`,
+		templateLiteral(tryString(event.SlackMSGSubject, "Lambda ECR-IMAGE-SYNC has run.")),
+		templateLiteral(tryString(event.SlackMSGErrSubject, "The following error has occurred during the lambda ecr-image-sync:")))
+}
+
+// legacySlackMessageTemplate returns a message template using the slack_msg_header event field
+func legacySlackMessageTemplate(event LambdaEvent) string {
+	if event.SlackMSGHeader == "" {
+		return ""
+	}
+	return strings.Replace(defaultMessageTemplate, "The following ecr images are being Synced to ECR:", templateLiteral(event.SlackMSGHeader), 1)
+}
+
+// templateLiteral returns s as a quoted string action so it is not parsed as a template
+func templateLiteral(s string) string {
+	quoted, _ := json.Marshal(s)
+	return "{{" + string(quoted) + "}}"
+}
+
+// newNotifiers creates the notifier registry from the notifier configs
+func newNotifiers(configs []NotifierConfig, env environmentVars) (n notifiers, err error) {
+	for i, config := range configs {
+		backend, err := newNotifier(config, env)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d: %w", i, err)
+		}
+		subject, err := template.New("subject").Parse(tryString(config.SubjectTemplate, defaultSubjectTemplate))
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d subject_template: %w", i, err)
+		}
+		message, err := template.New("message").Parse(tryString(config.MessageTemplate, defaultMessageTemplate))
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d message_template: %w", i, err)
+		}
+		n = append(n, registeredNotifier{
+			errorsOnly:      config.ErrorsOnly || strings.EqualFold(config.Type, "pagerduty"), // summaries would open incidents
+			messageTemplate: message,
+			name:            strings.ToLower(config.Type),
+			notifier:        backend,
+			subjectTemplate: subject,
+			syncSummaries:   config.SyncSummaries,
+		})
+	}
+	return n, err
+}
+
+// render executes the subject and message templates with the run result
+func (r *registeredNotifier) render(result *runResult) (n notification, err error) {
+	var subject, message bytes.Buffer
+
+	if err := r.subjectTemplate.Execute(&subject, result); err != nil {
+		return n, err
+	}
+
+	if err := r.messageTemplate.Execute(&message, result); err != nil {
+		return n, err
+	}
+	return notification{subject: subject.String(), message: message.String(), result: result}, err
+}
+
+// wants returns true when the notifier sends the result, summaries of sync runs only with sync_summaries
+func (r *registeredNotifier) wants(result *runResult) bool {
+	if !result.Ok {
+		return true
+	}
+
+	if r.errorsOnly {
+		return false
+	}
+	return r.syncSummaries || (result.Action != actionSync && result.Action != actionSyncOne)
+}
+
+// notify sends the run result to all registered notifiers, errors are logged and returned combined
+func (n notifiers) notify(ctx context.Context, result *runResult) (errs []error) {
+	if len(n) == 0 {
+		return nil
+	}
+	ctx, span := startSpan(ctx, phaseNotify)
+	defer span.End()
+
+	for _, r := range n {
+		if !r.wants(result) {
+			continue
+		}
+		msg, err := r.render(result)
+
+		if err == nil {
+			err = r.notifier.send(ctx, msg)
+		}
+
+		if err != nil {
+			slog.Error("error sending notification", logKeyPhase, phaseNotify, "notifier", r.name, logKeyError, err)
+			errs = append(errs, fmt.Errorf("%s notifier: %w", r.name, err))
+			span.RecordError(err)
+		}
+	}
+	return errs
+}
+
+// Count returns the number of images with the given status, used in templates
+func (r *runResult) Count(status string) int {
+	return countStatus(r.Images, status)
+}
+
+// Transferred returns the bytes uploaded and skipped of the run like "Uploaded 1.2 GB, skipped 300.0 MB", used in templates
+func (r *runResult) Transferred() string {
+	return fmt.Sprintf("Uploaded %s, skipped %s", formatBytes(r.BytesUploaded), formatBytes(r.BytesSkipped))
+}
+
+// transferTotals returns the bytes uploaded and skipped of all copies
+func transferTotals(options []syncOptions) (uploaded, skipped int64) {
+	for _, option := range options {
+		for _, t := range option.transfers {
+			uploaded += t.uploaded
+			skipped += t.skipped
+		}
+	}
+	return uploaded, skipped
+}
+
+// imageResultsFromSyncOptions returns the image results of the sync options, tags that are not failed get the status of done
+func imageResultsFromSyncOptions(options []syncOptions, env environmentVars, done string) (images []imageResult) {
+	for _, option := range options {
+		ecrURL := env.awsAccount + `.dkr.ecr.` + env.awsRegion + `.amazonaws.com/` + option.ecrImageName
+
+		for _, tag := range option.tags {
+			t := option.transfers[tag]
+			image := imageResult{BytesSkipped: t.skipped, BytesUploaded: t.uploaded, ECRURL: ecrURL, Source: option.source, Status: done, Tag: tag}
+
+			if err, ok := option.failed[tag]; ok {
+				image.Status = statusFailed
+				image.Error = err.Error()
+			}
+			images = append(images, image)
+		}
+
+		for _, tag := range option.pending {
+			images = append(images, imageResult{ECRURL: ecrURL, Source: option.source, Status: statusDeferred, Tag: tag})
+		}
+
+		for _, tag := range option.skipped {
+			images = append(images, imageResult{ECRURL: ecrURL, Source: option.source, Status: statusSkipped, Tag: tag})
+		}
+
+		for _, tag := range sortedKeys(option.tooLarge) {
+			images = append(images, imageResult{ECRURL: ecrURL, Reason: option.tooLarge[tag], Source: option.source, Status: statusSkipped, Tag: tag})
+		}
+	}
+	return images
+}
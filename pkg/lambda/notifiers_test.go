@@ -0,0 +1,337 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+type mockSNSClient struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (m *mockSNSClient) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	m.published = append(m.published, input)
+	return &sns.PublishOutput{}, nil
+}
+
+type mockNotifier struct {
+	sent []notification
+}
+
+func (m *mockNotifier) send(ctx context.Context, n notification) error {
+	m.sent = append(m.sent, n)
+	return nil
+}
+
+var testRunResult = &runResult{
+	Action:   "sync",
+	Finished: time.Date(2024, 10, 2, 17, 50, 41, 0, time.UTC),
+	Images: []imageResult{
+		{Source: "gcr.io/datadoghq/agent", ECRURL: "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadoghq/agent", Tag: "v7.32.0"},
+		{Source: "gcr.io/datadoghq/agent", ECRURL: "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadoghq/agent", Tag: "v7.31.0"},
+	},
+	Ok:    true,
+	RunID: "run1",
+	Total: 2,
+}
+
+func Test_getNotifierConfigs(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     LambdaEvent
+		env       environmentVars
+		envConfig string
+		wantTypes []string
+		wantErr   bool
+	}{
+		{
+			name:      "TestLegacySlack",
+			event:     LambdaEvent{SlackChannelID: "C0123455", SlackErrorsOnly: true},
+			env:       environmentVars{slackOAuthToken: "token"},
+			wantTypes: []string{"slack"},
+		},
+		{
+			name:  "TestLegacySlackWithoutToken",
+			event: LambdaEvent{SlackChannelID: "C0123455"},
+		},
+		{
+			name:      "TestEventAndEnvironment",
+			event:     LambdaEvent{Notifiers: []NotifierConfig{{Type: "teams", URL: "https://example.com"}}},
+			envConfig: `[{"type":"sns","topic_arn":"arn:aws:sns:eu-west-1:123456789012:ecr-sync"}]`,
+			wantTypes: []string{"teams", "sns"},
+		},
+		{
+			name:      "TestInvalidEnvironment",
+			envConfig: `{"type":"sns"}`,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(notifiersEnvironmentVar, tt.envConfig)
+			got, err := getNotifierConfigs(tt.event, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getNotifierConfigs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var gotTypes []string
+			for _, c := range got {
+				gotTypes = append(gotTypes, c.Type)
+			}
+			if strings.Join(gotTypes, ",") != strings.Join(tt.wantTypes, ",") {
+				t.Errorf("getNotifierConfigs() = %v, want %v", gotTypes, tt.wantTypes)
+			}
+		})
+	}
+}
+
+func Test_newNotifiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []NotifierConfig
+		wantErr bool
+	}{
+		{
+			name: "TestValidConfigs",
+			configs: []NotifierConfig{
+				{Type: "slack", ChannelID: "C0123455"},
+				{Type: "Webhook", URL: "https://example.com/hook"},
+				{Type: "email", From: "ecr@example.com", To: []string{"team@example.com"}, SMTPAddress: "smtp.example.com:587"},
+				{Type: "pagerduty", RoutingKey: "R0123455"},
+			},
+		},
+		{
+			name:    "TestMissingRoutingKey",
+			configs: []NotifierConfig{{Type: "pagerduty"}},
+			wantErr: true,
+		},
+		{
+			name:    "TestUnknownType",
+			configs: []NotifierConfig{{Type: "pigeon"}},
+			wantErr: true,
+		},
+		{
+			name:    "TestMissingChannel",
+			configs: []NotifierConfig{{Type: "slack"}},
+			wantErr: true,
+		},
+		{
+			name:    "TestInvalidTemplate",
+			configs: []NotifierConfig{{Type: "teams", URL: "https://example.com", MessageTemplate: "{{.Images"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newNotifiers(tt.configs, environmentVars{awsRegion: "eu-west-1"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newNotifiers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && len(got) != len(tt.configs) {
+				t.Errorf("newNotifiers() = %v notifiers, want %v", len(got), len(tt.configs))
+			}
+		})
+	}
+}
+
+func Test_registeredNotifier_render(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      NotifierConfig
+		result      *runResult
+		wantSubject string
+		wantMessage string
+	}{
+		{
+			name:        "TestDefaultTemplates",
+			config:      NotifierConfig{Type: "teams", URL: "https://example.com"},
+			result:      testRunResult,
+			wantSubject: "Lambda ECR-IMAGE-SYNC has run.",
+			wantMessage: "The following ecr images are being Synced to ECR:\ngcr.io/datadoghq/agent:v7.32.0\ngcr.io/datadoghq/agent:v7.31.0\n\n2024-10-02 17:50:41",
+		},
+		{
+			name:        "TestDefaultErrorTemplates",
+			config:      NotifierConfig{Type: "teams", URL: "https://example.com"},
+			result:      &runResult{Error: "access denied"},
+			wantSubject: "The following error has occurred during the lambda ecr-image-sync:",
+			wantMessage: "access denied",
+		},
+		{
+			name: "TestLegacySlackTemplates",
+			config: NotifierConfig{
+				Type:            "slack",
+				ChannelID:       "C0123455",
+				SubjectTemplate: legacySlackSubjectTemplate(LambdaEvent{SlackMSGSubject: "Synced {{images}}"}),
+				MessageTemplate: legacySlackMessageTemplate(LambdaEvent{SlackMSGHeader: "ECR-IMAGE-SYNC has completed"}),
+			},
+			result:      testRunResult,
+			wantSubject: "Synced {{images}}",
+			wantMessage: "ECR-IMAGE-SYNC has completed\ngcr.io/datadoghq/agent:v7.32.0\ngcr.io/datadoghq/agent:v7.31.0\n\n2024-10-02 17:50:41",
+		},
+		{
+			name:        "TestCustomTemplates",
+			config:      NotifierConfig{Type: "teams", URL: "https://example.com", SubjectTemplate: "run {{.RunID}}", MessageTemplate: "{{.Total}} images"},
+			result:      testRunResult,
+			wantSubject: "run run1",
+			wantMessage: "2 images",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := newNotifiers([]NotifierConfig{tt.config}, environmentVars{})
+			if err != nil {
+				t.Fatalf("newNotifiers() error = %v", err)
+			}
+			got, err := n[0].render(tt.result)
+			if err != nil {
+				t.Errorf("render() error = %v", err)
+				return
+			}
+			if got.subject != tt.wantSubject {
+				t.Errorf("render() subject = %q, want %q", got.subject, tt.wantSubject)
+			}
+			if got.message != tt.wantMessage {
+				t.Errorf("render() message = %q, want %q", got.message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func Test_notifiers_notify(t *testing.T) {
+	all := &mockNotifier{}
+	errorsOnly := &mockNotifier{}
+	summaries := &mockNotifier{}
+	n, err := newNotifiers([]NotifierConfig{
+		{Type: "teams", URL: "https://example.com", SyncSummaries: true},
+		{Type: "teams", URL: "https://example.com", ErrorsOnly: true},
+		{Type: "teams", URL: "https://example.com"},
+	}, environmentVars{})
+	if err != nil {
+		t.Fatalf("newNotifiers() error = %v", err)
+	}
+	n[0].notifier = all
+	n[1].notifier = errorsOnly
+	n[2].notifier = summaries
+
+	n.notify(context.Background(), testRunResult)
+	n.notify(context.Background(), &runResult{Action: actionS3, Ok: true})
+	n.notify(context.Background(), &runResult{Error: "failed"})
+
+	if len(all.sent) != 3 {
+		t.Errorf("notify() sent %v notifications, want 3", len(all.sent))
+	}
+	if len(errorsOnly.sent) != 1 || errorsOnly.sent[0].message != "failed" {
+		t.Errorf("notify() errors only notifier sent %v", errorsOnly.sent)
+	}
+	if len(summaries.sent) != 2 || summaries.sent[0].result.Action != actionS3 {
+		t.Errorf("notify() notifier without sync_summaries sent %v, want the s3 summary and the error", summaries.sent)
+	}
+}
+
+func Test_webhookNotifier_send(t *testing.T) {
+	var got webhookPayload
+	var gotHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		gotHeader = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	w := &webhookNotifier{client: server.Client(), headers: map[string]string{"Authorization": "Token abc"}, url: server.URL}
+	if err := w.send(context.Background(), notification{subject: "subject", message: "message", result: testRunResult}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if got.Subject != "subject" || got.Result == nil || got.Result.Total != 2 || len(got.Result.Images) != 2 {
+		t.Errorf("send() payload = %+v", got)
+	}
+	if gotHeader != "Token abc" {
+		t.Errorf("send() header = %v, want Token abc", gotHeader)
+	}
+}
+
+func Test_pagerDutyNotifier_send(t *testing.T) {
+	var got pagerDutyEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	p := &pagerDutyNotifier{client: server.Client(), routingKey: "R0123455", url: server.URL}
+	if err := p.send(context.Background(), notification{subject: "error\nsubject", message: "access denied", result: &runResult{Error: "access denied", RunID: "run1"}}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	want := pagerDutyEvent{DedupKey: "ecr-image-sync/run1", EventAction: "trigger", RoutingKey: "R0123455"}
+
+	if got.DedupKey != want.DedupKey || got.EventAction != want.EventAction || got.RoutingKey != want.RoutingKey {
+		t.Errorf("send() event = %+v, want %+v", got, want)
+	}
+	if got.Payload.Severity != "error" || got.Payload.Summary != "error subject" || got.Payload.CustomDetails.Message != "access denied" {
+		t.Errorf("send() payload = %+v", got.Payload)
+	}
+	got = pagerDutyEvent{}
+
+	if err := p.send(context.Background(), notification{subject: "summary", result: &runResult{Ok: true, RunID: "run2"}}); err != nil || got.DedupKey != "" {
+		t.Errorf("send() of a successful run = %+v, %v, want nothing sent", got, err)
+	}
+}
+
+func Test_snsNotifier_send(t *testing.T) {
+	svc := &mockSNSClient{}
+	s := &snsNotifier{svc: svc, topicARN: "arn:aws:sns:eu-west-1:123456789012:ecr-sync"}
+
+	if err := s.send(context.Background(), notification{subject: strings.Repeat("a", 120) + "\n", message: "message"}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if len(svc.published) != 1 || len(*svc.published[0].Subject) != snsSubjectMaxLength || *svc.published[0].Message != "message" {
+		t.Errorf("send() published = %v", svc.published)
+	}
+}
+
+func Test_imageResultsFromSyncOptions(t *testing.T) {
+	options := []syncOptions{
+		{
+			source:       "docker.io/nginx",
+			ecrImageName: "dev/nginx",
+			tags:         []string{"1.23.3", "1.23.2"},
+			failed:       map[string]error{"1.23.2": errors.New("denied")},
+			pending:      []string{"1.22.9"},
+			skipped:      []string{"1.23.1"},
+			tooLarge:     map[string]string{"1.23.0": "image size 2.0 GB exceeds ecr_sync_max_size 1.0 GB"},
+			transfers:    map[string]transfer{"1.23.3": {uploaded: 100, skipped: 50}},
+		},
+	}
+	want := []imageResult{
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/dev/nginx", Tag: "1.23.3", Status: statusSynced, BytesUploaded: 100, BytesSkipped: 50},
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/dev/nginx", Tag: "1.23.2", Status: statusFailed, Error: "denied"},
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/dev/nginx", Tag: "1.22.9", Status: statusDeferred},
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/dev/nginx", Tag: "1.23.1", Status: statusSkipped},
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/dev/nginx", Tag: "1.23.0", Status: statusSkipped, Reason: "image size 2.0 GB exceeds ecr_sync_max_size 1.0 GB"},
+	}
+	got := imageResultsFromSyncOptions(options, environmentVars{awsAccount: "123", awsRegion: "eu-west-1"}, statusSynced)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("imageResultsFromSyncOptions() = %v, want %v", got, want)
+	}
+
+	if uploaded, skipped := transferTotals(options); uploaded != 100 || skipped != 50 {
+		t.Errorf("transferTotals() = %v, %v, want 100, 50", uploaded, skipped)
+	}
+}
@@ -0,0 +1,200 @@
+package lambda
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultS3KeyTemplate = "{name}.{ext}"
+
+type outputFormat struct {
+	name        string
+	ext         string
+	contentType string
+	zip         bool
+	write       func(w io.Writer, content []csvFormat) error
+}
+
+type outputJSON struct {
+	Source string `json:"source"`
+	ECRURL string `json:"ecr_url"`
+	Tag    string `json:"tag"`
+}
+
+type keyTemplateData struct {
+	name   string
+	format string
+	ext    string
+	runID  string
+	time   time.Time
+}
+
+// outputFormats contains the supported formats for the s3 action
+var outputFormats = map[string]outputFormat{
+	"csv":    {name: "csv", ext: "zip", contentType: "application/zip", zip: true, write: writeCSV},
+	"json":   {name: "json", ext: "json", contentType: "application/json", write: writeJSON},
+	"ndjson": {name: "ndjson", ext: "ndjson", contentType: "application/x-ndjson", write: writeNDJSON},
+	"skopeo": {name: "skopeo", ext: "yaml", contentType: "application/yaml", write: writeSkopeoYAML},
+	"crane":  {name: "crane", ext: "sh", contentType: "text/x-shellscript", write: writeCraneScript},
+}
+
+// getOutputFormats returns the output formats for the given names, defaults to csv
+func getOutputFormats(names []string) (formats []outputFormat, err error) {
+	if len(names) == 0 {
+		names = []string{"csv"}
+	}
+	seen := make(map[string]bool)
+
+	for _, n := range names {
+		n = strings.ToLower(strings.TrimSpace(n))
+		format, ok := outputFormats[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown output format: %s", n)
+		}
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		formats = append(formats, format)
+	}
+	return formats, err
+}
+
+// renderKeyTemplate replaces the placeholders in a S3 object key template
+func renderKeyTemplate(template string, data keyTemplateData) string {
+	template = tryString(template, defaultS3KeyTemplate)
+	t := data.time.UTC()
+
+	replacer := strings.NewReplacer(
+		"{name}", data.name,
+		"{format}", data.format,
+		"{ext}", data.ext,
+		"{run_id}", data.runID,
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("150405"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+	)
+	return strings.TrimPrefix(replacer.Replace(template), "/")
+}
+
+// checkKeyTemplate returns an error when the key template writes several objects of a run to the same key, the
+// template needs the {name}, {format} or {ext} placeholders that tell them apart
+func checkKeyTemplate(template string, objects []keyTemplateData) error {
+	seen := make(map[string]string, len(objects))
+
+	for _, o := range objects {
+		key := renderKeyTemplate(template, o)
+
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("s3 key template %q writes %s and %s to the same key %s, add {name}, {format} or {ext}", tryString(template, defaultS3KeyTemplate), other, o.format, key)
+		}
+		seen[key] = o.format
+	}
+	return nil
+}
+
+// splitSource splits a source image name in a registry and repository part
+func splitSource(source string) (registry, repository string) {
+	parts := strings.SplitN(source, "/", 2)
+
+	if len(parts) == 1 || !(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return "docker.io", source
+	}
+	return parts[0], parts[1]
+}
+
+// shellQuote quotes a string for use in a posix shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeCSV(w io.Writer, content []csvFormat) error {
+	writer := csv.NewWriter(w)
+
+	for _, value := range content {
+		if err := writer.Write([]string{value.source, value.imageECRURL, value.imageTag}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeJSON(w io.Writer, content []csvFormat) error {
+	images := make([]outputJSON, 0, len(content))
+
+	for _, value := range content {
+		images = append(images, outputJSON{Source: value.source, ECRURL: value.imageECRURL, Tag: value.imageTag})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(images)
+}
+
+func writeNDJSON(w io.Writer, content []csvFormat) error {
+	encoder := json.NewEncoder(w)
+
+	for _, value := range content {
+		if err := encoder.Encode(outputJSON{Source: value.source, ECRURL: value.imageECRURL, Tag: value.imageTag}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSkopeoYAML writes a source yaml file for skopeo sync --src yaml
+func writeSkopeoYAML(w io.Writer, content []csvFormat) error {
+	registries := make(map[string]map[string][]string)
+
+	for _, value := range content {
+		registry, repository := splitSource(value.source)
+		if registries[registry] == nil {
+			registries[registry] = make(map[string][]string)
+		}
+		registries[registry][repository] = append(registries[registry][repository], value.imageTag)
+	}
+	var b strings.Builder
+
+	for _, registry := range sortedKeys(registries) {
+		b.WriteString(registry + ":\n  images:\n")
+
+		for _, repository := range sortedKeys(registries[registry]) {
+			b.WriteString("    " + strconv.Quote(repository) + ":\n")
+
+			for _, tag := range registries[registry][repository] {
+				b.WriteString("      - " + strconv.Quote(tag) + "\n")
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeCraneScript writes a shell script with crane copy commands
+func writeCraneScript(w io.Writer, content []csvFormat) error {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\nset -e\n")
+
+	for _, value := range content {
+		b.WriteString("crane copy " + shellQuote(value.source+":"+value.imageTag) + " " + shellQuote(value.imageECRURL+":"+value.imageTag) + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sortedKeys returns the sorted keys of a map
+func sortedKeys[V any](m map[string]V) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
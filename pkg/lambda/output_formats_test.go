@@ -0,0 +1,197 @@
+package lambda
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var testOutputContent = []csvFormat{
+	{"docker.io/datadog/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadog/agent", "7.32.0"},
+	{"docker.io/datadog/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadog/agent", "7.31.0"},
+	{"quay.io/cilium/cilium", "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/cilium/cilium", "v1.12.4"},
+}
+
+func Test_outputFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content []csvFormat
+		want    string
+	}{
+		{
+			name:    "TestCSV",
+			format:  "csv",
+			content: testOutputContent[:1],
+			want:    "docker.io/datadog/agent,123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadog/agent,7.32.0\n",
+		},
+		{
+			name:    "TestNDJSON",
+			format:  "ndjson",
+			content: testOutputContent[:1],
+			want:    `{"source":"docker.io/datadog/agent","ecr_url":"123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadog/agent","tag":"7.32.0"}` + "\n",
+		},
+		{
+			name:    "TestJSONEmpty",
+			format:  "json",
+			content: nil,
+			want:    "[]\n",
+		},
+		{
+			name:    "TestSkopeoYAML",
+			format:  "skopeo",
+			content: testOutputContent,
+			want: "docker.io:\n  images:\n    \"datadog/agent\":\n      - \"7.32.0\"\n      - \"7.31.0\"\n" +
+				"quay.io:\n  images:\n    \"cilium/cilium\":\n      - \"v1.12.4\"\n",
+		},
+		{
+			name:    "TestCraneScript",
+			format:  "crane",
+			content: testOutputContent[2:],
+			want:    "#!/bin/sh\nset -e\ncrane copy 'quay.io/cilium/cilium:v1.12.4' '123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/cilium/cilium:v1.12.4'\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := outputFormats[tt.format].write(&b, tt.content); err != nil {
+				t.Errorf("outputFormats[%s].write() error = %v", tt.format, err)
+				return
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("outputFormats[%s].write() = %q, want %q", tt.format, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getOutputFormats(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     []string
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			name:      "TestDefaultCSV",
+			wantNames: []string{"csv"},
+		},
+		{
+			name:      "TestMultipleDeduplicated",
+			names:     []string{"JSON", "crane", "json"},
+			wantNames: []string{"json", "crane"},
+		},
+		{
+			name:    "TestUnknownFormat",
+			names:   []string{"xml"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getOutputFormats(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getOutputFormats() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var gotNames []string
+			for _, f := range got {
+				gotNames = append(gotNames, f.name)
+			}
+			if len(gotNames) != len(tt.wantNames) {
+				t.Errorf("getOutputFormats() = %v, want %v", gotNames, tt.wantNames)
+				return
+			}
+			for i := range gotNames {
+				if gotNames[i] != tt.wantNames[i] {
+					t.Errorf("getOutputFormats() = %v, want %v", gotNames, tt.wantNames)
+				}
+			}
+		})
+	}
+}
+
+func Test_renderKeyTemplate(t *testing.T) {
+	runTime := time.Date(2024, 10, 2, 17, 50, 41, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		template string
+		data     keyTemplateData
+		want     string
+	}{
+		{
+			name: "TestDefaultTemplate",
+			data: keyTemplateData{name: "images", format: "csv", ext: "zip", time: runTime},
+			want: "images.zip",
+		},
+		{
+			name:     "TestDateAndRunID",
+			template: "/ecr-sync/{year}/{month}/{day}/{run_id}/{name}-{time}.{ext}",
+			data:     keyTemplateData{name: "images", format: "json", ext: "json", runID: "abc123", time: runTime},
+			want:     "ecr-sync/2024/10/02/abc123/images-175041.json",
+		},
+		{
+			name:     "TestFormatPlaceholder",
+			template: "{date}/{format}.{ext}",
+			data:     keyTemplateData{name: "images", format: "skopeo", ext: "yaml", time: runTime},
+			want:     "2024-10-02/skopeo.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderKeyTemplate(tt.template, tt.data); got != tt.want {
+				t.Errorf("renderKeyTemplate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkKeyTemplate(t *testing.T) {
+	objects := []keyTemplateData{
+		{name: "images", format: "csv", ext: "zip"},
+		{name: "images", format: "json", ext: "json"},
+		{name: "manifest", format: "manifest", ext: "json"},
+	}
+	tests := []struct {
+		name     string
+		template string
+		objects  []keyTemplateData
+		wantErr  bool
+	}{
+		{name: "TestDefaultTemplate", objects: objects},
+		{name: "TestFormatPlaceholder", template: "{date}/{format}", objects: objects},
+		{name: "TestSameKey", template: "{date}/output", objects: objects, wantErr: true},
+		{name: "TestExtOnly", template: "{date}.{ext}", objects: objects, wantErr: true},
+		{name: "TestSingleObject", template: "{date}/output", objects: objects[:1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkKeyTemplate(tt.template, tt.objects); (err != nil) != tt.wantErr {
+				t.Errorf("checkKeyTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_splitSource(t *testing.T) {
+	tests := []struct {
+		source         string
+		wantRegistry   string
+		wantRepository string
+	}{
+		{"docker.io/datadog/agent", "docker.io", "datadog/agent"},
+		{"nginx", "docker.io", "nginx"},
+		{"bitnami/redis", "docker.io", "bitnami/redis"},
+		{"localhost:5000/test/image", "localhost:5000", "test/image"},
+		{"ghcr.io/martijnvdp/ecr-image-sync", "ghcr.io", "martijnvdp/ecr-image-sync"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			gotRegistry, gotRepository := splitSource(tt.source)
+			if gotRegistry != tt.wantRegistry || gotRepository != tt.wantRepository {
+				t.Errorf("splitSource() = %v, %v, want %v, %v", gotRegistry, gotRepository, tt.wantRegistry, tt.wantRepository)
+			}
+		})
+	}
+}
@@ -3,16 +3,20 @@ package lambda
 import (
 	"archive/zip"
 	"bytes"
-	"encoding/csv"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
 type csvFormat struct {
@@ -21,66 +25,163 @@ type csvFormat struct {
 	imageTag    string
 }
 
-func addFileToS3Bucket(keyfile, region, bucket string) error {
-	s, _ := session.NewSession(&aws.Config{Region: aws.String(region)})
-	file, err := os.Open(keyfile)
+type s3OutputOptions struct {
+	bucket      string
+	endpoint    string
+	formats     []string
+	keyTemplate string
+	kmsKeyID    string
+	manifest    bool
+	metadata    map[string]string
+	region      string
+	runID       string
+	sse         string
+	tags        map[string]string
+	time        time.Time
+}
 
-	if err != nil {
-		return err
+type s3Manifest struct {
+	Bucket    string           `json:"bucket"`
+	CreatedAt time.Time        `json:"created_at"`
+	Outputs   []s3ManifestItem `json:"outputs"`
+	RunID     string           `json:"run_id"`
+	Total     int              `json:"total"`
+}
+
+type s3ManifestItem struct {
+	ContentType string `json:"content_type"`
+	Format      string `json:"format"`
+	Key         string `json:"key"`
+}
+
+// newS3Session returns a session for S3, endpoint can be set for S3 compatible storage
+func newS3Session(region, endpoint string) (*session.Session, error) {
+	config := &aws.Config{
+		Region:     aws.String(region),
+		HTTPClient: &http.Client{Transport: httpTransport(http.DefaultTransport)},
 	}
-	defer file.Close()
 
-	fileInfo, _ := file.Stat()
-	var size int64 = fileInfo.Size()
-	buffer := make([]byte, size)
-	file.Read(buffer)
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	s, err := session.NewSession(config)
 
-	_, err = s3.New(s).PutObject(&s3.PutObjectInput{
-		Bucket:               aws.String(bucket),
-		Key:                  aws.String("images.zip"),
-		ACL:                  aws.String("private"),
-		Body:                 bytes.NewReader(buffer),
-		ContentLength:        aws.Int64(size),
-		ContentType:          aws.String(http.DetectContentType(buffer)),
-		ContentDisposition:   aws.String("attachment"),
-		ServerSideEncryption: aws.String("AES256"),
-	})
+	if err != nil {
+		return nil, fmt.Errorf("creating s3 session: %w", err)
+	}
+	return s, err
+}
 
-	return err
+// newS3Uploader returns a S3 upload manager
+func newS3Uploader(region, endpoint string) (*s3manager.Uploader, error) {
+	s, err := newS3Session(region, endpoint)
+
+	if err != nil {
+		return nil, err
+	}
+	return s3manager.NewUploader(s), nil
 }
 
-func createZipFile(file string, target string) error {
-	createZipFile, _ := os.Create(target)
-	z := zip.NewWriter(createZipFile)
-	src, err := os.Open(file)
+// newS3Client returns a S3 client
+func newS3Client(region, endpoint string) (*s3.S3, error) {
+	s, err := newS3Session(region, endpoint)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
-	info, err := src.Stat()
+	return s3.New(s), nil
+}
+
+// getServerSideEncryption returns the S3 server side encryption algorithm for the sse option
+func getServerSideEncryption(sse string) (string, error) {
+	switch strings.ToLower(sse) {
+	case "", "aes256", "sse-s3":
+		return s3.ServerSideEncryptionAes256, nil
+	case "aws:kms", "sse-kms":
+		return s3.ServerSideEncryptionAwsKms, nil
+	}
+	return "", fmt.Errorf("unknown server side encryption: %s", sse)
+}
+
+// uploadInput returns the upload input with encryption, tags and metadata set from the options
+func (opts *s3OutputOptions) uploadInput(key, contentType string, body io.Reader) (*s3manager.UploadInput, error) {
+	sse, err := getServerSideEncryption(opts.sse)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+	input := &s3manager.UploadInput{
+		Bucket:               aws.String(opts.bucket),
+		Key:                  aws.String(key),
+		ACL:                  aws.String("private"),
+		Body:                 body,
+		ContentType:          aws.String(contentType),
+		ContentDisposition:   aws.String("attachment"),
+		ServerSideEncryption: aws.String(sse),
+	}
+
+	if sse == s3.ServerSideEncryptionAwsKms && opts.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(opts.kmsKeyID)
+	}
+
+	if len(opts.tags) > 0 {
+		tags := url.Values{}
+		for k, v := range opts.tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if len(opts.metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.metadata)
+	}
+	return input, err
+}
+
+// streamOutput writes the csv content in the given format to w, wrapped in a zip archive if needed
+func streamOutput(w io.Writer, csvContent []csvFormat, format outputFormat, modified time.Time) error {
+	if !format.zip {
+		return format.write(w, csvContent)
 	}
-	hdr, err := zip.FileInfoHeader(info)
+	z := zip.NewWriter(w)
+	dst, err := z.CreateHeader(&zip.FileHeader{
+		Name:     "images." + format.name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
 
 	if err != nil {
 		return err
 	}
-	hdr.Name = filepath.Base(file)
-	dst, err := z.CreateHeader(hdr)
 
-	if err != nil {
+	if err := format.write(dst, csvContent); err != nil {
 		return err
 	}
-	_, err = io.Copy(dst, src)
+	return z.Close()
+}
+
+// uploadStream uploads the output of write to the bucket without buffering it to disk
+func uploadStream(ctx context.Context, uploader s3manageriface.UploaderAPI, key, contentType string, opts *s3OutputOptions, write func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	input, err := opts.uploadInput(key, contentType, pr)
 
 	if err != nil {
 		return err
 	}
 
-	src.Close()
-	return z.Close()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	_, err = uploader.UploadWithContext(ctx, input)
+
+	// unblock the writer when the upload stopped before reading everything
+	pr.CloseWithError(err)
+
+	if err != nil {
+		return fmt.Errorf("uploading %s to bucket %s: %w", key, opts.bucket, err)
+	}
+	return err
 }
 
 func buildCSVFile(options []syncOptions, env environmentVars) (csvContent []csvFormat, total int, err error) {
@@ -97,46 +198,72 @@ func buildCSVFile(options []syncOptions, env environmentVars) (csvContent []csvF
 	return csvContent, total, err
 }
 
-func writeCSVFile(csvContent *[]csvFormat, csvFileName string) (err error) {
-	if csvContent != nil {
-		file, err := os.Create(csvFileName)
-		if err != nil {
-			fmt.Println("Error creating file")
-		}
-		defer file.Close()
-		writer := csv.NewWriter(file)
+// uploadManifest uploads a manifest file listing all outputs of the run
+func uploadManifest(ctx context.Context, uploader s3manageriface.UploaderAPI, manifest s3Manifest, opts *s3OutputOptions) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
 
-		for _, value := range *csvContent {
-			data := []string{value.source, value.imageECRURL, value.imageTag}
+	if err != nil {
+		return err
+	}
+	key := renderKeyTemplate(opts.keyTemplate, keyTemplateData{
+		name:   "manifest",
+		format: "manifest",
+		ext:    "json",
+		runID:  opts.runID,
+		time:   opts.time,
+	})
+	return uploadStream(ctx, uploader, key, "application/json", opts, func(w io.Writer) error {
+		_, err := io.Copy(w, bytes.NewReader(content))
+		return err
+	})
+}
 
-			if err := writer.Write(data); err != nil {
-				fmt.Println("Error write file")
-			}
-		}
-		writer.Flush()
+func outputToS3Bucket(ctx context.Context, uploader s3manageriface.UploaderAPI, csvContent []csvFormat, opts s3OutputOptions) (err error) {
+	formats, err := getOutputFormats(opts.formats)
 
-		if err != nil {
-			fmt.Println(err)
-		}
+	if err != nil {
+		return err
 	}
+	objects := make([]keyTemplateData, 0, len(formats)+1)
 
-	return err
-}
+	for _, format := range formats {
+		objects = append(objects, keyTemplateData{name: "images", format: format.name, ext: format.ext, runID: opts.runID, time: opts.time})
+	}
 
-func outputToS3Bucket(csvContent []csvFormat, csvFileName, zipFileName, region, bucket string) (err error) {
+	if opts.manifest {
+		objects = append(objects, keyTemplateData{name: "manifest", format: "manifest", ext: "json", runID: opts.runID, time: opts.time})
+	}
 
-	if err := writeCSVFile(&csvContent, csvFileName); err != nil {
+	if err := checkKeyTemplate(opts.keyTemplate, objects); err != nil {
 		return err
 	}
-	err = createZipFile(csvFileName, zipFileName)
-	if err != nil {
-		fmt.Println(err)
+	manifest := s3Manifest{
+		Bucket:    opts.bucket,
+		CreatedAt: opts.time.UTC(),
+		RunID:     opts.runID,
+		Total:     len(csvContent),
 	}
-	err = addFileToS3Bucket(zipFileName, region, bucket)
-	if err != nil {
-		fmt.Println(err)
+
+	for i, format := range formats {
+		format := format
+		key := renderKeyTemplate(opts.keyTemplate, objects[i])
+
+		err := uploadStream(ctx, uploader, key, format.contentType, &opts, func(w io.Writer) error {
+			return streamOutput(w, csvContent, format, opts.time)
+		})
+
+		if err != nil {
+			return err
+		}
+		manifest.Outputs = append(manifest.Outputs, s3ManifestItem{
+			ContentType: format.contentType,
+			Format:      format.name,
+			Key:         key,
+		})
+	}
+
+	if opts.manifest {
+		return uploadManifest(ctx, uploader, manifest, &opts)
 	}
-	defer os.Remove(csvFileName)
-	defer os.Remove(zipFileName)
 	return err
 }
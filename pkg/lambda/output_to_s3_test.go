@@ -1,31 +1,19 @@
 package lambda
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func Test_createZipFile(t *testing.T) {
-	type args struct {
-		file   string
-		target string
-	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		// TODO: Add test cases.
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := createZipFile(tt.args.file, tt.args.target); (err != nil) != tt.wantErr {
-				t.Errorf("createZipFile() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
-
 func Test_buildCSVFile(t *testing.T) {
 	type args struct {
 		options []syncOptions
@@ -70,23 +58,156 @@ func Test_buildCSVFile(t *testing.T) {
 	}
 }
 
-func Test_writeCSVFile(t *testing.T) {
-	type args struct {
-		csvContent  *[]csvFormat
-		csvFileName string
+func Test_streamOutput(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		wantZipName string
+		want        string
+	}{
+		{
+			name:        "TestZippedCSV",
+			format:      "csv",
+			wantZipName: "images.csv",
+			want:        "gcr.io/datadoghq/agent,123321.dkr.ecr.eu-west-2.amazonaws.com/dev/datadoghq/agent,v7.32.0\n",
+		},
+		{
+			name:   "TestPlainNDJSON",
+			format: "ndjson",
+			want:   `{"source":"gcr.io/datadoghq/agent","ecr_url":"123321.dkr.ecr.eu-west-2.amazonaws.com/dev/datadoghq/agent","tag":"v7.32.0"}` + "\n",
+		},
+	}
+	content := []csvFormat{{"gcr.io/datadoghq/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/dev/datadoghq/agent", "v7.32.0"}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := streamOutput(&b, content, outputFormats[tt.format], time.Now()); err != nil {
+				t.Errorf("streamOutput() error = %v", err)
+				return
+			}
+			got := b.String()
+			if tt.wantZipName != "" {
+				got = readZipEntry(t, b.Bytes(), tt.wantZipName)
+			}
+			if got != tt.want {
+				t.Errorf("streamOutput() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_outputToS3Bucket(t *testing.T) {
+	type upload struct {
+		header http.Header
+		body   []byte
 	}
+	var (
+		mu      sync.Mutex
+		uploads = make(map[string]upload)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		uploads[r.URL.Path] = upload{header: r.Header, body: body}
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	uploader, err := newS3Uploader("eu-west-1", server.URL)
+	if err != nil {
+		t.Fatalf("newS3Uploader() error = %v", err)
+	}
+	content := []csvFormat{{"gcr.io/datadoghq/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/dev/datadoghq/agent", "v7.32.0"}}
+
+	err = outputToS3Bucket(context.Background(), uploader, content, s3OutputOptions{
+		bucket:      "test-bucket",
+		formats:     []string{"csv", "crane"},
+		keyTemplate: "{date}/{run_id}/{name}.{ext}",
+		kmsKeyID:    "arn:aws:kms:eu-west-1:123456789012:key/test",
+		manifest:    true,
+		metadata:    map[string]string{"team": "platform"},
+		runID:       "run1",
+		sse:         "aws:kms",
+		tags:        map[string]string{"source": "ecr-image-sync"},
+		time:        time.Date(2024, 10, 2, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("outputToS3Bucket() error = %v", err)
+	}
+
+	for _, key := range []string{"/test-bucket/2024-10-02/run1/images.zip", "/test-bucket/2024-10-02/run1/images.sh", "/test-bucket/2024-10-02/run1/manifest.json"} {
+		u, ok := uploads[key]
+		if !ok {
+			t.Errorf("outputToS3Bucket() missing upload %s, got %v", key, uploads)
+			continue
+		}
+		if got := u.header.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+			t.Errorf("outputToS3Bucket() %s sse = %v, want aws:kms", key, got)
+		}
+		if got := u.header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != "arn:aws:kms:eu-west-1:123456789012:key/test" {
+			t.Errorf("outputToS3Bucket() %s kms key = %v", key, got)
+		}
+		if got := u.header.Get("X-Amz-Tagging"); got != "source=ecr-image-sync" {
+			t.Errorf("outputToS3Bucket() %s tagging = %v", key, got)
+		}
+		if got := u.header.Get("X-Amz-Meta-Team"); got != "platform" {
+			t.Errorf("outputToS3Bucket() %s metadata = %v", key, got)
+		}
+	}
+	if got := readZipEntry(t, uploads["/test-bucket/2024-10-02/run1/images.zip"].body, "images.csv"); !strings.Contains(got, "v7.32.0") {
+		t.Errorf("outputToS3Bucket() csv = %q", got)
+	}
+}
+
+func Test_getServerSideEncryption(t *testing.T) {
 	tests := []struct {
-		name    string
-		args    args
+		sse     string
+		want    string
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{sse: "", want: "AES256"},
+		{sse: "SSE-S3", want: "AES256"},
+		{sse: "sse-kms", want: "aws:kms"},
+		{sse: "aws:kms", want: "aws:kms"},
+		{sse: "none", wantErr: true},
 	}
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := writeCSVFile(tt.args.csvContent, tt.args.csvFileName); (err != nil) != tt.wantErr {
-				t.Errorf("writeCSVFile() error = %v, wantErr %v", err, tt.wantErr)
+		t.Run(tt.sse, func(t *testing.T) {
+			got, err := getServerSideEncryption(tt.sse)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getServerSideEncryption() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("getServerSideEncryption() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func readZipEntry(t *testing.T, content []byte, name string) string {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening zip entry: %v", err)
+		}
+		defer rc.Close()
+		b, _ := io.ReadAll(rc)
+		return string(b)
+	}
+	t.Fatalf("zip entry %s not found", name)
+	return ""
+}
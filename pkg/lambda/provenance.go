@@ -0,0 +1,187 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	provenanceArtifactType = "application/vnd.ecr-image-sync.provenance.v1+json"
+	provenanceTagSuffix    = ".provenance"
+	emptyConfigMediaType   = "application/vnd.oci.empty.v1+json"
+	toolName               = "lambda-ecr-image-sync"
+)
+
+// Version is the version of the tool recorded in the provenance, set at build time with
+// -ldflags "-X github.com/martijnvdp/lambda-ecr-image-sync/pkg/lambda.Version=v1.2.3"
+var Version = ""
+
+// provenance records where a mirrored image comes from, the fields are part of the public interface
+type provenance struct {
+	Digest       string    `json:"digest"` // digest of the image on ecr
+	Repository   string    `json:"repository"`
+	Rule         *WorkItem `json:"rule,omitempty"` // repository options that selected the tag
+	RunID        string    `json:"run_id"`
+	Source       string    `json:"source"`        // source reference like docker.io/library/nginx:1.25.3
+	SourceDigest string    `json:"source_digest"` // digest of the platform manifest copied from the source tag
+	SyncedAt     time.Time `json:"synced_at"`
+	Tag          string    `json:"tag"`
+	Tool         string    `json:"tool"`
+	ToolVersion  string    `json:"tool_version"`
+}
+
+// provenanceRecorder pushes a provenance artifact for every copied image
+type provenanceRecorder struct {
+	runID   string
+	version string
+}
+
+// artifactManifest is an oci image manifest with an artifact type and a subject, go-containerregistry v0.13 has no
+// subject in v1.Manifest
+type artifactManifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Subject       *v1.Descriptor    `json:"subject"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+func newProvenanceRecorder(runID string) *provenanceRecorder {
+	return &provenanceRecorder{runID: runID, version: toolVersion()}
+}
+
+// toolVersion returns the version set at build time or the module version of the binary
+func toolVersion() string {
+	if Version != "" {
+		return Version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// provenanceTag returns the tag of the provenance artifact of the digest, sha256-<hex>.provenance
+func provenanceTag(digest v1.Hash) string {
+	return digest.Algorithm + "-" + digest.Hex + provenanceTagSuffix
+}
+
+// provenanceArtifact returns the manifest and the layer of the provenance artifact referring to the subject
+func provenanceArtifact(p provenance, subject v1.Descriptor) (manifest []byte, layer v1.Layer, err error) {
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	layer = static.NewLayer(doc, provenanceArtifactType)
+	layerDigest, err := layer.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	emptyDigest, _, _ := v1.SHA256(strings.NewReader("{}"))
+
+	manifest, err = json.Marshal(artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  provenanceArtifactType,
+		Config:        v1.Descriptor{MediaType: emptyConfigMediaType, Size: 2, Digest: emptyDigest, Data: []byte("{}")},
+		Layers:        []v1.Descriptor{{MediaType: provenanceArtifactType, Size: int64(len(doc)), Digest: layerDigest}},
+		Subject:       &v1.Descriptor{MediaType: subject.MediaType, Size: subject.Size, Digest: subject.Digest},
+		Annotations:   map[string]string{"org.opencontainers.image.created": p.SyncedAt.Format(time.RFC3339)},
+	})
+	return manifest, layer, err
+}
+
+// sourceDigest returns the digest of the platform manifest the source tag points to, empty without provenance or when
+// the digest can't be read
+func (svc *ecrClient) sourceDigest(ctx context.Context, source, tag string) string {
+	if svc.provenance == nil {
+		return ""
+	}
+	digest, err := crane.Digest(source+":"+tag, svc.craneOptions(ctx)...)
+	if err != nil {
+		svc.log().Warn("error reading source digest, copying without provenance", logKeyPhase, phaseSync, logKeySource, source, logKeyTag, tag, logKeyError, err)
+		return ""
+	}
+	return digest
+}
+
+// recordProvenance pushes the provenance artifact of the copied tag to the ecr repository, the artifact refers to the
+// image as subject for the referrers api and is tagged sha256-<hex>.provenance for registries without it. The digest is
+// the platform manifest copied from the source, resolved before the copy
+func (svc *ecrClient) recordProvenance(ctx context.Context, options syncOptions, tag, digest, destination string) error {
+	r := svc.provenance
+
+	if r == nil || digest == "" {
+		return nil
+	}
+	opts := svc.craneOptions(ctx)
+	ref, err := name.ParseReference(destination)
+	if err != nil {
+		return err
+	}
+
+	subject, err := crane.Head(ref.Context().String()+"@"+digest, opts...)
+	if err != nil {
+		return fmt.Errorf("reading image digest: %w", err)
+	}
+
+	manifest, layer, err := provenanceArtifact(provenance{
+		Digest:       subject.Digest.String(),
+		Repository:   options.ecrImageName,
+		Rule:         options.rule,
+		RunID:        r.runID,
+		Source:       options.source + ":" + tag,
+		SourceDigest: digest,
+		SyncedAt:     time.Now().UTC(),
+		Tag:          tag,
+		Tool:         toolName,
+		ToolVersion:  r.version,
+	}, *subject)
+	if err != nil {
+		return err
+	}
+	return pushArtifact(destination, provenanceTag(subject.Digest), manifest, layer, crane.GetOptions(opts...).Remote...)
+}
+
+// pushArtifact pushes the empty config, the layer and the manifest of an artifact with the tag to the repository of the reference
+func pushArtifact(reference, tag string, manifest []byte, layer v1.Layer, opts ...remote.Option) error {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return err
+	}
+	repo := ref.Context()
+
+	for _, l := range []v1.Layer{static.NewLayer([]byte("{}"), emptyConfigMediaType), layer} {
+		if err := remote.WriteLayer(repo, l, opts...); err != nil {
+			return fmt.Errorf("pushing artifact blob: %w", err)
+		}
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	artifact := &remote.Descriptor{
+		Descriptor: v1.Descriptor{MediaType: types.OCIManifestSchema1, Size: size, Digest: digest},
+		Manifest:   manifest,
+	}
+
+	if err := remote.Put(repo.Tag(tag), artifact, opts...); err != nil {
+		return fmt.Errorf("pushing artifact manifest: %w", err)
+	}
+	return nil
+}
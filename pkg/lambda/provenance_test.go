@@ -0,0 +1,95 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func Test_recordProvenance(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, _ := random.Image(1024, 1)
+	arm, _ := random.Image(1024, 1)
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+		mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+	)
+	ref, _ := name.ParseReference(host + "/library/nginx:1.25.3")
+
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatalf("WriteIndex() error = %v", err)
+	}
+	digest, _ := img.Digest()
+
+	svc := &ecrClient{provenance: &provenanceRecorder{runID: "run-1", version: "v1.2.3"}}
+	options := syncOptions{ecrImageName: "dev/nginx", rule: &WorkItem{Version: WorkItemVersion, Constraint: ">= 1.25"}, source: host + "/library/nginx"}
+	source := svc.sourceDigest(context.Background(), options.source, "1.25.3")
+
+	if source != digest.String() {
+		t.Fatalf("sourceDigest() = %s, want the linux/amd64 manifest %s", source, digest)
+	}
+
+	if _, err := svc.copyImageWithCrane(context.Background(), options.source, "1.25.3", source, host, "dev/nginx", nil); err != nil {
+		t.Fatalf("copyImageWithCrane() error = %v", err)
+	}
+
+	if err := svc.recordProvenance(context.Background(), options, "1.25.3", source, host+"/dev/nginx:1.25.3"); err != nil {
+		t.Fatalf("recordProvenance() error = %v", err)
+	}
+
+	raw, err := crane.Manifest(host + "/dev/nginx:" + provenanceTag(digest))
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	var manifest artifactManifest
+	json.Unmarshal(raw, &manifest)
+
+	if manifest.ArtifactType != provenanceArtifactType || manifest.Subject == nil || manifest.Subject.Digest != digest || len(manifest.Layers) != 1 {
+		t.Fatalf("recordProvenance() manifest = %s, want a provenance artifact with subject %s", raw, digest)
+	}
+
+	layer, err := crane.PullLayer(host + "/dev/nginx@" + manifest.Layers[0].Digest.String())
+	if err != nil {
+		t.Fatalf("PullLayer() error = %v", err)
+	}
+	rc, _ := layer.Compressed()
+	defer rc.Close()
+	var got provenance
+	json.NewDecoder(rc).Decode(&got)
+
+	if got.Digest != digest.String() || got.SourceDigest != digest.String() || got.Source != host+"/library/nginx:1.25.3" || got.RunID != "run-1" || got.ToolVersion != "v1.2.3" || got.Rule == nil || got.Rule.Constraint != ">= 1.25" {
+		t.Errorf("recordProvenance() provenance = %+v", got)
+	}
+
+	if tag, _ := crane.Digest(host + "/dev/nginx:1.25.3"); tag != digest.String() {
+		t.Errorf("recordProvenance() changed the image digest to %s, want %s", tag, digest)
+	}
+}
+
+func Test_recordProvenance_disabled(t *testing.T) {
+	svc := &ecrClient{}
+
+	if digest := svc.sourceDigest(context.Background(), "invalid", "latest"); digest != "" {
+		t.Errorf("sourceDigest() = %s, want empty without provenance", digest)
+	}
+
+	if err := svc.recordProvenance(context.Background(), syncOptions{}, "latest", "sha256:1234", "invalid"); err != nil {
+		t.Errorf("recordProvenance() error = %v, want nil without provenance", err)
+	}
+}
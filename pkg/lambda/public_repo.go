@@ -7,7 +7,8 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-func (i *inputRepository) getTagsFromPublicRepo() (tags []string, err error) {
+// defaultCraneOptions returns the crane options used when no options are given
+func defaultCraneOptions() []crane.Option {
 	params := crane.Options{
 		Platform: &v1.Platform{
 			Architecture: "amd64",
@@ -15,7 +16,13 @@ func (i *inputRepository) getTagsFromPublicRepo() (tags []string, err error) {
 		},
 	}
 
-	opts := []crane.Option{crane.WithPlatform(params.Platform)}
+	return []crane.Option{crane.WithPlatform(params.Platform)}
+}
+
+func (i *inputRepository) getTagsFromPublicRepo(opts ...crane.Option) (tags []string, err error) {
+	if len(opts) == 0 {
+		opts = defaultCraneOptions()
+	}
 
 	tags, err = crane.ListTags(i.source, opts...)
 	if err != nil {
@@ -0,0 +1,293 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
+)
+
+const actionReport = "report"
+
+// reportHTMLTemplate renders the staleness report as a html page
+var reportHTMLTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"join": strings.Join}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>ECR image sync report {{.RunID}}</title></head>
+<body>
+<h1>ECR image sync report</h1>
+<p>{{.Summary}}</p>
+<table>
+<tr><th>Repository</th><th>Source</th><th>Newest upstream</th><th>Newest ECR</th><th>Behind</th><th>Last sync</th><th>Removed upstream</th></tr>
+{{- range .Repositories}}
+<tr><td>{{.Repository}}</td><td>{{.Source}}</td><td>{{.NewestUpstream}}</td><td>{{.NewestECR}}</td><td>{{.Behind}}</td><td>{{$.Age .}}</td><td>{{if .Error}}error: {{.Error}}{{else}}{{join .RemovedUpstream ", "}}{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// staleReport compares the ecr repositories with their sources, the fields are part of the public interface
+type staleReport struct {
+	GeneratedAt  time.Time          `json:"generated_at"`
+	Repositories []repositoryReport `json:"repositories"`
+	RunID        string             `json:"run_id"`
+}
+
+type repositoryReport struct {
+	Behind          int       `json:"behind"` // selected upstream versions newer than the newest ecr version
+	Error           string    `json:"error,omitempty"`
+	LastSync        time.Time `json:"last_sync"` // last push to the ecr repository
+	NewestECR       string    `json:"newest_ecr"`
+	NewestUpstream  string    `json:"newest_upstream"`            // newest upstream version that passes the ecr_sync filters
+	RemovedUpstream []string  `json:"removed_upstream,omitempty"` // ecr tags that no longer exist in the source
+	Repository      string    `json:"repository"`
+	Source          string    `json:"source"`
+}
+
+// buildRepositoryReport compares the tags of the ecr repository with the upstream tags using the filters of the repository
+func buildRepositoryReport(i *inputRepository, upstreamTags, ecrTags []string, lastSync time.Time) (r repositoryReport, err error) {
+	r = repositoryReport{LastSync: lastSync, Repository: i.ecrImageName, Source: i.source}
+	upstream, err := i.selectedVersions(upstreamTags)
+	if err != nil {
+		return r, err
+	}
+
+	mirrored, _, err := i.sortTags(ecrTags)
+	if err != nil {
+		return r, err
+	}
+	var newestECR *version.Version
+
+	if len(mirrored) > 0 {
+		newestECR = mirrored[len(mirrored)-1]
+		r.NewestECR = newestECR.Original()
+	}
+
+	if len(upstream) > 0 {
+		r.NewestUpstream = upstream[len(upstream)-1].Original()
+	}
+
+	for _, v := range upstream {
+		if newestECR == nil || v.GreaterThan(newestECR) {
+			r.Behind++
+		}
+	}
+	exists := make(map[string]bool, len(upstreamTags))
+
+	for _, t := range upstreamTags {
+		exists[t] = true
+	}
+
+	for _, t := range ecrTags {
+		if !exists[t] && !strings.HasSuffix(t, provenanceTagSuffix) {
+			r.RemovedUpstream = append(r.RemovedUpstream, t)
+		}
+	}
+	sort.Strings(r.RemovedUpstream)
+	return r, nil
+}
+
+// getLastPushedFromECR returns the time of the last image push to the ecr repository
+func (svc *ecrClient) getLastPushedFromECR(ctx context.Context, ecrImageName string) (last time.Time, err error) {
+	input := &ecr.DescribeImagesInput{
+		RepositoryName: aws.String(ecrImageName),
+		Filter:         &ecr.DescribeImagesFilter{TagStatus: aws.String("TAGGED")},
+	}
+
+	err = svc.DescribeImagesPagesWithContext(ctx, input, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+		for _, image := range page.ImageDetails {
+			if image.ImagePushedAt != nil && image.ImagePushedAt.After(last) {
+				last = *image.ImagePushedAt
+			}
+		}
+		return !lastPage
+	})
+	return last, err
+}
+
+// reportRepository returns the report of a single repository, errors are part of the report
+func (svc *ecrClient) reportRepository(ctx context.Context, repo inputRepository, region string) repositoryReport {
+	logger := svc.log().With(logKeyPhase, phaseFilter, logKeyRepository, repo.ecrImageName, logKeySource, repo.source)
+	failed := func(err error) repositoryReport {
+		logger.Error("error reporting repository", logKeyError, err)
+		return repositoryReport{Error: err.Error(), Repository: repo.ecrImageName, Source: repo.source}
+	}
+
+	images, err := svc.getImagesFromECR(ctx, repo.ecrImageName, region, &repo)
+	if err != nil {
+		return failed(err)
+	}
+	ecrTags := make([]string, 0, len(images))
+
+	for _, image := range images {
+		ecrTags = append(ecrTags, image.tag)
+	}
+
+	upstreamTags, err := repo.getTagsFromPublicRepo(svc.craneOptions(ctx)...)
+	if err != nil {
+		return failed(err)
+	}
+
+	lastSync, err := svc.getLastPushedFromECR(ctx, repo.ecrImageName)
+	if err != nil {
+		return failed(err)
+	}
+
+	report, err := buildRepositoryReport(&repo, upstreamTags, ecrTags, lastSync)
+	if err != nil {
+		return failed(err)
+	}
+	return report
+}
+
+// reportRepositories returns the reports of the repositories sorted by repository
+func (svc *ecrClient) reportRepositories(ctx context.Context, repositories []inputRepository, region string, max int) []repositoryReport {
+	reports := make([]repositoryReport, len(repositories))
+
+	forEach(len(repositories), max, func(i int) {
+		reports[i] = svc.reportRepository(ctx, repositories[i], region)
+	})
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Repository < reports[j].Repository })
+	return reports
+}
+
+// Summary returns the number of repositories that are behind or failed, used in the templates
+func (r *staleReport) Summary() string {
+	behind, failed := 0, 0
+
+	for _, repo := range r.Repositories {
+		switch {
+		case repo.Error != "":
+			failed++
+		case repo.Behind > 0:
+			behind++
+		}
+	}
+	return fmt.Sprintf("%d of %d repositories are behind their source, %d failed", behind, len(r.Repositories), failed)
+}
+
+// Age returns the time since the last sync of the repository rounded to minutes
+func (r *staleReport) Age(repo repositoryReport) string {
+	if repo.LastSync.IsZero() {
+		return "never"
+	}
+	return r.GeneratedAt.Sub(repo.LastSync).Round(time.Minute).String()
+}
+
+// markdown returns the report as a markdown table
+func (r *staleReport) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# ECR image sync report\n\n%s\n\n", r.Summary())
+	b.WriteString("| Repository | Source | Newest upstream | Newest ECR | Behind | Last sync | Removed upstream |\n")
+	b.WriteString("|---|---|---|---|---|---|---|\n")
+
+	for _, repo := range r.Repositories {
+		removed := strings.Join(repo.RemovedUpstream, ", ")
+
+		if repo.Error != "" {
+			removed = "error: " + repo.Error
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %d | %s | %s |\n", repo.Repository, repo.Source, repo.NewestUpstream, repo.NewestECR, repo.Behind, r.Age(repo), strings.ReplaceAll(removed, "|", `\|`))
+	}
+	return b.String()
+}
+
+// html returns the report as a html page
+func (r *staleReport) html() (string, error) {
+	var b bytes.Buffer
+	err := reportHTMLTemplate.Execute(&b, r)
+
+	return b.String(), err
+}
+
+// uploadReport uploads the report as markdown, html and json with the key template of the s3 output
+func uploadReport(ctx context.Context, uploader s3manageriface.UploaderAPI, r *staleReport, opts s3OutputOptions) (keys []string, err error) {
+	page, err := r.html()
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	outputs := []struct {
+		format, ext, contentType, body string
+	}{
+		{"markdown", "md", "text/markdown", r.markdown()},
+		{"html", "html", "text/html", page},
+		{"json", "json", "application/json", string(content)},
+	}
+
+	objects := make([]keyTemplateData, len(outputs))
+
+	for i, o := range outputs {
+		objects[i] = keyTemplateData{name: actionReport, format: o.format, ext: o.ext, runID: opts.runID, time: opts.time}
+	}
+
+	if err := checkKeyTemplate(opts.keyTemplate, objects); err != nil {
+		return nil, err
+	}
+
+	for i, o := range outputs {
+		key := renderKeyTemplate(opts.keyTemplate, objects[i])
+		body := o.body
+
+		err := uploadStream(ctx, uploader, key, o.contentType, &opts, func(w io.Writer) error {
+			_, err := io.WriteString(w, body)
+			return err
+		})
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// runReport reports the repositories, uploads the report to the s3 bucket when set and sends it to the notifiers
+func (svc *ecrClient) runReport(ctx context.Context, event LambdaEvent, env environmentVars, repositories []inputRepository, max int, n notifiers, result *runResult) (response, error) {
+	report := &staleReport{
+		GeneratedAt:  time.Now().UTC(),
+		Repositories: svc.reportRepositories(ctx, repositories, env.awsRegion, max),
+		RunID:        result.RunID,
+	}
+
+	if env.awsBucket != "" {
+		uploader, err := newS3Uploader(env.awsRegion, env.s3Endpoint)
+		if err != nil {
+			return returnErr(ctx, err, n, result,
+				"Error creating S3 client:")
+		}
+
+		outputCtx, outputSpan := startSpan(ctx, phaseOutput)
+		keys, err := uploadReport(outputCtx, uploader, report, s3OutputOptionsFromEvent(event, env, result))
+		endSpan(outputSpan, err)
+
+		if err != nil {
+			return returnErr(ctx, err, n, result,
+				"Error uploading the report to the S3 Bucket:")
+		}
+		svc.log().Info("uploaded report", logKeyPhase, phaseOutput, "keys", keys)
+	}
+	result.Ok = true
+	result.Message = report.Summary()
+	result.Report = report.markdown()
+	result.Finished = time.Now()
+	n.notify(ctx, result)
+
+	return response{
+		Message: result.Message,
+		Ok:      true,
+		Report:  report,
+	}, nil
+}
@@ -0,0 +1,116 @@
+package lambda
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_buildRepositoryReport(t *testing.T) {
+	lastSync := parseTime("2023-03-10T10:00:00Z")
+	tests := []struct {
+		name         string
+		i            *inputRepository
+		upstreamTags []string
+		ecrTags      []string
+		want         repositoryReport
+	}{
+		{
+			name:         "behind",
+			i:            &inputRepository{ecrImageName: "dev/nginx", source: "docker.io/library/nginx"},
+			upstreamTags: []string{"1.24.0", "1.25.0", "1.25.1", "1.25.2", "latest"},
+			ecrTags:      []string{"1.24.0", "1.25.0"},
+			want: repositoryReport{
+				Behind: 2, LastSync: lastSync, NewestECR: "1.25.0", NewestUpstream: "1.25.2",
+				Repository: "dev/nginx", Source: "docker.io/library/nginx",
+			},
+		},
+		{
+			name:         "removed upstream without provenance tags",
+			i:            &inputRepository{ecrImageName: "dev/nginx"},
+			upstreamTags: []string{"1.25.1", "1.25.2"},
+			ecrTags:      []string{"1.25.2", "1.25.0", "1.24.0", "sha256-1234.provenance"},
+			want: repositoryReport{
+				LastSync: lastSync, NewestECR: "1.25.2", NewestUpstream: "1.25.2",
+				RemovedUpstream: []string{"1.24.0", "1.25.0"}, Repository: "dev/nginx",
+			},
+		},
+		{
+			name:         "constraint and exclude filters",
+			i:            &inputRepository{constraint: "< 2.0.0", ecrImageName: "dev/app", excludeRLS: []string{"rc"}},
+			upstreamTags: []string{"1.0.0", "1.1.0", "1.2.0-rc1", "2.0.0"},
+			ecrTags:      []string{"1.0.0"},
+			want: repositoryReport{
+				Behind: 1, LastSync: lastSync, NewestECR: "1.0.0", NewestUpstream: "1.1.0", Repository: "dev/app",
+			},
+		},
+		{
+			name:         "empty mirror",
+			i:            &inputRepository{ecrImageName: "dev/app"},
+			upstreamTags: []string{"1.0.0", "1.1.0"},
+			want:         repositoryReport{Behind: 2, LastSync: lastSync, NewestUpstream: "1.1.0", Repository: "dev/app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildRepositoryReport(tt.i, tt.upstreamTags, tt.ecrTags, lastSync)
+			if err != nil {
+				t.Fatalf("buildRepositoryReport() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildRepositoryReport() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getLastPushedFromECR(t *testing.T) {
+	svc := &ecrClient{ECRAPI: &mockECRClient{}}
+
+	got, err := svc.getLastPushedFromECR(context.Background(), "dev/nginx")
+	if err != nil {
+		t.Fatalf("getLastPushedFromECR() error = %v", err)
+	}
+
+	if want := parseTime("2023-03-10T10:00:00Z"); !got.Equal(want) {
+		t.Errorf("getLastPushedFromECR() = %v, want %v", got, want)
+	}
+}
+
+func Test_staleReport_render(t *testing.T) {
+	generated := parseTime("2023-03-10T12:30:00Z")
+	r := &staleReport{
+		GeneratedAt: generated,
+		RunID:       "run-1",
+		Repositories: []repositoryReport{
+			{Behind: 2, LastSync: generated.Add(-2 * time.Hour), NewestECR: "1.25.0", NewestUpstream: "1.25.2", RemovedUpstream: []string{"1.24.0"}, Repository: "dev/nginx", Source: "docker.io/library/nginx"},
+			{Error: "unauthorized", Repository: "dev/private", Source: "ghcr.io/org/private"},
+			{NewestECR: "2.0.0", NewestUpstream: "2.0.0", Repository: "dev/app", Source: "ghcr.io/org/app"},
+		},
+	}
+
+	if got, want := r.Summary(), "1 of 3 repositories are behind their source, 1 failed"; got != want {
+		t.Errorf("Summary() = %q, want %q", got, want)
+	}
+
+	markdown := r.markdown()
+	for _, want := range []string{
+		"| dev/nginx | docker.io/library/nginx | 1.25.2 | 1.25.0 | 2 | 2h0m0s | 1.24.0 |",
+		"| dev/private | ghcr.io/org/private |  |  | 0 | never | error: unauthorized |",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("markdown() = %s, want row %q", markdown, want)
+		}
+	}
+
+	page, err := r.html()
+	if err != nil {
+		t.Fatalf("html() error = %v", err)
+	}
+
+	if !strings.Contains(page, "<td>dev/nginx</td><td>docker.io/library/nginx</td><td>1.25.2</td><td>1.25.0</td><td>2</td><td>2h0m0s</td><td>1.24.0</td>") {
+		t.Errorf("html() = %s, want the dev/nginx row", page)
+	}
+}
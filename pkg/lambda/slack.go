@@ -2,13 +2,43 @@ package lambda
 
 import (
 	"context"
-	"time"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/nikoksr/notify"
 	"github.com/nikoksr/notify/service/slack"
+	slackapi "github.com/slack-go/slack"
 )
 
-func sendSlackNotification(slackToken, channelID string, subject, message string) (err error) {
+const (
+	slackMaxBlocks       = 50    // max blocks in a single message
+	slackMaxHeaderText   = 150   // max characters of a header block
+	slackMaxMessageText  = 12000 // budget for the text of all blocks in a single message
+	slackMaxSectionText  = 3000  // max characters of a section block
+	slackMaxTagLine      = 300   // tags are packed in lines of this length
+	slackMaxErrorText    = 200   // errors of failed tags are truncated to this length
+	slackFormatBlocks    = "blocks"
+	slackFormatText      = "text"
+	slackCSVFileName     = "images.csv"
+	slackContinuedSuffix = " (continued)"
+)
+
+var slackStatusTitles = []struct {
+	status  string
+	title   string
+	summary string
+}{
+	{statusSynced, ":white_check_mark: *Synced*", "Synced"},
+	{statusPending, ":inbox_tray: *Added to output*", "Added"},
+	{statusDeferred, ":hourglass_flowing_sand: *Deferred to the next run*", "Deferred"},
+	{statusFailed, ":x: *Failed*", "Failed"},
+	{statusSkipped, ":fast_forward: *Skipped*", "Skipped"},
+}
+
+func sendSlackNotification(ctx context.Context, slackToken, channelID string, subject, message string) (err error) {
 	if slackToken == "" {
 		return err
 	}
@@ -18,7 +48,7 @@ func sendSlackNotification(slackToken, channelID string, subject, message string
 	notifier.UseServices(slackService)
 
 	err = notifier.Send(
-		context.Background(),
+		ctx,
 		subject,
 		message,
 	)
@@ -28,17 +58,229 @@ func sendSlackNotification(slackToken, channelID string, subject, message string
 	return err
 }
 
-func sendResultsToSlack(messageHeader, messageSubject string, csvContent *[]csvFormat, token, channelID string) {
-	if token == "" {
-		return
+func (s *slackNotifier) send(ctx context.Context, n notification) error {
+	if s.format == slackFormatText || n.result == nil || len(n.result.Images) == 0 {
+		return sendSlackNotification(ctx, s.token, s.channelID, n.subject, n.message)
+	}
+
+	if s.token == "" {
+		return nil
+	}
+	return s.sendBlocks(ctx, n)
+}
+
+// sendBlocks posts the result as block kit messages, overflowing sections are posted as thread replies
+func (s *slackNotifier) sendBlocks(ctx context.Context, n notification) error {
+	options := []slackapi.Option{}
+
+	if s.apiURL != "" {
+		options = append(options, slackapi.OptionAPIURL(s.apiURL))
 	}
-	subject := tryString(messageSubject, "Lambda ECR-IMAGE-SYNC has run.") + "\n"
-	message := tryString(messageHeader, "The following ecr images are being Synced to ECR:") + "\n"
+	api := slackapi.New(s.token, options...)
+	messages := buildSlackMessages(n.subject, s.header, n.result)
+	_, ts, err := api.PostMessageContext(ctx, s.channelID, slackapi.MsgOptionText(n.subject, false), slackapi.MsgOptionBlocks(messages[0]...))
+
+	if err != nil {
+		return fmt.Errorf("posting slack message: %w", err)
+	}
+
+	for _, blocks := range messages[1:] {
+		_, _, err := api.PostMessageContext(ctx, s.channelID, slackapi.MsgOptionText(n.subject, false), slackapi.MsgOptionBlocks(blocks...), slackapi.MsgOptionTS(ts))
+		if err != nil {
+			return fmt.Errorf("posting slack thread reply: %w", err)
+		}
+	}
+
+	// files.upload is retired, files are uploaded to an external url and completed in the channel
+	if s.attachCSV {
+		content := imageResultsCSV(n.result.Images)
+		_, err := api.UploadFileV2Context(ctx, slackapi.UploadFileV2Parameters{
+			Content:         content,
+			FileSize:        len(content),
+			Filename:        slackCSVFileName,
+			Title:           slackCSVFileName,
+			Channel:         s.channelID,
+			ThreadTimestamp: ts,
+		})
+		if err != nil {
+			return fmt.Errorf("uploading csv to slack: %w", err)
+		}
+	}
+	return err
+}
+
+// buildSlackMessages returns the block kit messages for the result, the first message contains the summary
+func buildSlackMessages(subject, header string, result *runResult) (messages [][]slackapi.Block) {
+	first := []slackapi.Block{
+		slackapi.NewHeaderBlock(slackapi.NewTextBlockObject(slackapi.PlainTextType, truncate(subject, slackMaxHeaderText), false, false)),
+		slackapi.NewContextBlock("", slackapi.NewTextBlockObject(slackapi.MarkdownType, slackSummary(result), false, false)),
+	}
+	size := 0
+
+	if header != "" {
+		first = append(first, slackSection(truncate(header, slackMaxSectionText)))
+		size += len(header)
+	}
+
+	if result.Error != "" {
+		text := "```" + truncate(result.Error, slackMaxSectionText-6) + "```"
+		first = append(first, slackSection(text))
+		size += len(text)
+	}
+	messages = append(messages, first)
+
+	for _, text := range slackRepositorySections(result.Images) {
+		current := messages[len(messages)-1]
+
+		if len(current) >= slackMaxBlocks || size+len(text) > slackMaxMessageText {
+			messages = append(messages, []slackapi.Block{})
+			current = nil
+			size = 0
+		}
+		messages[len(messages)-1] = append(current, slackSection(text))
+		size += len(text)
+	}
+	return messages
+}
+
+// slackSummary returns the counts of the result for the context block
+func slackSummary(result *runResult) string {
+	summary := []string{"Run `" + result.RunID + "`"}
+
+	for _, s := range slackStatusTitles {
+		if count := result.Count(s.status); count > 0 || s.status == statusSynced && result.Action != actionS3 {
+			summary = append(summary, fmt.Sprintf("%s: %d", s.summary, count))
+		}
+	}
+
+	if result.BytesUploaded > 0 || result.BytesSkipped > 0 {
+		summary = append(summary, result.Transferred())
+	}
+	return strings.Join(summary, " | ")
+}
+
+// slackRepositorySections returns the section texts grouped by repository, split to fit in a section block
+func slackRepositorySections(images []imageResult) (sections []string) {
+	repositories := make(map[string][]imageResult)
+
+	for _, i := range images {
+		repositories[i.ECRURL] = append(repositories[i.ECRURL], i)
+	}
+
+	for _, ecrURL := range sortedKeys(repositories) {
+		repoImages := repositories[ecrURL]
+		title := "*" + repoImages[0].Source + "* → `" + ecrURL + "`"
+		var lines []string
+
+		for _, s := range slackStatusTitles {
+			count := countStatus(repoImages, s.status)
+
+			if count == 0 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s (%d)", s.title, count))
+			var tags []string
+
+			for _, i := range repoImages {
+				switch {
+				case i.Status != s.status:
+				case i.Status == statusFailed:
+					lines = append(lines, "`"+i.Tag+"`: "+truncate(i.Error, slackMaxErrorText))
+				case i.Reason != "":
+					lines = append(lines, "`"+i.Tag+"`: "+truncate(i.Reason, slackMaxErrorText))
+				default:
+					tags = append(tags, "`"+i.Tag+"`")
+				}
+			}
+			lines = append(lines, packLines(tags, ", ", slackMaxTagLine)...)
+		}
+		sections = append(sections, packSections(title, lines, slackMaxSectionText)...)
+	}
+	return sections
+}
+
+// countStatus returns the number of images with the status
+func countStatus(images []imageResult, status string) (count int) {
+	for _, i := range images {
+		if i.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// packLines joins items with sep in lines of at most max characters
+func packLines(items []string, sep string, max int) (lines []string) {
+	var line string
+
+	for _, item := range items {
+		if line != "" && len(line)+len(sep)+len(item) > max {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += sep
+		}
+		line += item
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// packSections joins the lines in sections of at most max characters, every section starts with the title
+func packSections(title string, lines []string, max int) (sections []string) {
+	section := title
+
+	for _, line := range lines {
+		line = truncate(line, max-len(title)-len(slackContinuedSuffix)-1)
+
+		if len(section)+1+len(line) > max {
+			sections = append(sections, section)
+			section = title + slackContinuedSuffix
+		}
+		section += "\n" + line
+	}
+	return append(sections, section)
+}
+
+// slackSection returns a markdown section block
+func slackSection(text string) *slackapi.SectionBlock {
+	return slackapi.NewSectionBlock(slackapi.NewTextBlockObject(slackapi.MarkdownType, text, false, false), nil, nil)
+}
+
+// truncate shortens s to at most max bytes without splitting a character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	suffix := "..."
+
+	if max <= len(suffix) {
+		suffix = ""
+	}
+	cut := max - len(suffix)
+
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + suffix
+}
+
+// imageResultsCSV returns the image results as csv with a status column
+func imageResultsCSV(images []imageResult) string {
+	var b strings.Builder
+	writer := csv.NewWriter(&b)
+	writer.Write([]string{"source", "ecr_url", "tag", "status", "error"})
+
+	sorted := append([]imageResult{}, images...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ECRURL < sorted[j].ECRURL })
 
-	for _, r := range *csvContent {
-		message = message + r.source + ":" + r.imageTag + "\n"
+	for _, i := range sorted {
+		writer.Write([]string{i.Source, i.ECRURL, i.Tag, i.Status, i.Error})
 	}
-	currentTime := time.Now()
-	message = message + "\n" + currentTime.Format("2006-01-02 15:04:05")
-	sendSlackNotification(token, channelID, subject, message)
+	writer.Flush()
+	return b.String()
 }
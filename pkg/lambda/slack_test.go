@@ -1,6 +1,17 @@
 package lambda
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	slackapi "github.com/slack-go/slack"
+)
 
 func Test_sendSlackNotification(t *testing.T) {
 	type args struct {
@@ -26,37 +37,175 @@ func Test_sendSlackNotification(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := sendSlackNotification(tt.args.slackOAuthToken, tt.args.channelID, tt.args.subject, tt.args.message); (err != nil) != tt.wantErr {
+			if err := sendSlackNotification(context.Background(), tt.args.slackOAuthToken, tt.args.channelID, tt.args.subject, tt.args.message); (err != nil) != tt.wantErr {
 				t.Errorf("sendSlackNotification() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_sendResultsToSlack(t *testing.T) {
+func Test_slackRepositorySections(t *testing.T) {
+	images := []imageResult{
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/nginx", Tag: "1.23.3", Status: statusSynced},
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/nginx", Tag: "1.23.2", Status: statusSkipped},
+		{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/nginx", Tag: "1.23.1", Status: statusFailed, Error: "denied"},
+		{Source: "quay.io/cilium/cilium", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/cilium", Tag: "v1.12.4", Status: statusSynced},
+	}
+	want := []string{
+		"*quay.io/cilium/cilium* → `123.dkr.ecr.eu-west-1.amazonaws.com/cilium`\n:white_check_mark: *Synced* (1)\n`v1.12.4`",
+		"*docker.io/nginx* → `123.dkr.ecr.eu-west-1.amazonaws.com/nginx`\n:white_check_mark: *Synced* (1)\n`1.23.3`\n:x: *Failed* (1)\n`1.23.1`: denied\n:fast_forward: *Skipped* (1)\n`1.23.2`",
+	}
+	got := slackRepositorySections(images)
+
+	if len(got) != len(want) {
+		t.Fatalf("slackRepositorySections() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("slackRepositorySections()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func Test_buildSlackMessages(t *testing.T) {
 	type args struct {
-		csvContent     *[]csvFormat
-		token          string
-		channelID      string
-		messageHeader  string
-		messageSubject string
+		images int
+		repos  int
 	}
 	tests := []struct {
-		name string
-		args args
+		name         string
+		args         args
+		wantMessages int
 	}{
 		{
-			name: "TestSlackMessage",
-			args: args{
-				token:      "",          // oauth token of the slackbot with chat:public:write and chat:write access
-				channelID:  "C02Pfgsaf", // right click on the channel and click copy link, id should be in there
-				csvContent: &[]csvFormat{{"gcr.io/datadoghq/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadoghq/agent", "v7.32.0"}, {"gcr.io/datadoghq/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadoghq/agent", "v7.31.0"}, {"gcr.io/datadoghq/agent", "123321.dkr.ecr.eu-west-2.amazonaws.com/base/infra/datadoghq/agent", "v7.28.0"}},
-			},
+			name:         "TestSingleMessage",
+			args:         args{images: 5, repos: 3},
+			wantMessages: 1,
+		},
+		{
+			name:         "TestLongTagListSplit",
+			args:         args{images: 2000, repos: 1},
+			wantMessages: 3,
+		},
+		{
+			name:         "TestManyRepositoriesSplit",
+			args:         args{images: 1, repos: 120},
+			wantMessages: 3,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			sendResultsToSlack(tt.args.messageHeader, tt.args.messageSubject, tt.args.csvContent, tt.args.token, tt.args.channelID)
+			result := &runResult{RunID: "run1", Ok: true}
+			for r := 0; r < tt.args.repos; r++ {
+				for i := 0; i < tt.args.images; i++ {
+					result.Images = append(result.Images, imageResult{
+						Source: fmt.Sprintf("docker.io/test/image%d", r),
+						ECRURL: fmt.Sprintf("123.dkr.ecr.eu-west-1.amazonaws.com/image%03d", r),
+						Tag:    fmt.Sprintf("v1.%d.0", i),
+						Status: statusSynced,
+					})
+				}
+			}
+			got := buildSlackMessages("subject", "", result)
+
+			if len(got) != tt.wantMessages {
+				t.Errorf("buildSlackMessages() = %v messages, want %v", len(got), tt.wantMessages)
+			}
+			for _, blocks := range got {
+				if len(blocks) > slackMaxBlocks {
+					t.Errorf("buildSlackMessages() message has %v blocks", len(blocks))
+				}
+				size := 0
+				for _, b := range blocks {
+					if s, ok := b.(*slackapi.SectionBlock); ok {
+						if len(s.Text.Text) > slackMaxSectionText {
+							t.Errorf("buildSlackMessages() section has %v characters", len(s.Text.Text))
+						}
+						size += len(s.Text.Text)
+					}
+				}
+				if size > slackMaxMessageText {
+					t.Errorf("buildSlackMessages() message has %v characters", size)
+				}
+			}
 		})
 	}
 }
+
+func Test_truncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"a longer text", 8, "a lon..."},
+		{"ab→cd", 6, "ab..."},
+		{"abcdef", 2, "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := truncate(tt.s, tt.max); got != tt.want {
+				t.Errorf("truncate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_slackNotifier_sendBlocks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		posts    []url.Values
+		uploaded bool
+		shared   url.Values
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			r.ParseForm()
+			posts = append(posts, r.PostForm)
+			fmt.Fprint(w, `{"ok":true,"channel":"C0123455","ts":"1700000000.000100"}`)
+		case "/auth.test":
+			fmt.Fprint(w, `{"ok":true,"user_id":"U1"}`)
+		case "/files.getUploadURLExternal":
+			fmt.Fprintf(w, `{"ok":true,"upload_url":"http://%s/upload/F1","file_id":"F1"}`, r.Host)
+		case "/upload/F1":
+			r.ParseForm()
+			uploaded = strings.HasPrefix(r.PostForm.Get("content"), "source,")
+		case "/files.completeUploadExternal":
+			r.ParseForm()
+			shared = r.PostForm
+			fmt.Fprint(w, `{"ok":true,"files":[{"id":"F1","title":"images.csv"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	result := &runResult{RunID: "run1", Ok: true}
+	for i := 0; i < 2000; i++ {
+		result.Images = append(result.Images, imageResult{Source: "docker.io/nginx", ECRURL: "123.dkr.ecr.eu-west-1.amazonaws.com/nginx", Tag: fmt.Sprintf("1.%d.0", i), Status: statusSynced})
+	}
+	s := &slackNotifier{apiURL: server.URL + "/", attachCSV: true, channelID: "C0123455", format: slackFormatBlocks, token: "xoxb-test"}
+
+	if err := s.send(context.Background(), notification{subject: "subject", result: result}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if len(posts) < 2 {
+		t.Fatalf("send() posted %v messages, want thread replies", len(posts))
+	}
+	if posts[0].Get("thread_ts") != "" {
+		t.Errorf("send() first message is a thread reply")
+	}
+	for _, p := range posts[1:] {
+		if p.Get("thread_ts") != "1700000000.000100" {
+			t.Errorf("send() reply thread_ts = %v", p.Get("thread_ts"))
+		}
+	}
+	if !uploaded || shared.Get("channel_id") != "C0123455" || shared.Get("thread_ts") != "1700000000.000100" {
+		t.Errorf("send() csv uploaded %v and shared with %v, want it in the thread", uploaded, shared)
+	}
+}
@@ -1,9 +1,11 @@
 package lambda
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 
@@ -12,8 +14,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
-
-	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type loginOptions struct {
@@ -27,6 +28,13 @@ type syncOptions struct {
 	tags         []string
 	source       string
 	ecrImageName string
+	failed       map[string]error    // tags that failed to copy
+	maxSize      int64               // max compressed size of an image in bytes, no limit when 0
+	pending      []string            // tags left for the next run when the run stopped before the lambda deadline
+	rule         *WorkItem           // repository options that selected the tags, recorded in the provenance
+	skipped      []string            // selected tags that are already on ECR
+	tooLarge     map[string]string   // tags skipped because of the max size with the reason
+	transfers    map[string]transfer // bytes moved by the copied tags
 }
 
 func login(opts loginOptions) error {
@@ -61,38 +69,64 @@ func login(opts loginOptions) error {
 	if err := cf.Save(); err != nil {
 		return err
 	}
-	log.Printf("logged in via %s", cf.Filename)
+	slog.Debug("logged in", "registry", opts.serverAddress, "config", cf.Filename, logKeyPhase, phaseSetup)
 	return nil
 }
 
-func (svc *ecrClient) copyImageWithCrane(imageName, tag, awsPrefix, ecrImageName string) (err error) {
-	params := crane.Options{
-		Platform: &v1.Platform{
-			Architecture: "amd64",
-			OS:           "linux",
-		},
+// copyImageWithCrane copies the tag, or the digest of the tag when resolved, to the ECR and returns the bytes uploaded
+// and skipped, sizes are the blob sizes of the image by digest when known
+func (svc *ecrClient) copyImageWithCrane(ctx context.Context, imageName, tag, digest, awsPrefix, ecrImageName string, sizes map[string]int64) (_ transfer, err error) {
+	ctx, span := startSpan(ctx, "copy "+ecrImageName+":"+tag, attribute.String(attrRepository, ecrImageName), attribute.String(attrSource, imageName), attribute.String(attrTag, tag))
+	defer func() { endSpan(span, err) }()
+	counter := &transferTransport{inner: svc.registryTransport(), sizes: sizes}
+	opts := append(svc.craneOptions(ctx), crane.WithTransport(counter))
+	source := imageName + ":" + tag
+
+	// copy the resolved digest so the copied image can't differ from the digest in the provenance
+	if digest != "" {
+		source = imageName + "@" + digest
 	}
 
-	opts := []crane.Option{crane.WithPlatform(params.Platform)}
-
-	if err := crane.Copy((imageName + ":" + tag), (awsPrefix + "/" + ecrImageName + ":" + tag), opts...); err != nil {
-		log.Printf("error copying image: %v", err)
+	if err := crane.Copy(source, (awsPrefix + "/" + ecrImageName + ":" + tag), opts...); err != nil {
 		if strings.Contains(err.Error(), "no child with platform linux/amd64") {
-			return nil
+			svc.log().Warn("image has no linux/amd64 platform", logKeyPhase, phaseSync, logKeyRepository, ecrImageName, logKeySource, imageName, logKeyTag, tag)
+			return transfer{}, nil
 		}
-		return err
+		return transfer{}, err
 	}
+	t := counter.result()
+	span.SetAttributes(attribute.Int64(attrBytesUploaded, t.uploaded), attribute.Int64(attrBytesSkipped, t.skipped))
 
-	return nil
+	return t, nil
+}
+
+// checkSize returns the reason to skip the tag when the image is larger than the max size and the blob sizes of the
+// image, images with an unknown size are copied
+func (svc *ecrClient) checkSize(ctx context.Context, options syncOptions, tag string) (reason string, sizes map[string]int64) {
+	if options.maxSize <= 0 {
+		return "", nil
+	}
+	size, sizes, err := imageSize(options.source+":"+tag, svc.craneOptions(ctx)...)
+
+	if err != nil {
+		svc.log().Warn("error getting image size, copying without size check", logKeyPhase, phaseSync, logKeyRepository, options.ecrImageName, logKeySource, options.source, logKeyTag, tag, logKeyError, err)
+		return "", nil
+	}
+
+	if size > options.maxSize {
+		return fmt.Sprintf("image size %s exceeds ecr_sync_max_size %s", formatBytes(size), formatBytes(options.maxSize)), sizes
+	}
+	return "", sizes
 }
 
-func (svc *ecrClient) authToECR(env environmentVars) error {
+func (svc *ecrClient) authToECR(ctx context.Context, env environmentVars) error {
 	awsPrefix := env.awsAccount + ".dkr.ecr." + env.awsRegion + ".amazonaws.com"
-	log.Printf("add login for %v", awsPrefix)
-	awsAuthData, err := svc.getECRAuthData()
+	logger := svc.log().With(logKeyPhase, phaseSetup, "registry", awsPrefix)
+	logger.Debug("adding login for ecr")
+	awsAuthData, err := svc.getECRAuthData(ctx)
 
 	if err != nil {
-		log.Println("error getting authdata: ", err)
+		logger.Error("error getting ecr auth data", logKeyError, err)
 		return err
 	}
 
@@ -103,23 +137,74 @@ func (svc *ecrClient) authToECR(env environmentVars) error {
 	})
 
 	if err != nil {
-		log.Println("error authentication to ecr: ", err)
+		logger.Error("error authenticating to ecr", logKeyError, err)
 		return err
 	}
 	return err
 }
 
-func (svc *ecrClient) syncImages(options syncOptions, env environmentVars) (err error) {
+// syncImages copies the tags to the ECR, continues on errors and returns the options with the copied, failed, too large
+// and pending tags and the first error, tags not copied before the lambda deadline are returned as pending
+func (svc *ecrClient) syncImages(ctx context.Context, options syncOptions, env environmentVars) (result syncOptions, err error) {
+	ctx, span := startSpan(ctx, phaseSync+" "+options.ecrImageName, attribute.String(attrRepository, options.ecrImageName), attribute.String(attrSource, options.source), attribute.Int(attrTags, len(options.tags)))
+	defer func() { endSpan(span, err) }()
 	awsPrefix := env.awsAccount + ".dkr.ecr." + env.awsRegion + ".amazonaws.com"
 
-	for _, tag := range options.tags {
-		log.Printf("copying %s:%s to %s/%s:%s", options.source, tag, awsPrefix, options.ecrImageName, tag)
-		err := svc.copyImageWithCrane(options.source, tag, awsPrefix, options.ecrImageName)
+	logger := svc.log().With(logKeyPhase, phaseSync, logKeyRepository, options.ecrImageName, logKeySource, options.source)
+	result = options
+	result.tags = nil
 
-		if err != nil {
-			log.Println("error copying image: ", err)
-			return err
+	for i, tag := range options.tags {
+		if svc.checkpoint.stop(ctx) {
+			logger.Warn("stopping before the lambda deadline", "pending", len(options.tags)-i)
+			result.pending = options.tags[i:]
+			return result, err
+		}
+		reason, sizes := svc.checkSize(ctx, options, tag)
+
+		if reason != "" {
+			logger.Warn("skipping image", logKeyTag, tag, "reason", reason)
+			svc.checkpoint.done(ctx, options.ecrImageName, tag, nil)
+
+			if result.tooLarge == nil {
+				result.tooLarge = make(map[string]string)
+			}
+			result.tooLarge[tag] = reason
+			continue
+		}
+		result.tags = append(result.tags, tag)
+
+		logger.Info("copying image", logKeyTag, tag, "destination", awsPrefix+"/"+options.ecrImageName+":"+tag)
+		digest := svc.sourceDigest(ctx, options.source, tag)
+		t, copyErr := svc.copyImageWithCrane(ctx, options.source, tag, digest, awsPrefix, options.ecrImageName, sizes)
+		svc.metrics.addError(options.ecrImageName, copyErr)
+		svc.checkpoint.done(ctx, options.ecrImageName, tag, copyErr)
+
+		if copyErr == nil {
+			logger.Info("copied image", logKeyTag, tag, "bytes_uploaded", t.uploaded, "bytes_skipped", t.skipped)
+			svc.metrics.add(options.ecrImageName, func(r *repositoryMetrics) { r.tagsCopied++ })
+
+			if result.transfers == nil {
+				result.transfers = make(map[string]transfer)
+			}
+			result.transfers[tag] = t
+
+			if err := svc.recordProvenance(ctx, options, tag, digest, awsPrefix+"/"+options.ecrImageName+":"+tag); err != nil {
+				logger.Warn("error pushing provenance", logKeyTag, tag, logKeyError, err)
+			}
+		}
+
+		if copyErr != nil {
+			logger.Error("error copying image", logKeyTag, tag, logKeyError, copyErr)
+			if result.failed == nil {
+				result.failed = make(map[string]error)
+			}
+			result.failed[tag] = copyErr
+
+			if err == nil {
+				err = copyErr
+			}
 		}
 	}
-	return err
+	return result, err
 }
@@ -0,0 +1,83 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+const (
+	cloudTrailDetailType = "AWS API Call via CloudTrail"
+	ecrEventSource       = "aws.ecr"
+	ecrTagResource       = "TagResource"
+	ecrUntagResource     = "UntagResource"
+	ecrSyncTagPrefix     = "ecr_sync"
+)
+
+// errEventIgnored is returned for events that don't need a sync, like tag changes without ecr_sync tags
+var errEventIgnored = errors.New("event ignored")
+
+// ecrTagEvent is the cloudtrail detail of an ecr TagResource or UntagResource call
+type ecrTagEvent struct {
+	ErrorCode         string `json:"errorCode"`
+	EventName         string `json:"eventName"`
+	RequestParameters struct {
+		ResourceArn string     `json:"resourceArn"`
+		TagKeys     []string   `json:"tagKeys"`
+		Tags        []*ecr.Tag `json:"tags"`
+	} `json:"requestParameters"`
+}
+
+// isECRTagEvent returns true for eventbridge events of ecr api calls recorded by cloudtrail
+func isECRTagEvent(source, detailType string) bool {
+	return source == ecrEventSource && detailType == cloudTrailDetailType
+}
+
+// parseECRTagEvent returns a sync request for the repository of a TagResource or UntagResource event that changed ecr_sync tags,
+// the tags of the repository are validated before the sync
+func parseECRTagEvent(detail []byte) (event LambdaEvent, err error) {
+	var call ecrTagEvent
+
+	if err := json.Unmarshal(detail, &call); err != nil {
+		return event, fmt.Errorf("decoding cloudtrail event: %w", err)
+	}
+
+	if call.ErrorCode != "" || (call.EventName != ecrTagResource && call.EventName != ecrUntagResource) {
+		return event, errEventIgnored
+	}
+	keys := call.RequestParameters.TagKeys
+
+	for _, t := range call.RequestParameters.Tags {
+		if t != nil && t.Key != nil {
+			keys = append(keys, *t.Key)
+		}
+	}
+
+	if !hasSyncTag(keys) {
+		return event, errEventIgnored
+	}
+	_, repo, found := strings.Cut(call.RequestParameters.ResourceArn, ":repository/")
+
+	if !found || repo == "" {
+		return event, fmt.Errorf("invalid ecr repository arn: %s", call.RequestParameters.ResourceArn)
+	}
+
+	return LambdaEvent{
+		Action:       actionSync,
+		Repositories: []string{repo},
+		ValidateTags: true,
+	}, nil
+}
+
+// hasSyncTag returns true if one of the keys is an ecr_sync tag
+func hasSyncTag(keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(k, ecrSyncTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
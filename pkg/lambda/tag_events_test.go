@@ -0,0 +1,72 @@
+package lambda
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_parseECRTagEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		detail  string
+		want    LambdaEvent
+		wantErr error
+	}{
+		{
+			name:   "TestTagResource",
+			detail: `{"eventName":"TagResource","requestParameters":{"resourceArn":"arn:aws:ecr:eu-west-1:123456789012:repository/dev/nginx","tags":[{"key":"ecr_sync_constraint","value":"-ge 1.25"}]}}`,
+			want:   LambdaEvent{Action: actionSync, Repositories: []string{"dev/nginx"}, ValidateTags: true},
+		},
+		{
+			name:   "TestUntagResource",
+			detail: `{"eventName":"UntagResource","requestParameters":{"resourceArn":"arn:aws:ecr:eu-west-1:123456789012:repository/nginx","tagKeys":["team","ecr_sync_exclude_tags"]}}`,
+			want:   LambdaEvent{Action: actionSync, Repositories: []string{"nginx"}, ValidateTags: true},
+		},
+		{
+			name:    "TestOtherTags",
+			detail:  `{"eventName":"TagResource","requestParameters":{"resourceArn":"arn:aws:ecr:eu-west-1:123456789012:repository/nginx","tags":[{"key":"team","value":"platform"}]}}`,
+			wantErr: errEventIgnored,
+		},
+		{
+			name:    "TestFailedCall",
+			detail:  `{"eventName":"TagResource","errorCode":"AccessDenied","requestParameters":{"resourceArn":"arn:aws:ecr:eu-west-1:123456789012:repository/nginx","tags":[{"key":"ecr_sync_source","value":"docker.io/nginx"}]}}`,
+			wantErr: errEventIgnored,
+		},
+		{
+			name:    "TestOtherCall",
+			detail:  `{"eventName":"PutImage","requestParameters":{"repositoryName":"nginx"}}`,
+			wantErr: errEventIgnored,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseECRTagEvent([]byte(tt.detail))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseECRTagEvent() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseECRTagEvent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HandlerECRTagEvent(t *testing.T) {
+	requests := stubStartSync(t)
+	tagEvent := `{"detail-type":"AWS API Call via CloudTrail","source":"aws.ecr","detail":{"eventName":"TagResource","requestParameters":{"resourceArn":"arn:aws:ecr:eu-west-1:123456789012:repository/dev/nginx","tags":[{"key":"ecr_sync_source","value":"docker.io/nginx"}]}}}`
+	otherEvent := `{"detail-type":"AWS API Call via CloudTrail","source":"aws.ecr","detail":{"eventName":"TagResource","requestParameters":{"resourceArn":"arn:aws:ecr:eu-west-1:123456789012:repository/dev/nginx","tags":[{"key":"team","value":"platform"}]}}}`
+
+	for _, payload := range []string{tagEvent, otherEvent, `{"Records":[{"messageId":"1","eventSource":"aws:sqs","body":` + jsonQuote(otherEvent) + `}]}`} {
+		if _, err := Handler(context.Background(), []byte(payload)); err != nil {
+			t.Fatalf("Handler() error = %v", err)
+		}
+	}
+	want := []LambdaEvent{{Action: actionSync, Repositories: []string{"dev/nginx"}, ValidateTags: true}}
+
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("Handler() requests = %v, want %v", *requests, want)
+	}
+}
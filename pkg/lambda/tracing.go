@@ -0,0 +1,166 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// span attribute names, documented in the README
+const (
+	attrAction          = "ecr_sync.action"
+	attrBytesSkipped    = "ecr_sync.bytes_skipped"
+	attrBytesUploaded   = "ecr_sync.bytes_uploaded"
+	attrRegistry        = "registry.host"
+	attrRepository      = "ecr_sync.repository"
+	attrRequestBytes    = "http.request.body.size"
+	attrResponseBytes   = "http.response.body.size"
+	attrRunID           = "ecr_sync.run_id"
+	attrSource          = "ecr_sync.source"
+	attrTag             = "ecr_sync.tag"
+	attrTags            = "ecr_sync.tags"
+	attrTagsSeen        = "ecr_sync.tags_seen"
+	attrTagsSelected    = "ecr_sync.tags_selected"
+	defaultServiceName  = "lambda-ecr-image-sync"
+	tracerName          = "github.com/martijnvdp/lambda-ecr-image-sync"
+	tracesExporterEnv   = "OTEL_TRACES_EXPORTER"
+	tracesExporterNone  = "none"
+	tracesExporterOTLP  = "otlp"
+	tracesExporterPrint = "stdout"
+)
+
+// spanAttributesTransport adds the registry host and body sizes to the client span
+type spanAttributesTransport struct {
+	inner http.RoundTripper
+}
+
+var (
+	tracerProvider     *sdktrace.TracerProvider
+	tracerProviderErr  error
+	tracerProviderOnce sync.Once
+)
+
+// newSpanExporter returns the span exporter for otlp or stdout
+func newSpanExporter(ctx context.Context, exporter string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(exporter) {
+	case tracesExporterOTLP:
+		// endpoint and headers are read from the OTEL_EXPORTER_OTLP_* environment variables
+		return otlptracehttp.New(ctx)
+	case tracesExporterPrint, "console":
+		return stdouttrace.New(stdouttrace.WithWriter(w))
+	}
+	return nil, fmt.Errorf("unknown traces exporter: %s", exporter)
+}
+
+// newTracerProvider returns a tracer provider for the exporter, nil when tracing is disabled
+func newTracerProvider(ctx context.Context, exporter string, w io.Writer) (*sdktrace.TracerProvider, error) {
+	if exporter == "" || strings.EqualFold(exporter, tracesExporterNone) {
+		return nil, nil
+	}
+	spanExporter, err := newSpanExporter(ctx, exporter, w)
+
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	), err
+}
+
+// initTracing sets up the global tracer provider once per lambda instance, the provider is reused by warm starts
+func initTracing(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	tracerProviderOnce.Do(func() {
+		tracerProvider, tracerProviderErr = newTracerProvider(ctx, os.Getenv(tracesExporterEnv), os.Stdout)
+
+		if tracerProvider != nil {
+			otel.SetTracerProvider(tracerProvider)
+			otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		}
+	})
+	return tracerProvider, tracerProviderErr
+}
+
+// startSpan starts a span with the tracer of the package
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// recordError records the error on the span and marks the span as failed
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// endSpan records the error on the span and ends it
+func endSpan(span trace.Span, err error) {
+	recordError(span, err)
+	span.End()
+}
+
+// httpSpanName returns the span name of a client request, the path is left out to keep the cardinality low
+func httpSpanName(_ string, req *http.Request) string {
+	return req.Method + " " + req.URL.Host
+}
+
+// newTracingTransport returns a transport creating a client span for every round trip, retries get their own span
+func newTracingTransport(inner http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(&spanAttributesTransport{inner: inner}, otelhttp.WithSpanNameFormatter(httpSpanName))
+}
+
+// httpTransport returns the transport for the aws clients, instrumented when tracing is enabled
+func httpTransport(inner http.RoundTripper) http.RoundTripper {
+	if tracerProvider == nil {
+		return inner
+	}
+	return newTracingTransport(inner)
+}
+
+// RoundTrip adds the attributes to the span created by otelhttp
+func (t *spanAttributesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(attribute.String(attrRegistry, req.URL.Host))
+	var body *countingReader
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countingReader{ReadCloser: req.Body}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	resp, err := t.inner.RoundTrip(req)
+
+	if body != nil {
+		span.SetAttributes(attribute.Int64(attrRequestBytes, body.count))
+	}
+
+	if resp != nil && resp.ContentLength >= 0 {
+		span.SetAttributes(attribute.Int64(attrResponseBytes, resp.ContentLength))
+	}
+	return resp, err
+}
@@ -0,0 +1,107 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_newTracerProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter string
+		wantNil  bool
+		wantErr  bool
+	}{
+		{name: "TestDisabled", exporter: "", wantNil: true},
+		{name: "TestNone", exporter: "none", wantNil: true},
+		{name: "TestStdout", exporter: "stdout"},
+		{name: "TestUnknown", exporter: "jaeger", wantNil: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			got, err := newTracerProvider(context.Background(), tt.exporter, &b)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newTracerProvider() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("newTracerProvider() = %v, wantNil %v", got, tt.wantNil)
+			}
+			if got == nil {
+				return
+			}
+			_, span := got.Tracer(tracerName).Start(context.Background(), "filter dev/nginx")
+			span.End()
+			got.Shutdown(context.Background())
+
+			if !strings.Contains(b.String(), "filter dev/nginx") {
+				t.Errorf("newTracerProvider() exported %s", b.String())
+			}
+		})
+	}
+}
+
+func Test_tracingTransport_RoundTrip(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(previous)
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	transport := newTracingTransport(http.DefaultTransport)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/v2/dev/nginx/blobs/uploads/1", strings.NewReader("0123456789"))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("0123456789")), nil }
+
+	// every round trip of a retried request gets its own span
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			req.Body, _ = req.GetBody()
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("RoundTrip() recorded %v spans, want 2", len(spans))
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[1].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	if spans[1].Name() != "PUT "+host || attrs[attrRegistry].AsString() != host {
+		t.Errorf("RoundTrip() span = %v, registry = %v", spans[1].Name(), attrs[attrRegistry].AsString())
+	}
+	if attrs[attrRequestBytes].AsInt64() != 10 || attrs[attrResponseBytes].AsInt64() != 2 {
+		t.Errorf("RoundTrip() attributes = %v", attrs)
+	}
+}
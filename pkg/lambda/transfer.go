@@ -0,0 +1,146 @@
+package lambda
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// sizeUnits are the units of ecr_sync_max_size, longest first so KiB is matched before B
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"t", 1e12},
+	{"b", 1},
+}
+
+var matchBlobDigest = regexp.MustCompile(`/blobs/(sha256:[0-9a-f]+)$`)
+
+// transfer is the number of bytes moved by the copy of a tag
+type transfer struct {
+	uploaded int64 // bytes of the blobs uploaded to the ecr
+	skipped  int64 // bytes of the blobs already on the ecr or mounted from another repository
+}
+
+// transferTransport counts the bytes uploaded and skipped by a single copy
+type transferTransport struct {
+	inner    http.RoundTripper
+	mu       sync.Mutex
+	sizes    map[string]int64 // blob sizes by digest, used for mounted blobs
+	transfer transfer
+}
+
+// parseSize parses a size like 500MB, 1.5GiB or 1073741824
+func parseSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	multiplier := 1.0
+
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, use bytes or a unit like 500MB or 2GiB", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// formatBytes returns the size in the largest decimal unit like 10.2 GB
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size, i := float64(n), 0
+
+	for ; size >= 1000 && i < len(units)-1; i++ {
+		size /= 1000
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// imageSize returns the compressed size of the layers of the image and the sizes of its blobs by digest
+func imageSize(ref string, opts ...crane.Option) (size int64, blobs map[string]int64, err error) {
+	img, err := crane.Pull(ref, opts...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, nil, err
+	}
+	blobs = map[string]int64{manifest.Config.Digest.String(): manifest.Config.Size}
+
+	for _, l := range manifest.Layers {
+		blobs[l.Digest.String()] = l.Size
+		size += l.Size
+	}
+	return size, blobs, nil
+}
+
+func (t *transferTransport) add(uploaded, skipped int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.transfer.uploaded += uploaded
+	t.transfer.skipped += skipped
+}
+
+// result returns the bytes counted so far
+func (t *transferTransport) result() transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.transfer
+}
+
+// RoundTrip counts the blob uploads, the existing blobs and the mounted blobs of the copy
+func (t *transferTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upload := strings.Contains(req.URL.Path, "/blobs/uploads/")
+	var body *countingReader
+
+	if upload && req.Body != nil && (req.Method == http.MethodPatch || req.Method == http.MethodPut) {
+		body = &countingReader{ReadCloser: req.Body}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	resp, err := t.inner.RoundTrip(req)
+
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		return resp, err
+	}
+
+	switch {
+	case body != nil:
+		t.add(body.count, 0)
+	case req.Method == http.MethodHead && resp.StatusCode == http.StatusOK:
+		if match := matchBlobDigest.FindStringSubmatch(req.URL.Path); match != nil {
+			t.add(0, t.blobSize(match[1], resp.ContentLength))
+		}
+	case upload && req.Method == http.MethodPost && resp.StatusCode == http.StatusCreated:
+		if mount := req.URL.Query().Get("mount"); mount != "" {
+			t.add(0, t.blobSize(mount, -1))
+		}
+	}
+	return resp, err
+}
+
+// blobSize returns the known size of the blob, the content length of the response otherwise
+func (t *transferTransport) blobSize(digest string, contentLength int64) int64 {
+	if size, ok := t.sizes[digest]; ok {
+		return size
+	}
+	return max(contentLength, 0)
+}
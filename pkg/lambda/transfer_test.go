@@ -0,0 +1,104 @@
+package lambda
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_parseSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{name: "bytes", size: "1073741824", want: 1 << 30},
+		{name: "decimal unit", size: "500MB", want: 500e6},
+		{name: "binary unit", size: "2GiB", want: 2 << 30},
+		{name: "fraction with space", size: "1.5 gb", want: 1.5e9},
+		{name: "short unit", size: "10G", want: 10e9},
+		{name: "invalid", size: "big", wantErr: true},
+		{name: "negative", size: "-1GB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_formatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 512, want: "512 B"},
+		{n: 1500, want: "1.5 KB"},
+		{n: 10_240_000_000, want: "10.2 GB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatBytes(tt.n); got != tt.want {
+				t.Errorf("formatBytes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_transferTransport_RoundTrip(t *testing.T) {
+	const existing, mounted = "sha256:aaaa", "sha256:bbbb"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		switch {
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/blobs/"+existing):
+			w.Header().Set("Content-Length", "300")
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Query().Get("mount") != "":
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+
+	counter := &transferTransport{inner: http.DefaultTransport, sizes: map[string]int64{mounted: 200}}
+	client := &http.Client{Transport: counter}
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodHead, "/v2/dev/nginx/blobs/" + existing, ""},
+		{http.MethodHead, "/v2/dev/nginx/blobs/sha256:cccc", ""},
+		{http.MethodPost, "/v2/dev/nginx/blobs/uploads/?mount=" + mounted + "&from=dev/base", ""},
+		{http.MethodPost, "/v2/dev/nginx/blobs/uploads/", ""},
+		{http.MethodPatch, "/v2/dev/nginx/blobs/uploads/1234", "0123456789"},
+		{http.MethodPut, "/v2/dev/nginx/manifests/latest", "{}"},
+	}
+
+	for _, r := range requests {
+		req, _ := http.NewRequest(r.method, server.URL+r.path, strings.NewReader(r.body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := counter.result(); got.uploaded != 10 || got.skipped != 500 {
+		t.Errorf("RoundTrip() transfer = %+v, want 10 bytes uploaded and 500 bytes skipped", got)
+	}
+}
@@ -0,0 +1,216 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
+)
+
+const (
+	problemError   = "error"   // the repository is not synced
+	problemWarning = "warning" // the repository is synced but the tags probably don't do what was intended
+)
+
+// knownSyncTags are the ecr_sync tags read from the repositories
+var knownSyncTags = map[string]bool{
+	"ecr_sync_calver":             true,
+	"ecr_sync_constraint":         true,
+	"ecr_sync_dedupe":             true,
+	"ecr_sync_exclude_repos":      true,
+	"ecr_sync_exclude_rls":        true,
+	"ecr_sync_exclude_tags":       true,
+	"ecr_sync_group_by":           true,
+	"ecr_sync_groups":             true,
+	"ecr_sync_include_repos":      true,
+	"ecr_sync_include_rls":        true,
+	"ecr_sync_include_tags":       true,
+	"ecr_sync_lifecycle_prefixes": true,
+	"ecr_sync_max_results":        true,
+	"ecr_sync_max_size":           true,
+	"ecr_sync_opt":                true,
+	"ecr_sync_release_only":       true,
+	"ecr_sync_source":             true,
+	"ecr_sync_tags_per_group":     true,
+	"ecr_sync_untagged_days":      true,
+	"ecr_sync_variants":           true,
+}
+
+// tagProblem is a problem found in the ecr_sync tags of a repository
+type tagProblem struct {
+	Repository string `json:"repository"`
+	Key        string `json:"key"`
+	Level      string `json:"level"` // error or warning
+	Message    string `json:"message"`
+}
+
+func (p tagProblem) String() string {
+	return fmt.Sprintf("%s: %s %s: %s", p.Repository, p.Level, p.Key, p.Message)
+}
+
+// addProblem adds a problem with a key of the repository
+type addProblem func(level, key, format string, a ...interface{})
+
+// validateRepositoryTags returns the problems in the ecr_sync tags of a repository
+func validateRepositoryTags(repo string, tags []*ecr.Tag) (problems []tagProblem) {
+	parsed := parseTags(tags)
+	add := func(level, key, format string, a ...interface{}) {
+		problems = append(problems, tagProblem{Repository: repo, Key: key, Level: level, Message: fmt.Sprintf(format, a...)})
+	}
+
+	for _, check := range []func(map[string]string, addProblem){checkKnownTags, checkNumberTags, checkGroupTags, checkBoolTags, checkPatternTags, checkCombinedTags} {
+		check(parsed, add)
+	}
+	return problems
+}
+
+// checkKnownTags checks for unknown tags and the required source
+func checkKnownTags(parsed map[string]string, add addProblem) {
+	for _, key := range sortedKeys(parsed) {
+		if !knownSyncTags[key] {
+			add(problemWarning, key, "unknown tag")
+		}
+	}
+
+	if parsed["ecr_sync_source"] == "" {
+		add(problemError, "ecr_sync_source", "not set, the repository is not synced")
+	}
+}
+
+// checkNumberTags checks the counts and the size
+func checkNumberTags(parsed map[string]string, add addProblem) {
+	for _, key := range []string{"ecr_sync_max_results", "ecr_sync_groups", "ecr_sync_tags_per_group", "ecr_sync_untagged_days"} {
+		if v := parsed[key]; v != "" {
+			if n, err := strconv.Atoi(v); err != nil || n < 0 {
+				add(problemError, key, "%q is not a non-negative number", v)
+			}
+		}
+	}
+
+	if v := parsed["ecr_sync_max_size"]; v != "" {
+		if _, err := parseSize(v); err != nil {
+			add(problemError, "ecr_sync_max_size", "%v", err)
+		}
+	}
+}
+
+// checkGroupTags checks the version line grouping
+func checkGroupTags(parsed map[string]string, add addProblem) {
+	if v := parsed["ecr_sync_group_by"]; v != "" && v != groupByMajor && v != groupByMinor {
+		add(problemError, "ecr_sync_group_by", "%q is not major or minor", v)
+	} else if v == "" && (parsed["ecr_sync_groups"] != "" || parsed["ecr_sync_tags_per_group"] != "") {
+		add(problemWarning, "ecr_sync_group_by", "not set, ecr_sync_groups and ecr_sync_tags_per_group are ignored")
+	}
+}
+
+// checkBoolTags checks the booleans
+func checkBoolTags(parsed map[string]string, add addProblem) {
+	for _, key := range []string{"ecr_sync_dedupe", "ecr_sync_release_only"} {
+		if v := parsed[key]; v != "" {
+			if _, err := strconv.ParseBool(v); err != nil {
+				add(problemError, key, "%q is not true or false", v)
+			}
+		}
+	}
+}
+
+// checkPatternTags checks the constraint, the calendar version layouts and the variant patterns
+func checkPatternTags(parsed map[string]string, add addProblem) {
+	if v := parsed["ecr_sync_constraint"]; v != "" {
+		if _, err := parseConstraint(v); err != nil {
+			add(problemError, "ecr_sync_constraint", "%v", err)
+		}
+	}
+
+	for _, l := range stringToSlice(parsed["ecr_sync_calver"]) {
+		if _, err := version.NewCalVerFormat(l); err != nil {
+			add(problemError, "ecr_sync_calver", "%v", err)
+		}
+	}
+
+	for _, key := range []string{"ecr_sync_variants", "ecr_sync_include_repos", "ecr_sync_exclude_repos"} {
+		for _, p := range stringToSlice(parsed[key]) {
+			if _, err := path.Match(p, ""); err != nil {
+				add(problemError, key, "invalid pattern %q", p)
+			}
+		}
+	}
+}
+
+// checkCombinedTags checks for tags that are ignored or contradict each other
+func checkCombinedTags(parsed map[string]string, add addProblem) {
+	if !isNamespaceSource(parsed["ecr_sync_source"]) && (parsed["ecr_sync_include_repos"] != "" || parsed["ecr_sync_exclude_repos"] != "") {
+		add(problemWarning, "ecr_sync_source", "not a namespace like quay.io/cilium/*, ecr_sync_include_repos and ecr_sync_exclude_repos are ignored")
+	}
+
+	for _, pair := range [][2]string{{"ecr_sync_include_tags", "ecr_sync_exclude_tags"}, {"ecr_sync_include_rls", "ecr_sync_exclude_rls"}} {
+		if both := intersect(stringToSlice(parsed[pair[0]]), stringToSlice(parsed[pair[1]])); len(both) > 0 {
+			add(problemWarning, pair[1], "%s are included and excluded by %s", strings.Join(both, " "), pair[0])
+		}
+	}
+}
+
+// intersect returns the values of a that are also in b
+func intersect(a, b []string) (both []string) {
+	in := make(map[string]bool, len(b))
+
+	for _, v := range b {
+		in[v] = true
+	}
+
+	for _, v := range a {
+		if in[v] {
+			both = append(both, v)
+		}
+	}
+	return both
+}
+
+// sortTagProblems sorts the problems by repository and keeps the order of the problems of a repository
+func sortTagProblems(problems []tagProblem) {
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Repository < problems[j].Repository })
+}
+
+// checkSources returns a problem for every repository with a source that can't be listed
+func (svc *ecrClient) checkSources(ctx context.Context, repositories []inputRepository, max int) (problems []tagProblem) {
+	errs := make([]error, len(repositories))
+
+	forEach(len(repositories), max, func(i int) {
+		_, errs[i] = repositories[i].getTagsFromPublicRepo(svc.craneOptions(ctx)...)
+	})
+
+	for i, err := range errs {
+		if err != nil {
+			problems = append(problems, tagProblem{Repository: repositories[i].ecrImageName, Key: "ecr_sync_source", Level: problemError, Message: fmt.Sprintf("unreachable: %v", err)})
+		}
+	}
+	return problems
+}
+
+// notifyTagProblems sends the tag problems to the notifiers
+func notifyTagProblems(ctx context.Context, n notifiers, runID string, problems []tagProblem) {
+	if len(problems) == 0 {
+		return
+	}
+	lines := make([]string, 0, len(problems))
+
+	for _, p := range problems {
+		lines = append(lines, p.String())
+	}
+	now := time.Now()
+
+	n.notify(ctx, &runResult{
+		Action:   actionValidate,
+		Error:    "invalid ecr_sync tags:\n" + strings.Join(lines, "\n"),
+		Finished: now,
+		Message:  fmt.Sprintf("Found %d problems in the ecr_sync tags", len(problems)),
+		RunID:    runID,
+		Started:  now,
+	})
+}
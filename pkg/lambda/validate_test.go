@@ -0,0 +1,61 @@
+package lambda
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func Test_validateRepositoryTags(t *testing.T) {
+	tag := func(key, value string) *ecr.Tag {
+		return &ecr.Tag{Key: aws.String(key), Value: aws.String(value)}
+	}
+	tests := []struct {
+		name string
+		tags []*ecr.Tag
+		want []string
+	}{
+		{
+			name: "TestValid",
+			tags: []*ecr.Tag{tag("ecr_sync_opt", "in"), tag("ecr_sync_source", "docker.io/nginx"), tag("ecr_sync_constraint", "-ge 1.25"), tag("ecr_sync_max_results", "5")},
+		},
+		{
+			name: "TestMissingSource",
+			tags: []*ecr.Tag{tag("ecr_sync_opt", "in")},
+			want: []string{"ecr_sync_source"},
+		},
+		{
+			name: "TestInvalidValues",
+			tags: []*ecr.Tag{tag("ecr_sync_source", "docker.io/nginx"), tag("ecr_sync_constraint", "-ge one"), tag("ecr_sync_max_results", "five")},
+			want: []string{"ecr_sync_max_results", "ecr_sync_constraint"},
+		},
+		{
+			name: "TestUnknownOperator",
+			tags: []*ecr.Tag{tag("ecr_sync_source", "docker.io/nginx"), tag("ecr_sync_constraint", "-ap 1.25")},
+			want: []string{"ecr_sync_constraint"},
+		},
+		{
+			name: "TestUnknownKeyAndBool",
+			tags: []*ecr.Tag{tag("ecr_sync_source", "docker.io/nginx"), tag("ecr_sync_max_result", "5"), tag("ecr_sync_release_only", "yes")},
+			want: []string{"ecr_sync_max_result", "ecr_sync_release_only"},
+		},
+		{
+			name: "TestContradiction",
+			tags: []*ecr.Tag{tag("ecr_sync_source", "docker.io/nginx"), tag("ecr_sync_include_tags", "1.25 1.26"), tag("ecr_sync_exclude_tags", "1.26"), tag("ecr_sync_include_rls", "alpine"), tag("ecr_sync_exclude_rls", "rc")},
+			want: []string{"ecr_sync_exclude_tags"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range validateRepositoryTags("dev/nginx", tt.tags) {
+				got = append(got, p.Key)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateRepositoryTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package lambda
+
+import (
+	"path"
+	"strings"
+
+	"github.com/martijnvdp/lambda-ecr-image-sync/external/go-version"
+)
+
+// variantDefault is the variant of tags without suffix like 1.25.3
+const variantDefault = "default"
+
+// variantOf returns the first variant pattern matching the suffix of the version, false if no pattern matches.
+// The suffix is everything after the first - like alpine for 1.25.3-alpine, patterns can contain wildcards like alpine*
+func variantOf(v *version.Version, patterns []string) (string, bool) {
+	suffix := v.Prerelease()
+
+	for _, p := range patterns {
+		if p == variantDefault {
+			if suffix == "" {
+				return p, true
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(p, suffix); ok && suffix != "" {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// checkVariantTags returns the newest versions of every variant, max results, constraints and groups apply to the
+// version without suffix within each variant
+func (i *inputRepository) checkVariantTags(sortedTags []*version.Version, c version.Constraints, maxResults int) (result []string) {
+	for _, variant := range i.variants {
+		budget := maxResults
+		groups := i.newVersionGroups()
+
+		for x := len(sortedTags) - 1; x != -1 && budget != 0; x-- {
+			v := sortedTags[x]
+
+			if match, ok := variantOf(v, i.variants); !ok || match != variant {
+				continue
+			}
+
+			if !i.checkVariantTag(v, variant, c) || !groups.add(v.Core()) {
+				continue
+			}
+			result = append(result, v.Original())
+			budget--
+		}
+	}
+	return result
+}
+
+// variantRelease returns the release of a variant tag, the parts of the suffix that don't match the variant like rc1
+// for 1.26.0-rc1-alpine with the variant *alpine
+func variantRelease(v *version.Version, variant string) string {
+	var release []string
+
+	for _, part := range strings.Split(v.Prerelease(), "-") {
+		if ok, _ := path.Match(variant, part); !ok && part != "" {
+			release = append(release, part)
+		}
+	}
+	return strings.Join(release, "-")
+}
+
+// checkVariantTag returns true if the tag passes the include and exclude tags, the release filters and the
+// constraint, the release filters apply to the suffix without the variant like they apply to the prerelease of a tag
+func (i *inputRepository) checkVariantTag(v *version.Version, variant string, c version.Constraints) bool {
+	release := variantRelease(v, variant)
+
+	switch {
+	case len(i.includeTags) > 0:
+		return i.checkIncTags(v.Original())
+	case i.checkExcTags(v.Original()):
+		return false
+	case release == "" && i.releaseOnly:
+		return false
+	case release != "" && (compareReleases(release, i.excludeRLS) || !compareReleases(release, i.includeRLS)):
+		return false
+	case i.constraint != "":
+		return c.Check(v.Core())
+	}
+	return true
+}
+
+// compareReleases returns true when a part of the release starts with one of the releases
+func compareReleases(release string, releases []string) bool {
+	for _, part := range strings.Split(release, "-") {
+		for _, r := range releases {
+			if strings.HasPrefix(part, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
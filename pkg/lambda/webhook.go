@@ -0,0 +1,329 @@
+package lambda
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	webhookMaxBodySize     = 1 << 20
+	webhookSecretEnvVar    = "WEBHOOK_SECRET"
+	webhookSecretParam     = "secret"
+	webhookSignatureHeader = "X-Hub-Signature-256"
+)
+
+var errWebhookUnauthorized = errors.New("invalid webhook secret or signature")
+
+// webhookPush is a pushed image parsed from a registry webhook
+type webhookPush struct {
+	provider string
+	source   string
+	tags     []string
+}
+
+// httpRequest contains the fields shared by function url, api gateway http api and rest api events
+type httpRequest struct {
+	Body                  string            `json:"body"`
+	Headers               map[string]string `json:"headers"`
+	IsBase64Encoded       bool              `json:"isBase64Encoded"`
+	QueryStringParameters map[string]string `json:"queryStringParameters"`
+}
+
+type httpResponse struct {
+	Body       string            `json:"body"`
+	Headers    map[string]string `json:"headers"`
+	StatusCode int               `json:"statusCode"`
+}
+
+type dockerHubWebhook struct {
+	PushData struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+type quayWebhook struct {
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+type githubPackage struct {
+	Name           string                `json:"name"`
+	Namespace      string                `json:"namespace"`
+	PackageType    string                `json:"package_type"`
+	PackageVersion *githubPackageVersion `json:"package_version"`
+}
+
+type githubPackageVersion struct {
+	ContainerMetadata *struct {
+		Tag struct {
+			Name string `json:"name"`
+		} `json:"tag"`
+	} `json:"container_metadata"`
+}
+
+type githubWebhook struct {
+	Package         *githubPackage `json:"package"`
+	RegistryPackage *githubPackage `json:"registry_package"`
+}
+
+type harborWebhook struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			ResourceURL string `json:"resource_url"`
+			Tag         string `json:"tag"`
+		} `json:"resources"`
+	} `json:"event_data"`
+}
+
+// verifyWebhook checks the github style hmac signature, the shared secret in the authorization header as set by harbor,
+// or the secret query parameter for registries that can't set headers like docker hub and quay
+func verifyWebhook(header http.Header, query url.Values, body []byte, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("%s not set: %w", webhookSecretEnvVar, errWebhookUnauthorized)
+	}
+
+	if signature := header.Get(webhookSignatureHeader); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		if hmac.Equal([]byte(signature), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			return nil
+		}
+		return errWebhookUnauthorized
+	}
+	candidates := []string{strings.TrimPrefix(header.Get("Authorization"), "Bearer "), query.Get(webhookSecretParam)}
+
+	for _, c := range candidates {
+		if c != "" && subtle.ConstantTimeCompare([]byte(c), []byte(secret)) == 1 {
+			return nil
+		}
+	}
+	return errWebhookUnauthorized
+}
+
+// parseWebhook returns the pushed image of a docker hub, quay, github packages or harbor webhook
+func parseWebhook(body []byte) (push webhookPush, err error) {
+	var keys map[string]json.RawMessage
+
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return push, fmt.Errorf("decoding webhook: %w", err)
+	}
+
+	switch {
+	case keys["push_data"] != nil:
+		var hook dockerHubWebhook
+
+		if err := json.Unmarshal(body, &hook); err != nil {
+			return push, fmt.Errorf("decoding docker hub webhook: %w", err)
+		}
+		push = webhookPush{provider: "dockerhub", source: "docker.io/" + hook.Repository.RepoName, tags: []string{hook.PushData.Tag}}
+	case keys["docker_url"] != nil:
+		var hook quayWebhook
+
+		if err := json.Unmarshal(body, &hook); err != nil {
+			return push, fmt.Errorf("decoding quay webhook: %w", err)
+		}
+		push = webhookPush{provider: "quay", source: hook.DockerURL, tags: hook.UpdatedTags}
+	case keys["registry_package"] != nil || keys["package"] != nil:
+		if push, err = parseGitHubWebhook(body); err != nil {
+			return push, err
+		}
+	case keys["event_data"] != nil:
+		var hook harborWebhook
+
+		if err := json.Unmarshal(body, &hook); err != nil {
+			return push, fmt.Errorf("decoding harbor webhook: %w", err)
+		}
+
+		if hook.Type != "PUSH_ARTIFACT" {
+			return push, fmt.Errorf("unsupported harbor event type: %s", hook.Type)
+		}
+		push.provider = "harbor"
+
+		for _, r := range hook.EventData.Resources {
+			ref, err := name.ParseReference(r.ResourceURL)
+
+			if err != nil {
+				return push, fmt.Errorf("parsing harbor resource url: %w", err)
+			}
+			push.source = ref.Context().Name()
+			push.tags = append(push.tags, r.Tag)
+		}
+	default:
+		return push, fmt.Errorf("unknown webhook payload")
+	}
+	push.tags = nonEmpty(push.tags)
+
+	if push.source == "" || len(push.tags) == 0 {
+		return push, fmt.Errorf("%s webhook without repository or tag", push.provider)
+	}
+	return push, err
+}
+
+// parseGitHubWebhook returns the pushed container of a github registry_package or package webhook
+func parseGitHubWebhook(body []byte) (push webhookPush, err error) {
+	var hook githubWebhook
+
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return push, fmt.Errorf("decoding github webhook: %w", err)
+	}
+	pkg := hook.RegistryPackage
+
+	if pkg == nil {
+		pkg = hook.Package
+	}
+
+	if pkg == nil {
+		return push, fmt.Errorf("github webhook without package")
+	}
+
+	if !strings.EqualFold(pkg.PackageType, "container") {
+		return push, fmt.Errorf("unsupported github package type: %s", pkg.PackageType)
+	}
+
+	if pkg.PackageVersion == nil || pkg.PackageVersion.ContainerMetadata == nil {
+		return push, fmt.Errorf("github webhook without container metadata")
+	}
+	return webhookPush{provider: "github", source: "ghcr.io/" + strings.ToLower(pkg.Namespace+"/"+pkg.Name), tags: []string{pkg.PackageVersion.ContainerMetadata.Tag.Name}}, nil
+}
+
+// nonEmpty returns the non empty strings
+func nonEmpty(s []string) (result []string) {
+	for _, v := range s {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// acceptWebhook verifies and parses the webhook, the status is 0 when the push is accepted
+func acceptWebhook(header http.Header, query url.Values, body []byte) (push webhookPush, status int, message string) {
+	if err := verifyWebhook(header, query, body, os.Getenv(webhookSecretEnvVar)); err != nil {
+		slog.Warn("rejected webhook", logKeyError, err)
+		return push, http.StatusUnauthorized, errWebhookUnauthorized.Error()
+	}
+	push, err := parseWebhook(body)
+
+	if err != nil {
+		return push, http.StatusBadRequest, err.Error()
+	}
+	slog.Info("received webhook", "provider", push.provider, logKeySource, push.source, "tags", push.tags)
+	return push, 0, ""
+}
+
+// handleWebhook verifies the webhook and syncs the pushed tags to the ecr repositories with that source
+func handleWebhook(ctx context.Context, header http.Header, query url.Values, body []byte) (status int, message string) {
+	push, status, message := acceptWebhook(header, query, body)
+
+	if status != 0 {
+		return status, message
+	}
+	return syncPush(ctx, push)
+}
+
+// syncPush syncs the pushed tags to the ecr repositories with the source of the push
+func syncPush(ctx context.Context, push webhookPush) (status int, message string) {
+	// pushed tags may move, compare digests to sync tags like latest again
+	resp, err := startSync(ctx, LambdaEvent{
+		Action:      actionSync,
+		CheckDigest: true,
+		Sources:     []string{push.source},
+		Tags:        push.tags,
+	})
+
+	if err != nil {
+		return http.StatusInternalServerError, resp.Message
+	}
+	return http.StatusOK, resp.Message
+}
+
+// handleHTTPRequest handles a function url or api gateway request
+func handleHTTPRequest(ctx context.Context, req httpRequest) (httpResponse, error) {
+	body := []byte(req.Body)
+
+	if req.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(req.Body)
+
+		if err != nil {
+			return webhookResponse(http.StatusBadRequest, "invalid base64 body"), nil
+		}
+		body = decoded
+	}
+	header := http.Header{}
+
+	for k, v := range req.Headers {
+		header.Set(k, v)
+	}
+	query := url.Values{}
+
+	for k, v := range req.QueryStringParameters {
+		query.Set(k, v)
+	}
+	return webhookResponse(handleWebhook(ctx, header, query, body)), nil
+}
+
+// webhookResponse returns the json response of the webhook
+func webhookResponse(status int, message string) httpResponse {
+	body, _ := json.Marshal(response{Message: message, Ok: status == http.StatusOK || status == http.StatusAccepted})
+
+	return httpResponse{
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		StatusCode: status,
+	}
+}
+
+// WebhookHTTPHandler returns the webhook receiver as http handler for running a local server. Registries close the
+// connection after a few seconds, so the push is acknowledged with 202 and synced on a context detached from the request
+func WebhookHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize))
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		push, status, message := acceptWebhook(r.Header, r.URL.Query(), body)
+
+		if status == 0 {
+			status, message = http.StatusAccepted, fmt.Sprintf("syncing %s:%s", push.source, strings.Join(push.tags, ","))
+
+			go func(ctx context.Context) {
+				if status, message := syncPush(ctx, push); status != http.StatusOK {
+					slog.Error("error syncing webhook push", logKeySource, push.source, "tags", push.tags, logKeyError, message)
+				}
+			}(context.WithoutCancel(r.Context()))
+		}
+		resp := webhookResponse(status, message)
+
+		for k, v := range resp.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.WriteString(w, resp.Body)
+	})
+}
@@ -0,0 +1,213 @@
+package lambda
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_verifyWebhook(t *testing.T) {
+	body := []byte(`{"action":"published"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		query   url.Values
+		secret  string
+		wantErr bool
+	}{
+		{name: "TestSignature", header: http.Header{"X-Hub-Signature-256": {signature}}, secret: "secret"},
+		{name: "TestInvalidSignature", header: http.Header{"X-Hub-Signature-256": {"sha256=00"}}, query: url.Values{"secret": {"secret"}}, secret: "secret", wantErr: true},
+		{name: "TestAuthorization", header: http.Header{"Authorization": {"secret"}}, secret: "secret"},
+		{name: "TestBearer", header: http.Header{"Authorization": {"Bearer secret"}}, secret: "secret"},
+		{name: "TestQuery", query: url.Values{"secret": {"secret"}}, secret: "secret"},
+		{name: "TestWrongSecret", query: url.Values{"secret": {"other"}}, secret: "secret", wantErr: true},
+		{name: "TestNoSecretConfigured", query: url.Values{"secret": {""}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyWebhook(tt.header, tt.query, body, tt.secret); (err != nil) != tt.wantErr {
+				t.Errorf("verifyWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    webhookPush
+		wantErr bool
+	}{
+		{
+			name: "TestDockerHub",
+			body: `{"push_data":{"tag":"1.25.3"},"repository":{"repo_name":"bitnami/nginx"}}`,
+			want: webhookPush{provider: "dockerhub", source: "docker.io/bitnami/nginx", tags: []string{"1.25.3"}},
+		},
+		{
+			name: "TestQuay",
+			body: `{"docker_url":"quay.io/prometheus/node-exporter","updated_tags":["v1.7.0","latest"]}`,
+			want: webhookPush{provider: "quay", source: "quay.io/prometheus/node-exporter", tags: []string{"v1.7.0", "latest"}},
+		},
+		{
+			name: "TestGithub",
+			body: `{"action":"published","package":{"name":"App","namespace":"Owner","package_type":"CONTAINER","package_version":{"container_metadata":{"tag":{"name":"v2.0.0"}}}}}`,
+			want: webhookPush{provider: "github", source: "ghcr.io/owner/app", tags: []string{"v2.0.0"}},
+		},
+		{
+			name:    "TestGithubNullPackage",
+			body:    `{"action":"published","registry_package":null}`,
+			wantErr: true,
+		},
+		{
+			name:    "TestGithubWithoutVersion",
+			body:    `{"action":"published","package":{"name":"app","namespace":"owner","package_type":"container"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "TestGithubNpm",
+			body:    `{"action":"published","package":{"name":"app","namespace":"owner","package_type":"npm"}}`,
+			wantErr: true,
+		},
+		{
+			name: "TestHarbor",
+			body: `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/library/app:v1.0.0","tag":"v1.0.0"}]}}`,
+			want: webhookPush{provider: "harbor", source: "harbor.example.com/library/app", tags: []string{"v1.0.0"}},
+		},
+		{
+			name:    "TestHarborDelete",
+			body:    `{"type":"DELETE_ARTIFACT","event_data":{"resources":[]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "TestUntaggedPush",
+			body:    `{"push_data":{"tag":""},"repository":{"repo_name":"bitnami/nginx"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "TestUnknown",
+			body:    `{"hello":"world"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWebhook([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseWebhook() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWebhook() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handleHTTPRequest(t *testing.T) {
+	t.Setenv(webhookSecretEnvVar, "secret")
+	requests := stubStartSync(t)
+	body := `{"push_data":{"tag":"1.25.3"},"repository":{"repo_name":"bitnami/nginx"}}`
+
+	tests := []struct {
+		name       string
+		payload    string
+		want       int
+		wantSynced bool
+	}{
+		{
+			name:       "TestFunctionURL",
+			payload:    `{"rawPath":"/","requestContext":{},"queryStringParameters":{"secret":"secret"},"body":` + jsonQuote(body) + `}`,
+			want:       http.StatusOK,
+			wantSynced: true,
+		},
+		{
+			name:    "TestUnauthorized",
+			payload: `{"rawPath":"/","requestContext":{},"queryStringParameters":{"secret":"wrong"},"body":` + jsonQuote(body) + `}`,
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "TestBadRequest",
+			payload: `{"httpMethod":"POST","requestContext":{},"headers":{"authorization":"secret"},"body":"{}"}`,
+			want:    http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*requests = nil
+			got, err := Handler(context.Background(), []byte(tt.payload))
+			if err != nil {
+				t.Fatalf("Handler() error = %v", err)
+			}
+			resp, ok := got.(httpResponse)
+			if !ok {
+				t.Fatalf("Handler() = %T, want httpResponse", got)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("Handler() status = %v, want %v", resp.StatusCode, tt.want)
+			}
+			if tt.wantSynced {
+				want := []LambdaEvent{{Action: actionSync, CheckDigest: true, Sources: []string{"docker.io/bitnami/nginx"}, Tags: []string{"1.25.3"}}}
+				if !reflect.DeepEqual(*requests, want) {
+					t.Errorf("Handler() requests = %v, want %v", *requests, want)
+				}
+			} else if len(*requests) > 0 {
+				t.Errorf("Handler() requests = %v, want none", *requests)
+			}
+		})
+	}
+}
+
+func Test_WebhookHTTPHandler(t *testing.T) {
+	t.Setenv(webhookSecretEnvVar, "secret")
+	synced := make(chan error, 1)
+	previous := startSync
+	startSync = func(ctx context.Context, event LambdaEvent) (response, error) {
+		synced <- ctx.Err()
+		return response{Ok: true}, nil
+	}
+	t.Cleanup(func() { startSync = previous })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/?secret=secret", strings.NewReader(`{"docker_url":"quay.io/app/app","updated_tags":["v1"]}`)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	WebhookHTTPHandler().ServeHTTP(rec, req)
+	// the registry closes the connection
+	cancel()
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("WebhookHTTPHandler() status = %v, want %v", rec.Code, http.StatusAccepted)
+	}
+
+	select {
+	case err := <-synced:
+		if err != nil {
+			t.Errorf("WebhookHTTPHandler() synced with a cancelled context: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("WebhookHTTPHandler() did not sync the push")
+	}
+
+	rec = httptest.NewRecorder()
+	WebhookHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("WebhookHTTPHandler() status = %v, want %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func jsonQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,118 @@
+package lambda
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	actionDiscover = "discover"
+	actionS3       = "s3"
+	actionSync     = "sync"
+	actionSyncOne  = "sync-one"
+	actionValidate = "validate"
+
+	// WorkItemVersion is the version of the work item schema, it changes when fields are removed or change meaning
+	WorkItemVersion = "1"
+)
+
+// WorkItem is a repository to sync returned by the discover action and processed by the sync-one action,
+// fields have to be exported and are part of the public interface
+type WorkItem struct {
+	Version      string   `json:"version"`
+	Repository   string   `json:"repository"` // ecr repository name
+	Source       string   `json:"source"`
+	CalVer       []string `json:"calver,omitempty"`
+	Constraint   string   `json:"constraint,omitempty"`
+	Dedupe       bool     `json:"dedupe,omitempty"`
+	ExcludeRLS   []string `json:"exclude_rls,omitempty"`
+	ExcludeTags  []string `json:"exclude_tags,omitempty"`
+	GroupBy      string   `json:"group_by,omitempty"`
+	Groups       int      `json:"groups,omitempty"`
+	TagsPerGroup int      `json:"tags_per_group,omitempty"`
+	IncludeRLS   []string `json:"include_rls,omitempty"`
+	IncludeTags  []string `json:"include_tags,omitempty"`
+	MaxResults   int      `json:"max_results,omitempty"`
+	MaxSize      int64    `json:"max_size,omitempty"` // bytes
+	ReleaseOnly  bool     `json:"release_only,omitempty"`
+	Variants     []string `json:"variants,omitempty"`
+
+	LifecyclePrefixes []string `json:"lifecycle_prefixes,omitempty"`
+	UntaggedDays      int      `json:"untagged_days,omitempty"`
+}
+
+// workItemsFromRepositories returns the work items of the repositories sorted by repository, repositories without source are left out
+func workItemsFromRepositories(repositories []inputRepository) (items []WorkItem) {
+	items = []WorkItem{}
+
+	for _, r := range repositories {
+		if r.source == "" {
+			continue
+		}
+		items = append(items, *r.workItem())
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Repository < items[j].Repository })
+	return items
+}
+
+// workItem returns the work item of the repository
+func (i *inputRepository) workItem() *WorkItem {
+	return &WorkItem{
+		Version:      WorkItemVersion,
+		Repository:   i.ecrImageName,
+		Source:       i.source,
+		CalVer:       i.calVer,
+		Constraint:   i.constraint,
+		Dedupe:       i.dedupe,
+		ExcludeRLS:   i.excludeRLS,
+		ExcludeTags:  i.excludeTags,
+		GroupBy:      i.groupBy,
+		Groups:       i.groups,
+		TagsPerGroup: i.tagsPerGroup,
+		IncludeRLS:   i.includeRLS,
+		IncludeTags:  i.includeTags,
+		MaxResults:   i.maxResults,
+		MaxSize:      i.maxSize,
+		ReleaseOnly:  i.releaseOnly,
+		Variants:     i.variants,
+
+		LifecyclePrefixes: i.lifecyclePrefixes,
+		UntaggedDays:      i.untaggedDays,
+	}
+}
+
+// inputRepository returns the repository of the work item
+func (w *WorkItem) inputRepository() (inputRepository, error) {
+	if w == nil {
+		return inputRepository{}, fmt.Errorf("work item is required for action %s", actionSyncOne)
+	}
+
+	if w.Version != WorkItemVersion {
+		return inputRepository{}, fmt.Errorf("unsupported work item version %q, expected %q", w.Version, WorkItemVersion)
+	}
+
+	if w.Repository == "" || w.Source == "" {
+		return inputRepository{}, fmt.Errorf("work item requires repository and source")
+	}
+	return inputRepository{
+		calVer:       w.CalVer,
+		constraint:   w.Constraint,
+		dedupe:       w.Dedupe,
+		ecrImageName: w.Repository,
+		excludeRLS:   w.ExcludeRLS,
+		excludeTags:  w.ExcludeTags,
+		groupBy:      w.GroupBy,
+		groups:       w.Groups,
+		tagsPerGroup: w.TagsPerGroup,
+		source:       w.Source,
+		includeRLS:   w.IncludeRLS,
+		includeTags:  w.IncludeTags,
+		maxResults:   w.MaxResults,
+		maxSize:      w.MaxSize,
+		releaseOnly:  w.ReleaseOnly,
+		variants:     w.Variants,
+
+		lifecyclePrefixes: w.LifecyclePrefixes,
+		untaggedDays:      w.UntaggedDays,
+	}, nil
+}
@@ -0,0 +1,73 @@
+package lambda
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_workItemsFromRepositories(t *testing.T) {
+	repositories := []inputRepository{
+		{ecrImageName: "dev/redis", source: "docker.io/bitnami/redis", constraint: ">= 7.0", maxResults: 5, releaseOnly: true},
+		{ecrImageName: "dev/missing-source"},
+		{ecrImageName: "dev/nginx", source: "docker.io/nginx", excludeTags: []string{"latest"}},
+	}
+	got := workItemsFromRepositories(repositories)
+	want := []WorkItem{
+		{Version: WorkItemVersion, Repository: "dev/nginx", Source: "docker.io/nginx", ExcludeTags: []string{"latest"}},
+		{Version: WorkItemVersion, Repository: "dev/redis", Source: "docker.io/bitnami/redis", Constraint: ">= 7.0", MaxResults: 5, ReleaseOnly: true},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("workItemsFromRepositories() = %+v, want %+v", got, want)
+	}
+
+	// the schema is consumed by step functions and must stay stable
+	content, _ := json.Marshal(got[1])
+	wantJSON := `{"version":"1","repository":"dev/redis","source":"docker.io/bitnami/redis","constraint":"\u003e= 7.0","max_results":5,"release_only":true}`
+
+	if string(content) != wantJSON {
+		t.Errorf("WorkItem json = %s, want %s", content, wantJSON)
+	}
+}
+
+func Test_WorkItem_inputRepository(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    *WorkItem
+		want    inputRepository
+		wantErr bool
+	}{
+		{
+			name: "TestValid",
+			item: &WorkItem{Version: "1", Repository: "dev/nginx", Source: "docker.io/nginx", IncludeRLS: []string{"alpine"}},
+			want: inputRepository{ecrImageName: "dev/nginx", source: "docker.io/nginx", includeRLS: []string{"alpine"}},
+		},
+		{
+			name:    "TestMissingItem",
+			wantErr: true,
+		},
+		{
+			name:    "TestUnsupportedVersion",
+			item:    &WorkItem{Version: "2", Repository: "dev/nginx", Source: "docker.io/nginx"},
+			wantErr: true,
+		},
+		{
+			name:    "TestMissingSource",
+			item:    &WorkItem{Version: "1", Repository: "dev/nginx"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.item.inputRepository()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("inputRepository() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inputRepository() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}